@@ -3,27 +3,43 @@ package main
 import (
 	"time"
 	"errors"
-	"os"
+	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var sampleSecretKey = []byte(os.Getenv("JWT_KEY"))
+var (
+	// set from the config by configureAuth
+	jwtKey []byte
+	tokenLifetime = 10 * time.Minute
+	mfaTokenLifetime = 5 * time.Minute
+)
 
 var (
 	ErrInvalidCredentials = errors.New("invalid credentials")
 	ErrInvalidToken = errors.New("invalid token")
 	ErrExpiredToken = errors.New("token has expired")
+	ErrMissingToken = errors.New("missing token")
 )
 
-func generateJWT(username string) (string, error) {
+// sets the signing key and token lifetimes
+func configureAuth(config AuthConfig) {
+	jwtKey = []byte(config.JWTKey)
+	tokenLifetime = time.Duration(config.TokenLifetime)
+	mfaTokenLifetime = time.Duration(config.MFATokenLifetime)
+}
+
+// the subject is the user's id, which stays valid when they change their username
+func generateJWT(userId int) (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"exp": time.Now().Add(10 * time.Minute).Unix(),
-		"sub": username,
+		"exp": time.Now().Add(tokenLifetime).Unix(),
+		"sub": strconv.Itoa(userId),
 		"iat": time.Now().Unix(),
 	})
 
-	tokenString, err := token.SignedString(sampleSecretKey)
+	tokenString, err := token.SignedString(jwtKey)
 	if err != nil {
 		return "", err
 	}
@@ -31,9 +47,74 @@ func generateJWT(username string) (string, error) {
 	return tokenString, nil
 }
 
+// generates a short-lived token proving the password step of a two-step login succeeded.
+// it can only be exchanged for an access token, never used as one
+func generateMFAToken(userId int) (string, error) {
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp": time.Now().Add(mfaTokenLifetime).Unix(),
+		"sub": strconv.Itoa(userId),
+		"iat": time.Now().Unix(),
+		"mfa": "pending",
+	})
+
+	return token.SignedString(jwtKey)
+}
+
+// verifies an access token
 func verifyJWT(tokenString string) (jwt.MapClaims, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := claims["mfa"]; ok {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// verifies an mfa pending token
+func verifyMFAToken(tokenString string) (jwt.MapClaims, error) {
+	claims, err := parseJWT(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if claims["mfa"] != "pending" {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
+
+// returns the user id of the access token in the Authorization header of r
+func authenticateRequest(r *http.Request) (int, error) {
+	header := r.Header.Get("Authorization")
+	tokenString, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || tokenString == "" {
+		return 0, ErrMissingToken
+	}
+	claims, err := verifyJWT(tokenString)
+	if err != nil {
+		return 0, err
+	}
+	return subjectId(claims)
+}
+
+// returns the user id a token was issued to
+func subjectId(claims jwt.MapClaims) (int, error) {
+	sub, err := claims.GetSubject()
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(sub)
+	if err != nil {
+		// tokens issued before users had ids carry a username
+		return 0, ErrInvalidToken
+	}
+	return id, nil
+}
+
+func parseJWT(tokenString string) (jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return sampleSecretKey, nil
+		return jwtKey, nil
 	})
 	
 	if err != nil {
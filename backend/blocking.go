@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// block a user
+	EventBlockUser = "block_user"
+	// unblock a user
+	EventUnblockUser = "unblock_user"
+	// get the users we blocked
+	EventGetBlockedUsers = "get_blocked_users"
+	// response to block_user, unblock_user and get_blocked_users
+	EventBlockedUsers = "blocked_users"
+)
+
+var (
+	ErrUserBlocked = errors.New("this user can't be contacted")
+)
+
+type BlockUserEvent struct {
+	Username string `json:"username"`
+}
+
+type BlockedUsersEvent struct {
+	Usernames []string `json:"usernames"`
+}
+
+func BlockUserHandler(event Event, c *Client) error {
+	var e BlockUserEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+	if target.id == c.user.id {
+		return fmt.Errorf("you can't block yourself")
+	}
+
+	// blocking someone also ends the contact
+	if err := c.hub.removeContact(c.user, target); err != nil {
+		return err
+	}
+	hidden, err := c.hub.db.getPresenceHiddenFrom(c.user.id)
+	if err != nil {
+		return err
+	}
+	if err := c.hub.db.blockUser(c.user.id, target.id); err != nil {
+		return err
+	}
+
+	// from now on we appear offline to them
+	if err := c.hub.announcePresenceChange(c.user, hidden); err != nil {
+		return err
+	}
+	return GetBlockedUsersHandler(event, c)
+}
+
+func UnblockUserHandler(event Event, c *Client) error {
+	var e BlockUserEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+
+	hidden, err := c.hub.db.getPresenceHiddenFrom(c.user.id)
+	if err != nil {
+		return err
+	}
+	if err := c.hub.db.unblockUser(c.user.id, target.id); err != nil {
+		return err
+	}
+
+	// unless our privacy settings still hide it
+	if err := c.hub.announcePresenceChange(c.user, hidden); err != nil {
+		return err
+	}
+	return GetBlockedUsersHandler(event, c)
+}
+
+func GetBlockedUsersHandler(event Event, c *Client) error {
+	blocked, err := c.hub.db.getBlockedUsernames(c.user.id)
+	if err != nil {
+		return err
+	}
+
+	response := BlockedUsersEvent{Usernames: blocked}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventBlockedUsers
+
+	c.send <- outgoingEvent
+	return nil
+}
+
+// tells recipient's clients that username connected or disconnected
+func sendPresence(h *Hub, recipient int, username string, eventType string) error {
+	data, err := json.Marshal(UserConnectedEvent{Username: username})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = eventType
+	h.sendToUser(recipient, outgoingEvent)
+	return nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix telling bot API tokens apart from JWTs
+	botTokenPrefix = "gcb_"
+
+	// scopes a bot token can be given
+	ScopeWebSocket = "ws"
+	ScopeMessagesWrite = "messages:write"
+
+	// command handed to a bot, sent to the bot's clients
+	EventBotCommand = "bot_command"
+)
+
+var botScopes = []string{ScopeWebSocket, ScopeMessagesWrite}
+
+var commandPattern = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+
+var (
+	ErrNotBotOwner = errors.New("only the bot's owner can do this")
+	ErrMissingScope = errors.New("token is missing the required scope")
+	ErrBotOffline = errors.New("the bot handling this command is offline")
+)
+
+// a long-lived API token of a bot
+type BotToken struct {
+	Id         int        `json:"id"`
+	Bot        string     `json:"bot"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+
+	botId int
+}
+
+// a slash command registered by a bot
+type BotCommand struct {
+	Command     string `json:"command"`
+	Bot         string `json:"bot"`
+	Description string `json:"description"`
+
+	botId int
+}
+
+// sent to a bot when someone uses one of its commands
+type BotCommandEvent struct {
+	Command string    `json:"command"`
+	Args    string    `json:"args"`
+	RoomId  int       `json:"room_id"`
+	From    string    `json:"from"`
+	Sent    time.Time `json:"sent"`
+}
+
+// returns a new token and the hash stored in the database.
+// tokens are random enough for an unsalted sha256 to be safe
+func generateBotToken() (string, string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", "", err
+	}
+	token := botTokenPrefix + base64.RawURLEncoding.EncodeToString(buf)
+	return token, hashBotToken(token), nil
+}
+
+func hashBotToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// returns the id of the bot a token belongs to, checking it was given scope
+func (h *Hub) authenticateBotToken(token string, scope string) (int, error) {
+	if !strings.HasPrefix(token, botTokenPrefix) {
+		return 0, ErrInvalidToken
+	}
+	bot, scopes, err := h.db.useBotToken(hashBotToken(token))
+	if errors.Is(err, BotTokenNotFoundError) {
+		return 0, ErrInvalidToken
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !slices.Contains(scopes, scope) {
+		return 0, ErrMissingScope
+	}
+	return bot, nil
+}
+
+// checks the authenticated user owns the bot whose id is in the path
+func (h *Hub) authorizeBotOwner(w http.ResponseWriter, r *http.Request) (*User, bool) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return nil, false
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad bot id", http.StatusBadRequest)
+		return nil, false
+	}
+	bot, err := h.db.getUser(id)
+	if errors.Is(err, UserNotFoundError) {
+		http.Error(w, BotNotFoundError.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving bot", http.StatusInternalServerError)
+		return nil, false
+	}
+	owner, err := h.db.getBotOwner(bot.id)
+	if errors.Is(err, BotNotFoundError) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving bot", http.StatusInternalServerError)
+		return nil, false
+	}
+	if owner != userId {
+		http.Error(w, ErrNotBotOwner.Error(), http.StatusForbidden)
+		return nil, false
+	}
+	return bot, true
+}
+
+// creates a bot account owned by the authenticated user
+func (h *Hub) createBotHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	owner, err := h.db.getUser(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	type createBotRequest struct {
+		Username string `json:"username"`
+	}
+
+	var req createBotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if validateUsername(req.Username) != nil {
+		http.Error(w, "bot username must be 1 to 64 letters, digits, '.', '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if _, err := h.db.getUserByUsername(req.Username); err == nil {
+		http.Error(w, "username already taken", http.StatusConflict)
+		return
+	}
+
+	bot := newUser(0, req.Username)
+	if err := h.db.addBot(bot, owner.id); err != nil {
+		http.Error(w, "Error creating bot", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		Id       int    `json:"id"`
+		Username string `json:"username"`
+		Owner    string `json:"owner"`
+	}
+	writeJSON(w, http.StatusCreated, response{Id: bot.id, Username: bot.username, Owner: owner.username})
+}
+
+// lists the usernames of the authenticated user's bots
+func (h *Hub) listBotsHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	bots, err := h.db.getBots(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving bots", http.StatusInternalServerError)
+		return
+	}
+	usernames := []string{}
+	for _, bot := range bots {
+		usernames = append(usernames, bot.username)
+	}
+	writeJSON(w, http.StatusOK, usernames)
+}
+
+// issues a token for the bot. the token is only returned in this response
+func (h *Hub) createBotTokenHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := h.authorizeBotOwner(w, r)
+	if !ok {
+		return
+	}
+
+	type createTokenRequest struct {
+		Scopes []string `json:"scopes"`
+	}
+
+	var req createTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Scopes) == 0 {
+		req.Scopes = botScopes
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(botScopes, scope) {
+			http.Error(w, fmt.Sprintf("unknown scope %q", scope), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tokenString, hash, err := generateBotToken()
+	if err != nil {
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+	token := &BotToken{Bot: bot.username, Scopes: req.Scopes, botId: bot.id}
+	if err := h.db.addBotToken(token, hash); err != nil {
+		http.Error(w, "Error storing token", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		*BotToken
+		Token string `json:"token"`
+	}
+	writeJSON(w, http.StatusCreated, response{BotToken: token, Token: tokenString})
+}
+
+func (h *Hub) listBotTokensHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := h.authorizeBotOwner(w, r)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.db.getBotTokens(bot.id)
+	if err != nil {
+		http.Error(w, "Error retrieving tokens", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, tokens)
+}
+
+func (h *Hub) revokeBotTokenHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := h.authorizeBotOwner(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("tokenId"))
+	if err != nil {
+		http.Error(w, "bad token id", http.StatusBadRequest)
+		return
+	}
+
+	err = h.db.revokeBotToken(bot.id, id)
+	if errors.Is(err, BotTokenNotFoundError) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error revoking token", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registers a slash command handled by the bot
+func (h *Hub) registerBotCommandHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := h.authorizeBotOwner(w, r)
+	if !ok {
+		return
+	}
+
+	var command BotCommand
+	if err := json.NewDecoder(r.Body).Decode(&command); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	command.Command = strings.TrimPrefix(strings.ToLower(command.Command), "/")
+	command.Bot = bot.username
+	command.botId = bot.id
+	if !commandPattern.MatchString(command.Command) {
+		http.Error(w, "command must be 1 to 32 lowercase letters, digits, '_' or '-'", http.StatusBadRequest)
+		return
+	}
+	if _, ok := h.commands[command.Command]; ok {
+		http.Error(w, "command is built in", http.StatusConflict)
+		return
+	}
+	if len(command.Description) > 255 {
+		http.Error(w, "description is longer than 255 characters", http.StatusBadRequest)
+		return
+	}
+
+	ok, err := h.db.setBotCommand(command)
+	if err != nil {
+		http.Error(w, "Error registering command", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "command already registered by another bot", http.StatusConflict)
+		return
+	}
+	writeJSON(w, http.StatusOK, command)
+}
+
+func (h *Hub) deleteBotCommandHandler(w http.ResponseWriter, r *http.Request) {
+	bot, ok := h.authorizeBotOwner(w, r)
+	if !ok {
+		return
+	}
+
+	if err := h.db.deleteBotCommand(bot.id, r.PathValue("command")); err != nil {
+		http.Error(w, "Error deleting command", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// posts a message as the bot, authenticated with a token with the messages:write scope
+func (h *Hub) postBotMessageHandler(w http.ResponseWriter, r *http.Request) {
+	tokenString, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	botId, err := h.authenticateBotToken(tokenString, ScopeMessagesWrite)
+	if errors.Is(err, ErrMissingScope) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.PathValue("id") != strconv.Itoa(botId) {
+		http.Error(w, "token does not belong to this bot", http.StatusForbidden)
+		return
+	}
+	user, err := h.db.getUser(botId)
+	if err != nil {
+		http.Error(w, "Error retrieving bot", http.StatusInternalServerError)
+		return
+	}
+
+	type postMessageRequest struct {
+		RoomId  int    `json:"room_id"`
+		Message string `json:"message"`
+		// plain or markdown, plain when empty
+		Format string `json:"format"`
+	}
+
+	var req postMessageRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	message, err := h.postMessage(user, SendMessageEvent{RoomId: req.RoomId, Message: req.Message, Format: req.Format})
+	if errors.Is(err, NotRoomMemberError) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, message)
+}
+
+// hands a command to the bot that registered it.
+// returns false when no bot registered it
+func dispatchBotCommand(c *Client, roomId int, name string, args string) (bool, error) {
+	command, err := c.hub.db.getBotCommand(name)
+	if errors.Is(err, CommandNotFoundError) {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+
+	// the bot must be in the room
+	if _, err := c.hub.db.getRoomRole(roomId, command.botId); err != nil {
+		if errors.Is(err, NotRoomMemberError) {
+			return true, fmt.Errorf("bot %s is not a member of this room", command.Bot)
+		}
+		return true, err
+	}
+	if !c.hub.isConnected(command.botId) {
+		return true, ErrBotOffline
+	}
+
+	data, err := json.Marshal(BotCommandEvent{
+		Command: command.Command,
+		Args: strings.TrimSpace(args),
+		RoomId: roomId,
+		From: c.user.username,
+		Sent: time.Now(),
+	})
+	if err != nil {
+		return true, fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventBotCommand
+	c.hub.sendToUser(command.botId, outgoingEvent)
+	return true, nil
+}
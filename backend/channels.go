@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+const (
+	// create a group room, public or private
+	EventCreateChannel = "create_channel"
+	// browse the public rooms
+	EventListPublicRooms = "list_public_rooms"
+	// response to list_public_rooms
+	EventPublicRooms = "public_rooms"
+	// read the latest messages of a public room without joining it
+	EventPreviewRoom = "preview_room"
+	// response to preview_room
+	EventRoomPreview = "room_preview"
+	// join a public room
+	EventJoinRoom = "join_room"
+	// leave a room
+	EventLeaveRoom = "leave_room"
+)
+
+// visibility of a room
+const (
+	RoomPrivate = "private"
+	RoomPublic = "public"
+)
+
+const (
+	// members a group room can have
+	maxChannelMembers = 10000
+
+	defaultPublicRoomsPage = 20
+	maxPublicRoomsPage = 50
+
+	defaultPreviewMessages = 20
+	maxPreviewMessages = 50
+)
+
+var (
+	ErrRoomNotPublic = errors.New("this room is not public")
+	ErrDirectRoomPublic = errors.New("direct rooms can't be public")
+	ErrOwnerLeaving = errors.New("transfer the ownership of the room before leaving it")
+)
+
+// a public room as listed by list_public_rooms
+type PublicRoom struct {
+	Id int `json:"id"`
+	Name string `json:"name"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	Avatar string `json:"avatar"`
+	Members int `json:"members"`
+	// the caller is a member
+	Joined bool `json:"joined"`
+}
+
+type CreateChannelEvent struct {
+	Name string `json:"name"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	// private when empty
+	Visibility string `json:"visibility"`
+}
+
+type ListPublicRoomsEvent struct {
+	// only rooms whose name or topic contains it, every public room when empty
+	Query string `json:"query"`
+	// public rooms to skip, for pagination
+	Offset int `json:"offset"`
+	Limit int `json:"limit"`
+}
+
+type PublicRoomsEvent struct {
+	Query string `json:"query"`
+	Rooms []PublicRoom `json:"rooms"`
+	// Offset of the next page, 0 on the last one
+	Next int `json:"next"`
+}
+
+type RoomIdEvent struct {
+	RoomId int `json:"room_id"`
+}
+
+type PreviewRoomEvent struct {
+	RoomId int `json:"room_id"`
+	Limit int `json:"limit"`
+}
+
+type RoomPreviewEvent struct {
+	Room PublicRoom `json:"room"`
+	// read-only, oldest first
+	Messages []NewMessageEvent `json:"messages"`
+}
+
+func CreateChannelHandler(event Event, c *Client) error {
+	var e CreateChannelEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	e.Name = strings.TrimSpace(e.Name)
+	e.Topic = strings.TrimSpace(e.Topic)
+	if e.Name == "" {
+		return fmt.Errorf("a channel needs a name")
+	}
+	if len(e.Name) > maxRoomNameLength {
+		return fmt.Errorf("room name is longer than %d characters", maxRoomNameLength)
+	}
+	if len(e.Topic) > maxRoomTopicLength {
+		return fmt.Errorf("room topic is longer than %d characters", maxRoomTopicLength)
+	}
+	if len(e.Description) > maxRoomDescriptionLength {
+		return fmt.Errorf("room description is longer than %d characters", maxRoomDescriptionLength)
+	}
+	if e.Visibility == "" {
+		e.Visibility = RoomPrivate
+	}
+	if e.Visibility != RoomPublic && e.Visibility != RoomPrivate {
+		return fmt.Errorf("room visibility must be %s or %s", RoomPublic, RoomPrivate)
+	}
+
+	room := newRoom(c.hub)
+	room.capacity = maxChannelMembers
+	room.name = e.Name
+	room.topic = e.Topic
+	room.description = e.Description
+	room.visibility = e.Visibility
+	go room.run()
+	id, err := c.hub.db.addRoom(room)
+	if err != nil {
+		return err
+	}
+	room.id = id
+	c.hub.registerRoom(room)
+
+	// the creator owns it, and is sent the room like any new member
+	return c.hub.addRoomMember(room, c.user, RoleOwner, "")
+}
+
+func ListPublicRoomsHandler(event Event, c *Client) error {
+	var e ListPublicRoomsEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	query := strings.TrimSpace(e.Query)
+	if len(query) > maxRoomNameLength {
+		return fmt.Errorf("search query is longer than %d characters", maxRoomNameLength)
+	}
+	if e.Offset < 0 {
+		e.Offset = 0
+	}
+	if e.Limit <= 0 {
+		e.Limit = defaultPublicRoomsPage
+	}
+	e.Limit = min(e.Limit, maxPublicRoomsPage)
+
+	rooms, err := c.hub.db.listPublicRooms(c.user.id, query, e.Offset, e.Limit)
+	if err != nil {
+		return err
+	}
+	response := PublicRoomsEvent{Query: e.Query, Rooms: rooms}
+	if len(rooms) == e.Limit {
+		response.Next = e.Offset + len(rooms)
+	}
+
+	data, err := json.Marshal(response)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventPublicRooms
+	c.send <- outgoingEvent
+	return nil
+}
+
+func PreviewRoomHandler(event Event, c *Client) error {
+	var e PreviewRoomEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	room, ok := c.hub.getRoom(e.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	// described to no member in particular, so every member is listed
+	described := room.describeTo(0, nil)
+	if described.Visibility != RoomPublic {
+		return ErrRoomNotPublic
+	}
+	if e.Limit <= 0 {
+		e.Limit = defaultPreviewMessages
+	}
+	e.Limit = min(e.Limit, maxPreviewMessages)
+
+	messages, err := c.hub.db.getRecentMessages(room.id, e.Limit)
+	if err != nil {
+		return err
+	}
+	joined := slices.ContainsFunc(described.Users, func(member RoomUser) bool {
+		return member.Id == c.user.id
+	})
+	preview := RoomPreviewEvent{
+		Room: PublicRoom{
+			Id: room.id,
+			Name: described.Name,
+			Topic: described.Topic,
+			Description: described.Description,
+			Avatar: described.Avatar,
+			Members: len(described.Users),
+			Joined: joined,
+		},
+		Messages: messages,
+	}
+
+	data, err := json.Marshal(preview)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventRoomPreview
+	c.send <- outgoingEvent
+	return nil
+}
+
+func JoinRoomHandler(event Event, c *Client) error {
+	var e RoomIdEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	room, ok := c.hub.getRoom(e.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	if room.describeTo(0, nil).Visibility != RoomPublic {
+		return ErrRoomNotPublic
+	}
+	return c.hub.addRoomMember(room, c.user, RoleMember, "")
+}
+
+func LeaveRoomHandler(event Event, c *Client) error {
+	var e RoomIdEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	room, ok := c.hub.getRoom(e.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	return c.hub.leaveRoom(room, c.user)
+}
+
+// removes user from the room at their own request. the owner has to hand the room over first,
+// unless they are the last member
+func (h *Hub) leaveRoom(room *Room, user *User) error {
+	role, err := h.db.getRoomRole(room.id, user.id)
+	if err != nil {
+		return err
+	}
+	if role == RoleOwner && len(room.describeTo(0, nil).Users) > 1 {
+		return ErrOwnerLeaving
+	}
+	return h.removeRoomMember(room, user, "")
+}
@@ -1,28 +1,14 @@
 package main
 
 import (
+	"crypto/rand"
 	"log"
 	"time"
-	"encoding/json"
+	"sync/atomic"
 
 	"github.com/gorilla/websocket"
 )
 
-const (
-	// Time allowed to write a message to the peer
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer
-	maxMessageSize = 512 
-)
-
-
 // Client is a the intermediary between the websocket connection and the hub
 type Client struct {
 	hub *Hub
@@ -36,14 +22,42 @@ type Client struct {
 	user *User
 
 	online bool
+
+	// unix nanoseconds of the last event received from the client, for push notifications
+	lastActive atomic.Int64
+
+	// random id of the connection, given in welcome
+	sessionId string
+
+	// negotiated in hello, nil until the client sends it
+	protocol atomic.Pointer[clientProtocol]
+
+	// the user's new username and display name, set by the hub and picked up
+	// by readMessages before the next event so only this client's goroutine writes user
+	renamed atomic.Pointer[User]
+
+	// wire format of the events, chosen by the websocket subprotocol
+	codec Codec
 }
 
 func newClient(h *Hub, conn *websocket.Conn, user *User) *Client {
-	return &Client{
+	c := &Client{
 		hub: h,
 		conn: conn,
 		user: user,
-		send: make(chan Event, maxMessageSize),
+		send: make(chan Event, h.config.WebSocket.SendBufferSize),
+		sessionId: rand.Text(),
+		codec: codecFor(conn.Subprotocol()),
+	}
+	c.lastActive.Store(time.Now().UnixNano())
+	return c
+}
+
+// takes the username and display name the user changed to, if they changed
+func (c *Client) applyRename() {
+	if user := c.renamed.Swap(nil); user != nil {
+		c.user.username = user.username
+		c.user.displayName = user.displayName
 	}
 }
 
@@ -53,7 +67,10 @@ func (c *Client) readMessages() {
 	defer func() {
 		c.hub.unregister <- c
 	}()
-	c.conn.SetReadLimit(maxMessageSize)
+	// Time allowed to read the next pong message from the peer
+	pongWait := time.Duration(c.hub.config.WebSocket.PongWait)
+
+	c.conn.SetReadLimit(c.hub.config.WebSocket.MaxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
 	c.conn.SetPongHandler(func(string) error { c.conn.SetReadDeadline(time.Now().Add(pongWait)); return nil})
 	for {
@@ -64,10 +81,12 @@ func (c *Client) readMessages() {
 			}
 			break
 		}
+		c.lastActive.Store(time.Now().UnixNano())
+		c.applyRename()
 
-		// unmarshal incoming data into Event
+		// decode incoming data into Event
 		var request Event
-		if err := json.Unmarshal(payload, &request); err != nil {
+		if err := c.codec.Decode(payload, &request); err != nil {
 			log.Printf("error unmarshalling message: %v", err)
 			break
 		}
@@ -76,10 +95,7 @@ func (c *Client) readMessages() {
 		if err := c.hub.routeEvent(request, c); err != nil {
 			log.Println("error handling message: ", err)
 
-			errorEvent := Event{
-				Type: "error",
-				Payload: json.RawMessage(`"` + err.Error() + `"`),
-			}
+			errorEvent := c.errorEvent(request.Type, err)
 
 			select {
 			case c.send <- errorEvent:
@@ -93,6 +109,12 @@ func (c *Client) readMessages() {
 // writes messages from the hub to the websocket connection.
 // one writeMessages goroutine is started with each connection to ensure only one write at a time
 func (c *Client) writeMessages() {
+	// Time allowed to write a message to the peer
+	writeWait := time.Duration(c.hub.config.WebSocket.WriteWait)
+
+	// Send pings to peer with this period. Must be less than pongWait
+	pingPeriod := (time.Duration(c.hub.config.WebSocket.PongWait) * 9) / 10
+
 	ticker := time.NewTicker(pingPeriod)
 	defer func() {
 		ticker.Stop()
@@ -109,46 +131,15 @@ func (c *Client) writeMessages() {
 				return
 			}
 
-			data, err := json.Marshal(message)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-
-			w, err := c.conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Println(err)
-				return
-			}
-			w.Write(data)
-
-			if err := w.Close(); err != nil {
+			if err := c.writeEvent(message); err != nil {
 				log.Println(err)
 				return
 			}
 
-			// Add queued chat messages to the current websocket message
+			// Send the queued chat messages too, each in its own websocket message
 			n := len(c.send)
 			for i := 0; i < n; i++ {
-				w.Write(newline)
-				
-				message = <-c.send
-
-				data, err := json.Marshal(message)
-				w, err := c.conn.NextWriter(websocket.TextMessage)
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				if err != nil {
-					log.Println(err)
-					return
-				}
-
-				w.Write(data)
-
-				if err := w.Close(); err != nil {
+				if err := c.writeEvent(<-c.send); err != nil {
 					log.Println(err)
 					return
 				}
@@ -163,3 +154,17 @@ func (c *Client) writeMessages() {
 	}
 }
 
+
+// encodes the event with the client's codec as one websocket message
+func (c *Client) writeEvent(event Event) error {
+	event = c.adapt(event)
+	w, err := c.conn.NextWriter(c.codec.MessageType())
+	if err != nil {
+		return err
+	}
+	if err := c.codec.Encode(w, event); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
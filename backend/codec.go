@@ -0,0 +1,431 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strconv"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"github.com/vmihailenco/msgpack/v5/msgpcode"
+)
+
+// websocket subprotocols selecting a codec, a client that asks for none speaks JSON
+const (
+	SubprotocolJSON = "gochat.json"
+	SubprotocolMessagePack = "gochat.msgpack"
+)
+
+// Codec encodes events on the wire. handlers always see JSON payloads,
+// codecs other than JSON convert them at the edge of the connection
+type Codec interface {
+	// websocket message type of the encoded events
+	MessageType() int
+	Encode(w io.Writer, event Event) error
+	Decode(data []byte, event *Event) error
+}
+
+// subprotocols offered to clients, the preferred first
+var subprotocols = []string{SubprotocolMessagePack, SubprotocolJSON}
+
+// returns the codec of the subprotocol negotiated by the upgrade
+func codecFor(subprotocol string) Codec {
+	if subprotocol == SubprotocolMessagePack {
+		return msgpackCodec{}
+	}
+	return jsonCodec{}
+}
+
+// jsonCodec is the default codec, an event is {"type": ..., "payload": ...}
+type jsonCodec struct{}
+
+func (jsonCodec) MessageType() int {
+	return websocket.TextMessage
+}
+
+// writes the payload as is instead of going through json.Marshal, which would validate
+// and compact it a second time. payloads are always built by json.Marshal
+func (jsonCodec) Encode(w io.Writer, event Event) error {
+	eventType, err := json.Marshal(event.Type)
+	if err != nil {
+		return err
+	}
+	payload := []byte(event.Payload)
+	if len(payload) == 0 {
+		payload = []byte("null")
+	}
+	var buf bytes.Buffer
+	buf.Grow(len(eventType) + len(payload) + 22)
+	buf.WriteString(`{"type":`)
+	buf.Write(eventType)
+	buf.WriteString(`,"payload":`)
+	buf.Write(payload)
+	buf.WriteByte('}')
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (jsonCodec) Decode(data []byte, event *Event) error {
+	return json.Unmarshal(data, event)
+}
+
+// msgpackCodec encodes an event as a MessagePack map with a type and a payload,
+// the payload being the MessagePack form of its JSON
+type msgpackCodec struct{}
+
+// an event as msgpackCodec decodes it
+type msgpackEvent struct {
+	Type string `msgpack:"type"`
+	Payload any `msgpack:"payload"`
+}
+
+func (msgpackCodec) MessageType() int {
+	return websocket.BinaryMessage
+}
+
+// transcodes the JSON payload straight into MessagePack in one pass over its bytes,
+// rather than decoding it into Go values and encoding those
+func (msgpackCodec) Encode(w io.Writer, event Event) error {
+	buf := make([]byte, 0, len(event.Type)+len(event.Payload)+16)
+	buf = append(buf, msgpcode.FixedMapLow|2)
+	buf = appendMsgpackString(buf, "type")
+	buf = appendMsgpackString(buf, event.Type)
+	buf = appendMsgpackString(buf, "payload")
+	if len(event.Payload) == 0 {
+		buf = append(buf, msgpcode.Nil)
+	} else {
+		t := jsonTranscoder{in: event.Payload, out: buf}
+		if err := t.value(); err != nil {
+			return fmt.Errorf("bad payload in %s event: %v", event.Type, err)
+		}
+		if t.skipSpace(); t.pos != len(t.in) {
+			return fmt.Errorf("bad payload in %s event: trailing data", event.Type)
+		}
+		buf = t.out
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+func (msgpackCodec) Decode(data []byte, event *Event) error {
+	var e msgpackEvent
+	if err := msgpack.Unmarshal(data, &e); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	event.Type = e.Type
+	event.Payload = payload
+	return nil
+}
+
+var errBadJSON = errors.New("invalid JSON")
+
+// jsonTranscoder converts JSON to MessagePack. numbers without a fraction or an exponent
+// become integers, so ids stay integers rather than becoming floats
+type jsonTranscoder struct {
+	in []byte
+	pos int
+	out []byte
+}
+
+func (t *jsonTranscoder) skipSpace() {
+	for t.pos < len(t.in) && (t.in[t.pos] == ' ' || t.in[t.pos] == '\t' || t.in[t.pos] == '\n' || t.in[t.pos] == '\r') {
+		t.pos++
+	}
+}
+
+// transcodes the value at pos
+func (t *jsonTranscoder) value() error {
+	t.skipSpace()
+	if t.pos == len(t.in) {
+		return errBadJSON
+	}
+	switch c := t.in[t.pos]; {
+	case c == '{':
+		return t.container('}', true)
+	case c == '[':
+		return t.container(']', false)
+	case c == '"':
+		return t.string()
+	case c == 't':
+		return t.literal("true", msgpcode.True)
+	case c == 'f':
+		return t.literal("false", msgpcode.False)
+	case c == 'n':
+		return t.literal("null", msgpcode.Nil)
+	case c == '-' || (c >= '0' && c <= '9'):
+		return t.number()
+	}
+	return errBadJSON
+}
+
+func (t *jsonTranscoder) literal(word string, code byte) error {
+	if !bytes.HasPrefix(t.in[t.pos:], []byte(word)) {
+		return errBadJSON
+	}
+	t.pos += len(word)
+	t.out = append(t.out, code)
+	return nil
+}
+
+// transcodes an object or an array. MessagePack puts the length first, so the elements
+// are written and their header is inserted before them once they are counted
+func (t *jsonTranscoder) container(end byte, object bool) error {
+	t.pos++
+	start := len(t.out)
+	n := 0
+	for {
+		t.skipSpace()
+		if t.pos < len(t.in) && t.in[t.pos] == end && n == 0 {
+			t.pos++
+			break
+		}
+		if object {
+			if t.pos == len(t.in) || t.in[t.pos] != '"' {
+				return errBadJSON
+			}
+			if err := t.string(); err != nil {
+				return err
+			}
+			t.skipSpace()
+			if t.pos == len(t.in) || t.in[t.pos] != ':' {
+				return errBadJSON
+			}
+			t.pos++
+		}
+		if err := t.value(); err != nil {
+			return err
+		}
+		n++
+		t.skipSpace()
+		if t.pos == len(t.in) {
+			return errBadJSON
+		}
+		c := t.in[t.pos]
+		t.pos++
+		if c == end {
+			break
+		}
+		if c != ',' {
+			return errBadJSON
+		}
+	}
+
+	var header []byte
+	if object {
+		header = msgpackLength(n, msgpcode.FixedMapLow, msgpcode.Map16, msgpcode.Map32)
+	} else {
+		header = msgpackLength(n, msgpcode.FixedArrayLow, msgpcode.Array16, msgpcode.Array32)
+	}
+	t.out = slices.Insert(t.out, start, header...)
+	return nil
+}
+
+// transcodes the string at pos, unescaping it
+func (t *jsonTranscoder) string() error {
+	t.pos++
+	start := len(t.out)
+	for {
+		// copies the run up to the next quote or escape at once
+		i := bytes.IndexAny(t.in[t.pos:], `"\`)
+		if i < 0 {
+			return errBadJSON
+		}
+		t.out = append(t.out, t.in[t.pos:t.pos+i]...)
+		t.pos += i
+		if t.in[t.pos] == '"' {
+			t.pos++
+			break
+		}
+		if err := t.escape(); err != nil {
+			return err
+		}
+	}
+	header := msgpackStringHeader(len(t.out) - start)
+	t.out = slices.Insert(t.out, start, header...)
+	return nil
+}
+
+// unescapes the escape sequence at pos
+func (t *jsonTranscoder) escape() error {
+	if t.pos+1 >= len(t.in) {
+		return errBadJSON
+	}
+	c := t.in[t.pos+1]
+	t.pos += 2
+	switch c {
+	case '"', '\\', '/':
+		t.out = append(t.out, c)
+	case 'b':
+		t.out = append(t.out, '\b')
+	case 'f':
+		t.out = append(t.out, '\f')
+	case 'n':
+		t.out = append(t.out, '\n')
+	case 'r':
+		t.out = append(t.out, '\r')
+	case 't':
+		t.out = append(t.out, '\t')
+	case 'u':
+		r, ok := t.hex4()
+		if !ok {
+			return errBadJSON
+		}
+		if utf16.IsSurrogate(r) {
+			// the second half of a surrogate pair follows as another \u escape,
+			// a lone half becomes U+FFFD like encoding/json makes it
+			next := jsonTranscoder{in: t.in, pos: t.pos + 2}
+			low, ok := next.hex4()
+			if t.pos+1 < len(t.in) && t.in[t.pos] == '\\' && t.in[t.pos+1] == 'u' && ok && utf16.DecodeRune(r, low) != unicode.ReplacementChar {
+				r = utf16.DecodeRune(r, low)
+				t.pos = next.pos
+			} else {
+				r = unicode.ReplacementChar
+			}
+		}
+		t.out = utf8.AppendRune(t.out, r)
+	default:
+		return errBadJSON
+	}
+	return nil
+}
+
+// reads the 4 hex digits of a \u escape
+func (t *jsonTranscoder) hex4() (rune, bool) {
+	if t.pos+4 > len(t.in) {
+		return 0, false
+	}
+	var r rune
+	for _, c := range t.in[t.pos : t.pos+4] {
+		switch {
+		case c >= '0' && c <= '9':
+			c -= '0'
+		case c >= 'a' && c <= 'f':
+			c = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			c = c - 'A' + 10
+		default:
+			return 0, false
+		}
+		r = r<<4 | rune(c)
+	}
+	t.pos += 4
+	return r, true
+}
+
+// transcodes the number at pos, as an integer when it has no fraction or exponent and fits in one
+func (t *jsonTranscoder) number() error {
+	start := t.pos
+	integer := true
+	for t.pos < len(t.in) {
+		c := t.in[t.pos]
+		if c == '.' || c == 'e' || c == 'E' {
+			integer = false
+		} else if !(c == '-' || c == '+' || (c >= '0' && c <= '9')) {
+			break
+		}
+		t.pos++
+	}
+	text := t.in[start:t.pos]
+	if integer {
+		if n, ok := parseJSONInt(text); ok {
+			t.out = appendMsgpackInt(t.out, n)
+			return nil
+		}
+	}
+	f, err := strconv.ParseFloat(string(text), 64)
+	if err != nil {
+		return errBadJSON
+	}
+	t.out = append(t.out, msgpcode.Double)
+	t.out = binary.BigEndian.AppendUint64(t.out, math.Float64bits(f))
+	return nil
+}
+
+// parses a JSON integer, false when it isn't one or doesn't fit in an int64
+func parseJSONInt(text []byte) (int64, bool) {
+	negative := len(text) > 0 && text[0] == '-'
+	if negative {
+		text = text[1:]
+	}
+	if len(text) == 0 || len(text) > 18 {
+		// 18 digits always fit, longer numbers go through ParseFloat
+		return 0, false
+	}
+	var n int64
+	for _, c := range text {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	if negative {
+		n = -n
+	}
+	return n, true
+}
+
+// appends n in the shortest MessagePack integer form
+func appendMsgpackInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= int64(msgpcode.PosFixedNumHigh):
+		return append(b, byte(n))
+	case n < 0 && n >= -32:
+		return append(b, byte(int8(n)))
+	case n >= 0 && n <= math.MaxUint8:
+		return append(b, msgpcode.Uint8, byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, msgpcode.Uint16), uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, msgpcode.Uint32), uint32(n))
+	case n >= 0:
+		return binary.BigEndian.AppendUint64(append(b, msgpcode.Uint64), uint64(n))
+	case n >= math.MinInt8:
+		return append(b, msgpcode.Int8, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, msgpcode.Int16), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, msgpcode.Int32), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(b, msgpcode.Int64), uint64(n))
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	b = append(b, msgpackStringHeader(len(s))...)
+	return append(b, s...)
+}
+
+func msgpackStringHeader(n int) []byte {
+	switch {
+	case n <= int(msgpcode.FixedStrMask):
+		return []byte{msgpcode.FixedStrLow | byte(n)}
+	case n <= math.MaxUint8:
+		return []byte{msgpcode.Str8, byte(n)}
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{msgpcode.Str16}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{msgpcode.Str32}, uint32(n))
+}
+
+// header of a map or an array of n elements
+func msgpackLength(n int, fixed byte, code16 byte, code32 byte) []byte {
+	switch {
+	case n <= int(msgpcode.FixedMapMask):
+		return []byte{fixed | byte(n)}
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16([]byte{code16}, uint16(n))
+	}
+	return binary.BigEndian.AppendUint32([]byte{code32}, uint32(n))
+}
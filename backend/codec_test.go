@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// a new_message event, the event sent the most
+func benchmarkEvent(b testing.TB) Event {
+	data, err := json.Marshal(NewMessageEvent{
+		Id: 123456,
+		SendMessageEvent: SendMessageEvent{
+			Message: "see **the notes** at https://example.com/notes?id=42 & tell me <what> you think",
+			From: "alice",
+			RoomId: 42,
+			Format: FormatMarkdown,
+		},
+		FromId: 7,
+		FromDisplayName: "Alice Liddell",
+		Sent: time.Date(2025, 3, 14, 15, 9, 26, 0, time.UTC),
+		HTML: `<p>see <strong>the notes</strong> at <a href="https://example.com/notes?id=42" rel="nofollow noopener noreferrer">https://example.com/notes?id=42</a> &amp; tell me &lt;what&gt; you think</p>`,
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	return Event{Type: EventNewMessage, Payload: data}
+}
+
+// decodes JSON into Go values with float64 numbers, to compare payloads whatever their encoding
+func decodeJSON(t *testing.T, data []byte) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", data, err)
+	}
+	return v
+}
+
+func TestMessagePackEncode(t *testing.T) {
+	payloads := []string{
+		`null`,
+		`{}`,
+		`[]`,
+		`{"id":1,"ok":true,"no":false,"none":null}`,
+		`{"small":-5,"byte":200,"short":-30000,"int":4000000000,"long":-9007199254740993,"huge":123456789012345678901234}`,
+		`{"float":1.5,"exp":1e3,"negative":-0.25}`,
+		`{"escapes":"quote \" backslash \\ slash \/ tab \t newline \n <html> &"}`,
+		`{"unicode":"héllo wörld ✓","pair":"😀","lone":"\ud83d!"}`,
+		`{"nested":{"list":[1,[2,[3,{}]],{"a":[]}]}}`,
+		`{"long":"` + strings.Repeat("a", 40) + `","longer":"` + strings.Repeat("b", 300) + `","longest":"` + strings.Repeat("c", 70000) + `"}`,
+		`[` + strings.Repeat(`1,`, 20) + `1]`,
+		`{ "spaced" : [ 1 , 2 ] }`,
+		string(benchmarkEvent(t).Payload),
+	}
+	for _, payload := range payloads {
+		var buf bytes.Buffer
+		if err := (msgpackCodec{}).Encode(&buf, Event{Type: "test", Payload: json.RawMessage(payload)}); err != nil {
+			t.Fatalf("Encode(%.50s): %v", payload, err)
+		}
+		var decoded msgpackEvent
+		if err := msgpack.Unmarshal(buf.Bytes(), &decoded); err != nil {
+			t.Fatalf("Encode(%.50s) is not MessagePack: %v", payload, err)
+		}
+		if decoded.Type != "test" {
+			t.Errorf("Encode(%.50s) type = %q", payload, decoded.Type)
+		}
+		data, err := json.Marshal(decoded.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := decodeJSON(t, data), decodeJSON(t, []byte(payload)); !reflect.DeepEqual(got, want) {
+			t.Errorf("Encode(%.50s) payload = %.50s", payload, data)
+		}
+	}
+}
+
+func TestMessagePackEncodeKeepsIntegers(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (msgpackCodec{}).Encode(&buf, Event{Type: "test", Payload: json.RawMessage(`{"id":9007199254740993}`)}); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Payload struct {
+			Id int64 `msgpack:"id"`
+		} `msgpack:"payload"`
+	}
+	if err := msgpack.Unmarshal(buf.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Payload.Id != 9007199254740993 {
+		t.Errorf("id = %d, want 9007199254740993", decoded.Payload.Id)
+	}
+}
+
+func TestMessagePackEncodeRejectsInvalidJSON(t *testing.T) {
+	for _, payload := range []string{`{`, `{"a"}`, `{"a":1,}`, `[1 2]`, `"open`, `tru`, `{"a":1}x`, `"\x"`, `-`} {
+		if err := (msgpackCodec{}).Encode(io.Discard, Event{Type: "test", Payload: json.RawMessage(payload)}); err == nil {
+			t.Errorf("Encode(%s) succeeded", payload)
+		}
+	}
+}
+
+func TestMessagePackDecode(t *testing.T) {
+	data, err := msgpack.Marshal(map[string]any{"type": EventSendMessage, "payload": map[string]any{"room_id": 42, "message": "hi"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var event Event
+	if err := (msgpackCodec{}).Decode(data, &event); err != nil {
+		t.Fatal(err)
+	}
+	var message SendMessageEvent
+	if err := json.Unmarshal(event.Payload, &message); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != EventSendMessage || message.RoomId != 42 || message.Message != "hi" {
+		t.Errorf("Decode = %s %s", event.Type, event.Payload)
+	}
+}
+
+func benchmarkEncode(b *testing.B, codec Codec) {
+	event := benchmarkEvent(b)
+	var buf bytes.Buffer
+	b.ReportAllocs()
+	for b.Loop() {
+		buf.Reset()
+		if err := codec.Encode(&buf, event); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.SetBytes(int64(buf.Len()))
+}
+
+func benchmarkDecode(b *testing.B, codec Codec) {
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, benchmarkEvent(b)); err != nil {
+		b.Fatal(err)
+	}
+	data := buf.Bytes()
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for b.Loop() {
+		var event Event
+		if err := codec.Decode(data, &event); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkJSONEncode(b *testing.B) {
+	benchmarkEncode(b, jsonCodec{})
+}
+
+func BenchmarkMessagePackEncode(b *testing.B) {
+	benchmarkEncode(b, msgpackCodec{})
+}
+
+func BenchmarkJSONDecode(b *testing.B) {
+	benchmarkDecode(b, jsonCodec{})
+}
+
+func BenchmarkMessagePackDecode(b *testing.B) {
+	benchmarkDecode(b, msgpackCodec{})
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// reply to a command, only sent to the client that ran it
+	EventEphemeral = "ephemeral_message"
+)
+
+// a server side slash command
+type Command struct {
+	Name string
+	// arguments shown by /help
+	Usage string
+	Description string
+	Run func(ctx *CommandContext) error
+}
+
+// what a command runs with
+type CommandContext struct {
+	client *Client
+	room *Room
+	// words following the command name
+	args []string
+	// everything following the command name, untouched
+	rawArgs string
+}
+
+// reply only the client running a command sees
+type EphemeralEvent struct {
+	RoomId int `json:"room_id"`
+	Message string `json:"message"`
+	Error bool `json:"error,omitempty"`
+	Sent time.Time `json:"sent"`
+}
+
+// replies to the client that ran the command
+func (ctx *CommandContext) reply(format string, args ...any) error {
+	return sendEphemeral(ctx.client, ctx.room.id, fmt.Sprintf(format, args...), false)
+}
+
+func sendEphemeral(c *Client, roomId int, message string, isError bool) error {
+	data, err := json.Marshal(EphemeralEvent{RoomId: roomId, Message: message, Error: isError, Sent: time.Now()})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventEphemeral
+	c.send <- outgoingEvent
+	return nil
+}
+
+// configures and adds all built in commands
+func (h *Hub) setupCommands() {
+	for _, command := range []*Command{
+		{Name: "help", Description: "list the available commands", Run: helpCommand},
+		{Name: "me", Usage: "<action>", Description: "describe what you are doing", Run: meCommand},
+		{Name: "topic", Usage: "[topic]", Description: "show or change the room topic", Run: topicCommand},
+		{Name: "invite", Usage: "<user>", Description: "add a user to the room", Run: inviteCommand},
+		{Name: "leave", Description: "leave the room", Run: leaveCommand},
+		{Name: "mute", Usage: "<user> <duration>", Description: "prevent a member from posting, e.g. /mute bob 10m", Run: muteCommand},
+	} {
+		h.commands[command.Name] = command
+	}
+}
+
+// runs messages starting with '/' as commands. returns false if the message
+// isn't a command and should be posted as is. "//text" posts "/text".
+// encrypted messages are never commands, their text is dropped when they are posted
+func (h *Hub) runCommand(c *Client, chatevent SendMessageEvent) (bool, error) {
+	if chatevent.Encrypted {
+		return false, nil
+	}
+	if text, ok := strings.CutPrefix(chatevent.Message, "//"); ok {
+		chatevent.Message = "/" + text
+		_, err := h.postMessage(c.user, chatevent)
+		return true, err
+	}
+	name, rawArgs, ok := parseCommand(chatevent.Message)
+	if !ok {
+		return false, nil
+	}
+
+	room, ok := h.getRoom(chatevent.RoomId)
+	if !ok {
+		return true, RoomNotFoundError
+	}
+	if _, err := h.db.getRoomRole(room.id, c.user.id); err != nil {
+		return true, err
+	}
+
+	return true, h.dispatchCommand(newCommandContext(c, room, rawArgs), name)
+}
+
+func newCommandContext(c *Client, room *Room, rawArgs string) *CommandContext {
+	return &CommandContext{
+		client: c,
+		room: room,
+		args: strings.Fields(rawArgs),
+		rawArgs: strings.TrimSpace(rawArgs),
+	}
+}
+
+// splits "/name args" into the lowercased name of the command and what follows it.
+// ok is false when the message isn't shaped like a command, e.g. a path
+func parseCommand(message string) (name string, rawArgs string, ok bool) {
+	text, ok := strings.CutPrefix(message, "/")
+	if !ok {
+		return "", "", false
+	}
+	name, rawArgs, _ = strings.Cut(text, " ")
+	name = strings.ToLower(name)
+	if !commandPattern.MatchString(name) {
+		return "", "", false
+	}
+	return name, rawArgs, true
+}
+
+// runs the built in command name, or hands it to the bot that registered it.
+// errors and unknown commands are replied to the client that ran it
+func (h *Hub) dispatchCommand(ctx *CommandContext, name string) error {
+	command, ok := h.commands[name]
+	if !ok {
+		dispatched, err := h.botCommand(ctx.client, ctx.room.id, name, ctx.rawArgs)
+		if err != nil {
+			return sendEphemeral(ctx.client, ctx.room.id, err.Error(), true)
+		}
+		if !dispatched {
+			return sendEphemeral(ctx.client, ctx.room.id, fmt.Sprintf("Unknown command /%s. Type /help to list the available commands.", name), true)
+		}
+		return nil
+	}
+	if err := command.Run(ctx); err != nil {
+		return sendEphemeral(ctx.client, ctx.room.id, fmt.Sprintf("/%s: %v", name, err), true)
+	}
+	return nil
+}
+
+// errUsage is returned when a command is called with the wrong arguments
+func errUsage(ctx *CommandContext, name string) error {
+	return fmt.Errorf("usage: /%s %s", name, ctx.client.hub.commands[name].Usage)
+}
+
+func helpCommand(ctx *CommandContext) error {
+	h := ctx.client.hub
+	var lines []string
+	for _, command := range h.commands {
+		lines = append(lines, strings.TrimSpace(fmt.Sprintf("/%s %s", command.Name, command.Usage))+" - "+command.Description)
+	}
+	sort.Strings(lines)
+
+	botCommands, err := h.db.getBotCommands()
+	if err != nil {
+		return err
+	}
+	for _, command := range botCommands {
+		lines = append(lines, fmt.Sprintf("/%s - %s (bot %s)", command.Command, command.Description, command.Bot))
+	}
+	return ctx.reply("Available commands:\n%s", strings.Join(lines, "\n"))
+}
+
+func meCommand(ctx *CommandContext) error {
+	if ctx.rawArgs == "" {
+		return errUsage(ctx, "me")
+	}
+	_, err := ctx.client.hub.postMessage(ctx.client.user, SendMessageEvent{RoomId: ctx.room.id, Message: fmt.Sprintf("* %s %s", ctx.client.user.username, ctx.rawArgs)})
+	return err
+}
+
+func topicCommand(ctx *CommandContext) error {
+	if ctx.rawArgs == "" {
+		var topic string
+		ctx.room.apply(func(r *Room) {
+			topic = r.topic
+		})
+		if topic == "" {
+			return ctx.reply("This room has no topic.")
+		}
+		return ctx.reply("Topic: %s", topic)
+	}
+	return runHandler(ctx, UpdateRoomHandler, UpdateRoomEvent{RoomId: ctx.room.id, Topic: &ctx.rawArgs})
+}
+
+func inviteCommand(ctx *CommandContext) error {
+	if len(ctx.args) != 1 {
+		return errUsage(ctx, "invite")
+	}
+	h := ctx.client.hub
+
+	role, err := h.db.getRoomRole(ctx.room.id, ctx.client.user.id)
+	if err != nil {
+		return err
+	}
+	if roleRank(role) < roleRank(RoleAdmin) {
+		return ErrNotRoomAdmin
+	}
+
+	user, err := h.db.getUserByUsername(ctx.args[0])
+	if err != nil {
+		return err
+	}
+	blocked, err := h.db.isBlockedEitherWay(ctx.client.user.id, user.id)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrUserBlocked
+	}
+	return h.addRoomMember(ctx.room, user, RoleMember, ctx.client.user.username)
+}
+
+func leaveCommand(ctx *CommandContext) error {
+	if err := ctx.client.hub.leaveRoom(ctx.room, ctx.client.user); err != nil {
+		return err
+	}
+	return ctx.reply("You left the room.")
+}
+
+func muteCommand(ctx *CommandContext) error {
+	if len(ctx.args) != 2 {
+		return errUsage(ctx, "mute")
+	}
+	return runHandler(ctx, MuteMemberHandler, MuteMemberEvent{RoomId: ctx.room.id, Username: ctx.args[0], Duration: ctx.args[1]})
+}
+
+// runs an event handler with payload, for commands that are shortcuts to an event
+func runHandler(ctx *CommandContext, handler EventHandler, payload any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return handler(Event{Payload: data}, ctx.client)
+}
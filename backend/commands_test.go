@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// the text of an encrypted message is dropped, "/kick" in it must not kick anyone
+func TestRunCommandSkipsEncryptedMessages(t *testing.T) {
+	h := &Hub{commands: make(map[string]*Command)}
+	message := SendMessageEvent{Message: "/kick bob", RoomId: 1, Encrypted: true, Envelope: &EncryptedEnvelope{}}
+	handled, err := h.runCommand(nil, message)
+	if handled || err != nil {
+		t.Errorf("runCommand = %v, %v, want the message posted", handled, err)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		name string
+		rawArgs string
+		ok bool
+	}{
+		{"/help", "help", "", true},
+		{"/me waves at everyone", "me", "waves at everyone", true},
+		{"/TOPIC Release  day", "topic", "Release  day", true},
+		{"/mute bob 10m", "mute", "bob 10m", true},
+		{"/deploy-app now", "deploy-app", "now", true},
+		{"hello", "", "", false},
+		{"/", "", "", false},
+		{"/ help", "", "", false},
+		{"/usr/bin/env", "", "", false},
+		{"//help", "", "", false},
+	} {
+		name, rawArgs, ok := parseCommand(test.message)
+		if name != test.name || rawArgs != test.rawArgs || ok != test.ok {
+			t.Errorf("parseCommand(%q) = %q, %q, %v, want %q, %q, %v", test.message, name, rawArgs, ok, test.name, test.rawArgs, test.ok)
+		}
+	}
+}
+
+// a hub with the built in commands and a bot that registered /deploy, and a member of a room
+func newTestCommandContext(t *testing.T) (*Hub, *Client, *Room) {
+	t.Helper()
+	h := &Hub{commands: make(map[string]*Command)}
+	h.setupCommands()
+	h.botCommand = func(c *Client, roomId int, name string, args string) (bool, error) {
+		return name == "deploy", nil
+	}
+	c := &Client{hub: h, send: make(chan Event, 1), user: newUser(1, "alice")}
+	return h, c, newTestRoom(t)
+}
+
+func TestDispatchCommand(t *testing.T) {
+	for _, test := range []struct {
+		message string
+		// the ephemeral reply, none when empty
+		reply string
+		isError bool
+	}{
+		{"/topic", "This room has no topic.", false},
+		{"/me", "/me: usage: /me <action>", true},
+		{"/invite", "/invite: usage: /invite <user>", true},
+		{"/invite bob carol", "/invite: usage: /invite <user>", true},
+		{"/mute bob", "/mute: usage: /mute <user> <duration>", true},
+		{"/deploy now", "", false},
+		{"/nope", "Unknown command /nope. Type /help to list the available commands.", true},
+	} {
+		h, c, room := newTestCommandContext(t)
+		name, rawArgs, ok := parseCommand(test.message)
+		if !ok {
+			t.Fatalf("parseCommand(%q) isn't a command", test.message)
+		}
+		if err := h.dispatchCommand(newCommandContext(c, room, rawArgs), name); err != nil {
+			t.Errorf("%s: dispatchCommand = %v", test.message, err)
+			continue
+		}
+
+		select {
+		case event := <-c.send:
+			var reply EphemeralEvent
+			if err := json.Unmarshal(event.Payload, &reply); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type != EventEphemeral || reply.Message != test.reply || reply.Error != test.isError || reply.RoomId != room.id {
+				t.Errorf("%s: replied %s %+v, want %q, error %v", test.message, event.Type, reply, test.reply, test.isError)
+			}
+		default:
+			if test.reply != "" {
+				t.Errorf("%s: no reply, want %q", test.message, test.reply)
+			}
+		}
+	}
+}
+
+// the topic is read on the room's goroutine
+func TestTopicCommandShowsTopic(t *testing.T) {
+	h, c, room := newTestCommandContext(t)
+	room.apply(func(r *Room) {
+		r.topic = "Release day"
+	})
+	if err := h.dispatchCommand(newCommandContext(c, room, ""), "topic"); err != nil {
+		t.Fatal(err)
+	}
+	var reply EphemeralEvent
+	if err := json.Unmarshal((<-c.send).Payload, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Message != "Topic: Release day" || reply.Error {
+		t.Errorf("reply = %+v, want the topic", reply)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every runtime setting of the server.
+// it is loaded from an optional YAML file, then overridden by environment variables
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  DatabaseConfig  `yaml:"database"`
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	Auth      AuthConfig      `yaml:"auth"`
+	Webhooks  WebhookConfig   `yaml:"webhooks"`
+	Push      PushConfig      `yaml:"push"`
+	Retention RetentionConfig `yaml:"retention"`
+	Privacy   PrivacyConfig   `yaml:"privacy"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Previews  PreviewConfig   `yaml:"previews"`
+}
+
+type ServerConfig struct {
+	// http service address
+	Addr string `yaml:"addr"`
+
+	// origins allowed for CORS and websocket upgrades
+	AllowedOrigins []string `yaml:"allowed_origins"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+type WebSocketConfig struct {
+	// Time allowed to write a message to the peer
+	WriteWait Duration `yaml:"write_wait"`
+
+	// Time allowed to read the next pong message from the peer
+	PongWait Duration `yaml:"pong_wait"`
+
+	// Maximum message size allowed from peer
+	MaxMessageSize int64 `yaml:"max_message_size"`
+
+	// Size of the buffered channel of outbound events of each client
+	SendBufferSize int `yaml:"send_buffer_size"`
+
+	ReadBufferSize  int `yaml:"read_buffer_size"`
+	WriteBufferSize int `yaml:"write_buffer_size"`
+}
+
+type AuthConfig struct {
+	JWTKey string `yaml:"jwt_key"`
+
+	// lifetime of access tokens
+	TokenLifetime Duration `yaml:"token_lifetime"`
+
+	// lifetime of the mfa pending token of a two-step login
+	MFATokenLifetime Duration `yaml:"mfa_token_lifetime"`
+}
+
+type WebhookConfig struct {
+	// timeout of a single delivery attempt
+	Timeout Duration `yaml:"timeout"`
+
+	// how often the queue is checked for deliveries due for a retry
+	PollInterval Duration `yaml:"poll_interval"`
+
+	// attempts before a delivery is moved to the dead letters
+	MaxAttempts int `yaml:"max_attempts"`
+
+	// delay before the first retry, doubled after each failure up to MaxBackoff
+	InitialBackoff Duration `yaml:"initial_backoff"`
+	MaxBackoff     Duration `yaml:"max_backoff"`
+
+	// deliveries claimed at once by the worker
+	BatchSize int `yaml:"batch_size"`
+}
+
+// Web Push is disabled unless both VAPID keys are set
+type PushConfig struct {
+	// base64url encoded uncompressed P-256 public key, given to browsers
+	VAPIDPublicKey string `yaml:"vapid_public_key"`
+
+	// base64url encoded P-256 private scalar
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+
+	// contact of the server operator for push services, mailto: or https: URL
+	Subject string `yaml:"subject"`
+
+	// how long push services keep undelivered notifications
+	TTL Duration `yaml:"ttl"`
+
+	// members whose clients were all inactive this long are pushed to as if offline
+	IdleAfter Duration `yaml:"idle_after"`
+
+	// timeout of a request to a push service
+	Timeout Duration `yaml:"timeout"`
+
+	// concurrent requests to push services
+	Workers int `yaml:"workers"`
+}
+
+type RetentionConfig struct {
+	// policy of the rooms that don't set their own, keeps everything by default
+	RetentionPolicy `yaml:",inline"`
+
+	// how often expired messages are purged
+	Interval Duration `yaml:"interval"`
+
+	// messages deleted per statement
+	BatchSize int `yaml:"batch_size"`
+
+	// copy purged messages to messages_archive before deleting them
+	Archive bool `yaml:"archive"`
+}
+
+type PrivacyConfig struct {
+	// where personal data exports are written until they are downloaded
+	ExportDir string `yaml:"export_dir"`
+
+	// how long a finished export can be downloaded
+	ExportTTL Duration `yaml:"export_ttl"`
+
+	// how often queued exports and erasures are looked for
+	PollInterval Duration `yaml:"poll_interval"`
+}
+
+type SchedulerConfig struct {
+	// longest the scheduler sleeps before looking for due messages,
+	// it otherwise wakes up when the next one is due
+	PollInterval Duration `yaml:"poll_interval"`
+
+	// messages posted per claim
+	BatchSize int `yaml:"batch_size"`
+
+	// pending scheduled messages a user can have
+	MaxPerUser int `yaml:"max_per_user"`
+}
+
+// link previews of the messages posted in unencrypted rooms
+type PreviewConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// timeout of previewing one link, redirects and oEmbed included
+	Timeout Duration `yaml:"timeout"`
+
+	// bytes of a page or oEmbed response read at most
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	// links of a message previewed at most
+	MaxLinks int `yaml:"max_links"`
+
+	// how long a fetched preview, or a failed fetch, is reused
+	CacheTTL Duration `yaml:"cache_ttl"`
+
+	// concurrent fetches
+	Workers int `yaml:"workers"`
+}
+
+func (c PushConfig) enabled() bool {
+	return c.VAPIDPublicKey != "" && c.VAPIDPrivateKey != ""
+}
+
+// Duration is a time.Duration written as a string ("60s", "10m") in config files
+type Duration time.Duration
+
+func (d Duration) MarshalYAML() (any, error) {
+	return time.Duration(d).String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	v, err := time.ParseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %v", value.Line, err)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// returns the settings used when neither the config file nor the environment set them
+func defaultConfig() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:           ":8080",
+			AllowedOrigins: []string{"http://localhost:8080", "http://localhost"},
+		},
+		Database: DatabaseConfig{
+			Host:    "localhost",
+			Port:    5432,
+			User:    "postgres",
+			Name:    "gochat_db",
+			SSLMode: "disable",
+		},
+		WebSocket: WebSocketConfig{
+			WriteWait:       Duration(10 * time.Second),
+			PongWait:        Duration(60 * time.Second),
+			MaxMessageSize:  512,
+			SendBufferSize:  512,
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+		},
+		Auth: AuthConfig{
+			TokenLifetime:    Duration(10 * time.Minute),
+			MFATokenLifetime: Duration(5 * time.Minute),
+		},
+		Webhooks: WebhookConfig{
+			Timeout:        Duration(10 * time.Second),
+			PollInterval:   Duration(5 * time.Second),
+			MaxAttempts:    8,
+			InitialBackoff: Duration(30 * time.Second),
+			MaxBackoff:     Duration(6 * time.Hour),
+			BatchSize:      20,
+		},
+		Push: PushConfig{
+			Subject:   "mailto:admin@localhost",
+			TTL:       Duration(24 * time.Hour),
+			IdleAfter: Duration(5 * time.Minute),
+			Timeout:   Duration(10 * time.Second),
+			Workers:   4,
+		},
+		Retention: RetentionConfig{
+			Interval:  Duration(time.Hour),
+			BatchSize: 500,
+		},
+		Privacy: PrivacyConfig{
+			ExportDir:    filepath.Join(os.TempDir(), "gochat-exports"),
+			ExportTTL:    Duration(7 * 24 * time.Hour),
+			PollInterval: Duration(30 * time.Second),
+		},
+		Scheduler: SchedulerConfig{
+			PollInterval: Duration(time.Minute),
+			BatchSize:    50,
+			MaxPerUser:   100,
+		},
+		Previews: PreviewConfig{
+			Enabled:     true,
+			Timeout:     Duration(5 * time.Second),
+			MaxBodySize: 512 << 10,
+			MaxLinks:    3,
+			CacheTTL:    Duration(24 * time.Hour),
+			Workers:     4,
+		},
+	}
+}
+
+// loads the config file at path, if any, applies the environment overrides and validates the result
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("parsing %s: %v", path, err)
+		}
+	}
+
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// overrides settings with environment variables.
+// the variables used before the config file existed keep their meaning
+func (c *Config) applyEnv() error {
+	envString("GOCHAT_ADDR", &c.Server.Addr)
+	envList("ALLOWED_ORIGIN", &c.Server.AllowedOrigins)
+
+	envString("DB_HOST", &c.Database.Host)
+	envString("PSQL_PWD", &c.Database.Password)
+	envString("GOCHAT_DB_USER", &c.Database.User)
+	envString("GOCHAT_DB_NAME", &c.Database.Name)
+	envString("GOCHAT_DB_SSLMODE", &c.Database.SSLMode)
+
+	envString("JWT_KEY", &c.Auth.JWTKey)
+
+	envString("VAPID_PUBLIC_KEY", &c.Push.VAPIDPublicKey)
+	envString("VAPID_PRIVATE_KEY", &c.Push.VAPIDPrivateKey)
+	envString("VAPID_SUBJECT", &c.Push.Subject)
+
+	envString("GOCHAT_EXPORT_DIR", &c.Privacy.ExportDir)
+
+	var errs []error
+	errs = append(errs, envInt("GOCHAT_DB_PORT", &c.Database.Port))
+	errs = append(errs, envDuration("GOCHAT_WS_WRITE_WAIT", &c.WebSocket.WriteWait))
+	errs = append(errs, envDuration("GOCHAT_WS_PONG_WAIT", &c.WebSocket.PongWait))
+	errs = append(errs, envInt64("GOCHAT_WS_MAX_MESSAGE_SIZE", &c.WebSocket.MaxMessageSize))
+	errs = append(errs, envInt("GOCHAT_WS_SEND_BUFFER_SIZE", &c.WebSocket.SendBufferSize))
+	errs = append(errs, envDuration("GOCHAT_TOKEN_LIFETIME", &c.Auth.TokenLifetime))
+	errs = append(errs, envDuration("GOCHAT_MFA_TOKEN_LIFETIME", &c.Auth.MFATokenLifetime))
+	errs = append(errs, envInt("GOCHAT_RETENTION_DAYS", &c.Retention.Days))
+	errs = append(errs, envInt("GOCHAT_RETENTION_MESSAGES", &c.Retention.Messages))
+	return errors.Join(errs...)
+}
+
+// checks the config is usable before anything is started
+func (c *Config) validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr must be set"))
+	}
+	if len(c.Server.AllowedOrigins) == 0 {
+		errs = append(errs, errors.New("server.allowed_origins must not be empty"))
+	}
+	if c.Database.Host == "" || c.Database.User == "" || c.Database.Name == "" {
+		errs = append(errs, errors.New("database.host, database.user and database.name must be set"))
+	}
+	if c.Database.Port <= 0 || c.Database.Port > 65535 {
+		errs = append(errs, fmt.Errorf("database.port %d is out of range", c.Database.Port))
+	}
+	if c.WebSocket.WriteWait <= 0 {
+		errs = append(errs, errors.New("websocket.write_wait must be positive"))
+	}
+	// pings go out every 9/10 of pong_wait, shorter waits would ping in a loop
+	if c.WebSocket.PongWait < Duration(time.Second) {
+		errs = append(errs, errors.New("websocket.pong_wait must be at least 1s"))
+	}
+	if c.WebSocket.MaxMessageSize <= 0 {
+		errs = append(errs, errors.New("websocket.max_message_size must be positive"))
+	}
+	if c.WebSocket.SendBufferSize <= 0 || c.WebSocket.ReadBufferSize <= 0 || c.WebSocket.WriteBufferSize <= 0 {
+		errs = append(errs, errors.New("websocket buffer sizes must be positive"))
+	}
+	if c.Auth.JWTKey == "" {
+		errs = append(errs, errors.New("auth.jwt_key must be set"))
+	}
+	if c.Auth.TokenLifetime <= 0 || c.Auth.MFATokenLifetime <= 0 {
+		errs = append(errs, errors.New("auth token lifetimes must be positive"))
+	}
+	if c.Webhooks.Timeout <= 0 || c.Webhooks.PollInterval <= 0 {
+		errs = append(errs, errors.New("webhooks.timeout and webhooks.poll_interval must be positive"))
+	}
+	if c.Webhooks.MaxAttempts <= 0 || c.Webhooks.BatchSize <= 0 {
+		errs = append(errs, errors.New("webhooks.max_attempts and webhooks.batch_size must be positive"))
+	}
+	if c.Webhooks.InitialBackoff <= 0 || c.Webhooks.MaxBackoff < c.Webhooks.InitialBackoff {
+		errs = append(errs, errors.New("webhooks.initial_backoff must be positive and at most webhooks.max_backoff"))
+	}
+	if (c.Push.VAPIDPublicKey == "") != (c.Push.VAPIDPrivateKey == "") {
+		errs = append(errs, errors.New("push.vapid_public_key and push.vapid_private_key must be set together"))
+	}
+	if c.Push.enabled() {
+		if _, err := parseVAPIDKeys(c.Push.VAPIDPublicKey, c.Push.VAPIDPrivateKey); err != nil {
+			errs = append(errs, fmt.Errorf("push: %v", err))
+		}
+		if !strings.HasPrefix(c.Push.Subject, "mailto:") && !strings.HasPrefix(c.Push.Subject, "https:") {
+			errs = append(errs, errors.New("push.subject must be a mailto: or https: URL"))
+		}
+		if c.Push.TTL <= 0 || c.Push.IdleAfter <= 0 || c.Push.Timeout <= 0 || c.Push.Workers <= 0 {
+			errs = append(errs, errors.New("push.ttl, push.idle_after, push.timeout and push.workers must be positive"))
+		}
+	}
+	if err := c.Retention.validate(); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Retention.Interval <= 0 || c.Retention.BatchSize <= 0 {
+		errs = append(errs, errors.New("retention.interval and retention.batch_size must be positive"))
+	}
+	if c.Privacy.ExportDir == "" {
+		errs = append(errs, errors.New("privacy.export_dir must be set"))
+	}
+	if c.Privacy.ExportTTL <= 0 || c.Privacy.PollInterval <= 0 {
+		errs = append(errs, errors.New("privacy.export_ttl and privacy.poll_interval must be positive"))
+	}
+	if c.Scheduler.PollInterval <= 0 || c.Scheduler.BatchSize <= 0 || c.Scheduler.MaxPerUser <= 0 {
+		errs = append(errs, errors.New("scheduler.poll_interval, scheduler.batch_size and scheduler.max_per_user must be positive"))
+	}
+	if c.Previews.Enabled {
+		if c.Previews.Timeout <= 0 || c.Previews.MaxBodySize <= 0 || c.Previews.MaxLinks <= 0 || c.Previews.CacheTTL <= 0 || c.Previews.Workers <= 0 {
+			errs = append(errs, errors.New("previews.timeout, previews.max_body_size, previews.max_links, previews.cache_ttl and previews.workers must be positive"))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// returns the config as YAML with secrets redacted
+func (c Config) String() string {
+	if c.Database.Password != "" {
+		c.Database.Password = "<redacted>"
+	}
+	if c.Auth.JWTKey != "" {
+		c.Auth.JWTKey = "<redacted>"
+	}
+	if c.Push.VAPIDPrivateKey != "" {
+		c.Push.VAPIDPrivateKey = "<redacted>"
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		*dst = v
+	}
+}
+
+// comma separated list
+func envList(key string, dst *[]string) {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return
+	}
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*dst = list
+}
+
+func envInt(key string, dst *int) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envInt64(key string, dst *int64) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	*dst = n
+	return nil
+}
+
+func envDuration(key string, dst *Duration) error {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	*dst = Duration(d)
+	return nil
+}
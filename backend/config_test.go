@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidatePongWait(t *testing.T) {
+	for _, wait := range []time.Duration{0, time.Nanosecond, 999 * time.Millisecond} {
+		c := defaultConfig()
+		c.Auth.JWTKey = "secret"
+		c.WebSocket.PongWait = Duration(wait)
+		err := c.validate()
+		if err == nil || !strings.Contains(err.Error(), "pong_wait") {
+			t.Errorf("validate with pong_wait %s = %v, want a pong_wait error", wait, err)
+		}
+	}
+
+	c := defaultConfig()
+	c.Auth.JWTKey = "secret"
+	c.WebSocket.PongWait = Duration(time.Second)
+	if err := c.validate(); err != nil && strings.Contains(err.Error(), "pong_wait") {
+		t.Errorf("validate with pong_wait 1s = %v", err)
+	}
+}
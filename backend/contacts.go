@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ask a user to become a contact
+	EventSendContactRequest = "send_contact_request"
+	// accept a contact request received from a user
+	EventAcceptContactRequest = "accept_contact_request"
+	// decline a contact request received from a user
+	EventDeclineContactRequest = "decline_contact_request"
+	// remove a contact, or cancel a contact request we sent
+	EventRemoveContact = "remove_contact"
+	// get the user's contacts and pending requests
+	EventGetContacts = "get_contacts"
+	// response to the contact events, also sent to the other user when their contacts changed
+	EventContacts = "contacts"
+	// get the user's privacy settings
+	EventGetPrivacySettings = "get_privacy_settings"
+	// change who can start direct rooms with the user and who sees them online
+	EventSetPrivacySettings = "set_privacy_settings"
+	// response to get_privacy_settings and set_privacy_settings
+	EventPrivacySettings = "privacy_settings"
+)
+
+// what a user is to another
+const (
+	ContactAccepted = "accepted"
+	// we sent a request they didn't answer yet
+	ContactOutgoing = "outgoing"
+	// they sent a request we didn't answer yet
+	ContactIncoming = "incoming"
+)
+
+// values of the privacy settings
+const (
+	PrivacyEveryone = "everyone"
+	PrivacyContacts = "contacts"
+	PrivacyNobody = "nobody"
+)
+
+var (
+	ErrContactsOnly = errors.New("this user only accepts direct rooms from their contacts")
+	ErrAlreadyContact = errors.New("already a contact")
+	ErrNoContactRequest = errors.New("no contact request from this user")
+)
+
+type Contact struct {
+	Id int `json:"id"`
+	Username string `json:"username"`
+	DisplayName string `json:"display_name"`
+	Status string `json:"status"`
+}
+
+type PrivacySettings struct {
+	// who can start a direct room with the user: everyone or contacts
+	DirectRooms string `json:"direct_rooms"`
+	// who sees the user online: everyone, contacts or nobody
+	Presence string `json:"presence"`
+}
+
+type ContactRequestEvent struct {
+	Username string `json:"username"`
+}
+
+type ContactsEvent struct {
+	Contacts []Contact `json:"contacts"`
+}
+
+// fields left out are not changed
+type SetPrivacySettingsEvent struct {
+	DirectRooms *string `json:"direct_rooms"`
+	Presence *string `json:"presence"`
+}
+
+func SendContactRequestHandler(event Event, c *Client) error {
+	var e ContactRequestEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+	if target.id == c.user.id {
+		return fmt.Errorf("you can't add yourself as a contact")
+	}
+	blocked, err := c.hub.db.isBlockedEitherWay(c.user.id, target.id)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return ErrUserBlocked
+	}
+
+	status, err := c.hub.db.getContactStatus(c.user.id, target.id)
+	if err != nil {
+		return err
+	}
+	switch status {
+	case ContactAccepted:
+		return ErrAlreadyContact
+	case ContactIncoming:
+		// they asked first, asking back accepts
+		return c.hub.acceptContact(target, c.user)
+	case ContactOutgoing:
+		return nil
+	}
+
+	if err := c.hub.db.addContactRequest(c.user.id, target.id); err != nil {
+		return err
+	}
+	return c.hub.sendContacts(c.user.id, target.id)
+}
+
+func AcceptContactRequestHandler(event Event, c *Client) error {
+	var e ContactRequestEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+	return c.hub.acceptContact(target, c.user)
+}
+
+func DeclineContactRequestHandler(event Event, c *Client) error {
+	var e ContactRequestEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+
+	status, err := c.hub.db.getContactStatus(c.user.id, target.id)
+	if err != nil {
+		return err
+	}
+	if status != ContactIncoming {
+		return ErrNoContactRequest
+	}
+	if err := c.hub.db.removeContact(c.user.id, target.id); err != nil {
+		return err
+	}
+	return c.hub.sendContacts(c.user.id, target.id)
+}
+
+func RemoveContactHandler(event Event, c *Client) error {
+	var e ContactRequestEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+	return c.hub.removeContact(c.user, target)
+}
+
+func GetContactsHandler(event Event, c *Client) error {
+	return c.hub.sendContacts(c.user.id)
+}
+
+// accepts the contact request from sent to to
+func (h *Hub) acceptContact(from *User, to *User) error {
+	hiddenFrom, err := h.db.getPresenceHiddenFrom(from.id)
+	if err != nil {
+		return err
+	}
+	hiddenTo, err := h.db.getPresenceHiddenFrom(to.id)
+	if err != nil {
+		return err
+	}
+
+	ok, err := h.db.acceptContactRequest(from.id, to.id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrNoContactRequest
+	}
+
+	// contacts may see each other's presence now
+	if err := h.announcePresenceChange(from, hiddenFrom); err != nil {
+		return err
+	}
+	if err := h.announcePresenceChange(to, hiddenTo); err != nil {
+		return err
+	}
+	return h.sendContacts(from.id, to.id)
+}
+
+// removes the contact or pending request between the users
+func (h *Hub) removeContact(user *User, other *User) error {
+	hiddenUser, err := h.db.getPresenceHiddenFrom(user.id)
+	if err != nil {
+		return err
+	}
+	hiddenOther, err := h.db.getPresenceHiddenFrom(other.id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.db.removeContact(user.id, other.id); err != nil {
+		return err
+	}
+
+	if err := h.announcePresenceChange(user, hiddenUser); err != nil {
+		return err
+	}
+	if err := h.announcePresenceChange(other, hiddenOther); err != nil {
+		return err
+	}
+	return h.sendContacts(user.id, other.id)
+}
+
+// sends their contacts to every client of the users
+func (h *Hub) sendContacts(userIds ...int) error {
+	for _, userId := range userIds {
+		contacts, err := h.db.getContacts(userId)
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(ContactsEvent{Contacts: contacts})
+		if err != nil {
+			return fmt.Errorf("failed to marshal broadcast message: %v", err)
+		}
+
+		var outgoingEvent Event
+		outgoingEvent.Payload = data
+		outgoingEvent.Type = EventContacts
+		h.sendToUser(userId, outgoingEvent)
+	}
+	return nil
+}
+
+func GetPrivacySettingsHandler(event Event, c *Client) error {
+	settings, err := c.hub.db.getPrivacySettings(c.user.id)
+	if err != nil {
+		return err
+	}
+	return sendPrivacySettings(c, settings)
+}
+
+func SetPrivacySettingsHandler(event Event, c *Client) error {
+	var e SetPrivacySettingsEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if e.DirectRooms != nil && *e.DirectRooms != PrivacyEveryone && *e.DirectRooms != PrivacyContacts {
+		return fmt.Errorf("direct_rooms must be %s or %s", PrivacyEveryone, PrivacyContacts)
+	}
+	if e.Presence != nil && *e.Presence != PrivacyEveryone && *e.Presence != PrivacyContacts && *e.Presence != PrivacyNobody {
+		return fmt.Errorf("presence must be %s, %s or %s", PrivacyEveryone, PrivacyContacts, PrivacyNobody)
+	}
+
+	settings, err := c.hub.db.getPrivacySettings(c.user.id)
+	if err != nil {
+		return err
+	}
+	hidden, err := c.hub.db.getPresenceHiddenFrom(c.user.id)
+	if err != nil {
+		return err
+	}
+	if e.DirectRooms != nil {
+		settings.DirectRooms = *e.DirectRooms
+	}
+	if e.Presence != nil {
+		settings.Presence = *e.Presence
+	}
+	if err := c.hub.db.setPrivacySettings(c.user.id, settings); err != nil {
+		return err
+	}
+
+	if err := c.hub.announcePresenceChange(c.user, hidden); err != nil {
+		return err
+	}
+	return sendPrivacySettings(c, settings)
+}
+
+func sendPrivacySettings(c *Client, settings PrivacySettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventPrivacySettings
+	c.send <- outgoingEvent
+	return nil
+}
+
+// checks user accepts a new direct room from from
+func (h *Hub) checkDirectRoomAllowed(from *User, user *User) error {
+	settings, err := h.db.getPrivacySettings(user.id)
+	if err != nil {
+		return err
+	}
+	if settings.DirectRooms != PrivacyContacts {
+		return nil
+	}
+	status, err := h.db.getContactStatus(user.id, from.id)
+	if err != nil {
+		return err
+	}
+	if status != ContactAccepted {
+		return ErrContactsOnly
+	}
+	return nil
+}
+
+// tells the users that started or stopped seeing user's presence since hiddenBefore,
+// the result of getPresenceHiddenFrom, was taken. nothing changes for them while user is offline
+func (h *Hub) announcePresenceChange(user *User, hiddenBefore map[int]bool) error {
+	if !h.isConnected(user.id) {
+		return nil
+	}
+	hiddenAfter, err := h.db.getPresenceHiddenFrom(user.id)
+	if err != nil {
+		return err
+	}
+	for recipient := range hiddenAfter {
+		if !hiddenBefore[recipient] {
+			if err := sendPresence(h, recipient, user.username, EventUserDisconnected); err != nil {
+				return err
+			}
+		}
+	}
+	for recipient := range hiddenBefore {
+		if !hiddenAfter[recipient] {
+			if err := sendPresence(h, recipient, user.username, EventUserConnected); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
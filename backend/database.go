@@ -1,23 +1,35 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"os"
+	"encoding/json"
 	"fmt"
 	"errors"
+	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
-)
-
-const (
-	port = 5432
-	user = "postgres"
-	dbname = "gochat_db"
+	"github.com/lib/pq"
 )
 
 var (
 	RoomNotFoundError = errors.New("Room not found")
 	UserNotFoundError = errors.New("User not found")
+	NotRoomMemberError = errors.New("Not a member of this room")
+	MessageNotFoundError = errors.New("Message not found")
+	WebhookNotFoundError = errors.New("Webhook not found")
+	BotNotFoundError = errors.New("Bot not found")
+	BotTokenNotFoundError = errors.New("Bot token not found")
+	CommandNotFoundError = errors.New("Command not found")
+	InviteNotFoundError = errors.New("Invite not found")
+	ScheduledMessageNotFoundError = errors.New("Scheduled message not found")
+)
+
+// roles of a user in a room
+const (
+	RoleMember = "member"
+	RoleAdmin = "admin"
+	RoleOwner = "owner"
 )
 
 type Database struct {
@@ -29,12 +41,8 @@ func (db *Database) closeDb() {
 	db.db.Close()
 }
 
-func getDb(hub *Hub) (*Database, error) {
-	dbHost := os.Getenv("DB_HOST")
-	if dbHost == "" {
-		dbHost = "localhost"
-	}
-	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=disable", dbHost, port, user, os.Getenv("PSQL_PWD"), dbname)
+func getDb(hub *Hub, config DatabaseConfig) (*Database, error) {
+	psqlInfo := fmt.Sprintf("host=%s port=%d user=%s password=%s dbname=%s sslmode=%s", config.Host, config.Port, config.User, config.Password, config.Name, config.SSLMode)
 	db, err := sql.Open("postgres", psqlInfo)
 	if err != nil {
 		return nil, err
@@ -48,32 +56,122 @@ func getDb(hub *Hub) (*Database, error) {
 	return &Database{db: db, hub: hub}, nil
 }
 
+// stores the user and sets their id
 func (db *Database) addUser(user *User, password string) error {
-	sqlStatement := `INSERT INTO users (username, password) VALUES ($1, $2);`
-	_, err := db.db.Exec(sqlStatement, user.username, password)
-	return err
+	sqlStatement := `INSERT INTO users (username, password) VALUES ($1, $2) RETURNING id;`
+	row := db.db.QueryRow(sqlStatement, user.username, password)
+	return row.Scan(&user.id)
 }
 
 func (db *Database) getUserByUsername(username string) (*User, error) {
-	sqlStatement := `SELECT username FROM users WHERE username=$1;`
+	sqlStatement := `SELECT id, username, display_name, is_bot FROM users WHERE username=$1;`
+	return scanUser(db.db.QueryRow(sqlStatement, username))
+}
+
+func (db *Database) getUser(id int) (*User, error) {
+	sqlStatement := `SELECT id, username, display_name, is_bot FROM users WHERE id=$1;`
+	return scanUser(db.db.QueryRow(sqlStatement, id))
+}
+
+func scanUser(row *sql.Row) (*User, error) {
+	var id int
 	var name string
-	row := db.db.QueryRow(sqlStatement, username)
-	err := row.Scan(&name)
-	user := newUser(name)
+	var displayName string
+	var bot bool
+	err := row.Scan(&id, &name, &displayName, &bot)
 	switch err {
 	case sql.ErrNoRows:
 		return nil, UserNotFoundError
 	case nil:
+		user := newUser(id, name)
+		user.displayName = displayName
+		user.bot = bot
 		return user, nil
 	default:
 		return nil, err
 	}
 }
 
-func (db *Database) getPasswordHashByUsername(username string) (string, error) {
-	sqlStatement := `SELECT password FROM users WHERE username=$1;`
+// renames the user, nothing else refers to the username
+func (db *Database) setUsername(userId int, username string) error {
+	sqlStatement := `UPDATE users SET username=$1 WHERE id=$2;`
+	_, err := db.db.Exec(sqlStatement, username, userId)
+	return err
+}
+
+// escapes the wildcards of a LIKE pattern
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+const profileColumns = `id, username, display_name, avatar, bio, status_text, is_bot`
+
+// scans a row selecting profileColumns
+func scanProfile(scan func(dest ...any) error) (Profile, error) {
+	var profile Profile
+	err := scan(&profile.Id, &profile.Username, &profile.DisplayName, &profile.Avatar, &profile.Bio, &profile.StatusText, &profile.Bot)
+	return profile, err
+}
+
+func (db *Database) getProfile(userId int) (Profile, error) {
+	sqlStatement := `SELECT ` + profileColumns + ` FROM users WHERE id=$1;`
+	profile, err := scanProfile(db.db.QueryRow(sqlStatement, userId).Scan)
+	if err == sql.ErrNoRows {
+		return profile, UserNotFoundError
+	}
+	return profile, err
+}
+
+// persists the profile fields of the user, the username is changed with setUsername
+func (db *Database) updateProfile(profile Profile) error {
+	sqlStatement := `UPDATE users SET display_name=$1, avatar=$2, bio=$3, status_text=$4 WHERE id=$5;`
+	_, err := db.db.Exec(sqlStatement, profile.DisplayName, profile.Avatar, profile.Bio, profile.StatusText, profile.Id)
+	return err
+}
+
+// returns up to limit users whose username or display name starts with prefix, case insensitive,
+// ordered by username and after the username after. users that blocked searcher and the tombstone are left out
+func (db *Database) searchUsers(searcher int, prefix string, after string, limit int) ([]Profile, error) {
+	sqlStatement := `SELECT ` + profileColumns + ` FROM users
+		WHERE (lower(username) LIKE $1 ESCAPE '\' OR lower(display_name) LIKE $1 ESCAPE '\') AND username>$2 AND username<>$3
+		AND NOT EXISTS (SELECT 1 FROM user_blocks WHERE blocker=users.id AND blocked=$4)
+		ORDER BY username LIMIT $5;`
+	pattern := likeEscaper.Replace(strings.ToLower(prefix)) + "%"
+	rows, err := db.db.Query(sqlStatement, pattern, after, tombstoneUsername, searcher, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	profiles := []Profile{}
+	for rows.Next() {
+		profile, err := scanProfile(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, profile)
+	}
+	return profiles, rows.Err()
+}
+
+// returns the user's id and password hash
+func (db *Database) getPasswordHashByUsername(username string) (int, string, error) {
+	sqlStatement := `SELECT id, password FROM users WHERE username=$1;`
+	var id int
 	var password string
 	row := db.db.QueryRow(sqlStatement, username)
+	err := row.Scan(&id, &password)
+	switch err {
+	case sql.ErrNoRows:
+		return 0, "", UserNotFoundError
+	case nil:
+		return id, password, nil
+	default:
+		return 0, "", err
+	}
+}
+
+func (db *Database) getPasswordHash(userId int) (string, error) {
+	sqlStatement := `SELECT password FROM users WHERE id=$1;`
+	var password string
+	row := db.db.QueryRow(sqlStatement, userId)
 	err := row.Scan(&password)
 	switch err {
 	case sql.ErrNoRows:
@@ -86,15 +184,15 @@ func (db *Database) getPasswordHashByUsername(username string) (string, error) {
 }
 
 func (db *Database) updateUserRoom(user *User, roomId int) error {
-	sqlStatement := `UPDATE users SET room_id=$1 WHERE username=$2;`
-	_, err := db.db.Exec(sqlStatement, roomId, user.username);
+	sqlStatement := `UPDATE users SET room_id=$1 WHERE id=$2;`
+	_, err := db.db.Exec(sqlStatement, roomId, user.id);
 	return err
 }
 
 func (db *Database) addRoom(room *Room) (int, error) {
-	sqlStatement := `INSERT INTO rooms (capacity, name) VALUES ($1, $2) RETURNING Id;`
+	sqlStatement := `INSERT INTO rooms (capacity, name, topic, description, encrypted, visibility) VALUES ($1, $2, $3, $4, $5, $6) RETURNING Id;`
 	var id int
-	row := db.db.QueryRow(sqlStatement, room.capacity, room.name)
+	row := db.db.QueryRow(sqlStatement, room.capacity, room.name, room.topic, room.description, room.encrypted, room.visibility)
 	err := row.Scan(&id)
 	if err != nil {
 		return -1, err
@@ -103,7 +201,7 @@ func (db *Database) addRoom(room *Room) (int, error) {
 }
 
 func (db *Database) getRoomObjects() (map[int]*Room, error) {
-	sqlStatement := `SELECT id, capacity, name FROM rooms;`
+	sqlStatement := `SELECT id, capacity, name, topic, description, avatar, encrypted, visibility, retention_days, retention_messages FROM rooms;`
 	rooms := make(map[int]*Room)
 	rows, err := db.db.Query(sqlStatement)
 	if err != nil {
@@ -113,10 +211,16 @@ func (db *Database) getRoomObjects() (map[int]*Room, error) {
 	for rows.Next() {
 		room := newRoom(db.hub)
 		var id int
-		err = rows.Scan(&id, &room.capacity, &room.name)
+		var retentionDays, retentionMessages sql.NullInt64
+		err = rows.Scan(&id, &room.capacity, &room.name, &room.topic, &room.description, &room.avatar, &room.encrypted, &room.visibility, &retentionDays, &retentionMessages)
 		if err != nil {
 			return nil, err	
 		}
+		if retentionDays.Valid {
+			room.retention = &RetentionPolicy{Days: int(retentionDays.Int64), Messages: int(retentionMessages.Int64)}
+		}
+		room.id = id
+		room.lastMessage = db.getLastRoomMessage(id)
 		roomUsers, err := db.getRoomUsers(id)
 		if err != nil {
 			return nil, err
@@ -127,10 +231,10 @@ func (db *Database) getRoomObjects() (map[int]*Room, error) {
 	return rooms, nil
 }
 
-func (db *Database) getRooms(username string) ([]int, error) {
-	sqlStatement := `SELECT rooms.id FROM rooms, room_users WHERE rooms.id=room_users.room_id AND room_users.username=$1;`
+func (db *Database) getRooms(userId int) ([]int, error) {
+	sqlStatement := `SELECT rooms.id FROM rooms, room_users WHERE rooms.id=room_users.room_id AND room_users.user_id=$1;`
 	var roomIds []int
-	rows, err := db.db.Query(sqlStatement, username)
+	rows, err := db.db.Query(sqlStatement, userId)
 	if err != nil {
 		return nil, err
 	}
@@ -146,20 +250,98 @@ func (db *Database) getRooms(username string) ([]int, error) {
 	return roomIds, nil
 }
 
-func (db *Database) updateRoomName(roomId int, name string) error {
-	sqlStatement := `UPDATE rooms SET name=$1 WHERE id=$2;`
-	_, err := db.db.Exec(sqlStatement, name, roomId)
+// persists the room's name, topic, description, avatar and visibility
+func (db *Database) updateRoomSettings(room *Room) error {
+	sqlStatement := `UPDATE rooms SET name=$1, topic=$2, description=$3, avatar=$4, visibility=$5 WHERE id=$6;`
+	_, err := db.db.Exec(sqlStatement, room.name, room.topic, room.description, room.avatar, room.visibility, room.id)
 	return err
 }
 
-func (db *Database) addMessage(message NewMessageEvent, roomId int) error {
-	sqlStatement := `INSERT INTO messages (message, author, date_sent, room_id) VALUES ($1, $2, $3, $4);`
-	_, err := db.db.Exec(sqlStatement, message.Message, message.From, message.Sent, roomId)
+// returns up to limit public rooms whose name or topic contains query, case insensitive,
+// skipping the first offset. the most populated come first
+// returns a page of the public rooms matching query, and whether userId joined each of them
+func (db *Database) listPublicRooms(userId int, query string, offset int, limit int) ([]PublicRoom, error) {
+	sqlStatement := `SELECT r.id, r.name, r.topic, r.description, r.avatar, COUNT(ru.user_id) AS members, COALESCE(bool_or(ru.user_id=$4), FALSE)
+		FROM rooms r LEFT JOIN room_users ru ON ru.room_id=r.id
+		WHERE r.visibility='public' AND (lower(r.name) LIKE $1 OR lower(r.topic) LIKE $1)
+		GROUP BY r.id ORDER BY members DESC, r.id OFFSET $2 LIMIT $3;`
+	pattern := "%" + likeEscaper.Replace(strings.ToLower(query)) + "%"
+	rows, err := db.db.Query(sqlStatement, pattern, offset, limit, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	rooms := []PublicRoom{}
+	for rows.Next() {
+		var room PublicRoom
+		if err := rows.Scan(&room.Id, &room.Name, &room.Topic, &room.Description, &room.Avatar, &room.Members, &room.Joined); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
+
+func (db *Database) addMessage(message NewMessageEvent, roomId int) (int, error) {
+	sqlStatement := `INSERT INTO messages (message, author_id, date_sent, room_id, from_bot, envelope, format, html) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id;`
+	var envelope sql.NullString
+	if message.Envelope != nil {
+		data, err := json.Marshal(message.Envelope)
+		if err != nil {
+			return -1, err
+		}
+		envelope = sql.NullString{String: string(data), Valid: true}
+	}
+	var id int
+	var html sql.NullString
+	if message.HTML != "" {
+		html = sql.NullString{String: message.HTML, Valid: true}
+	}
+	args := []any{message.Message, message.FromId, message.Sent, roomId, message.Bot, envelope, message.Format, html}
+	if message.scheduledId != 0 {
+		// the scheduled message is removed in the same statement, so it can't be posted twice
+		sqlStatement = `WITH posted AS (DELETE FROM scheduled_messages WHERE id=$9) ` + sqlStatement
+		args = append(args, message.scheduledId)
+	}
+	row := db.db.QueryRow(sqlStatement, args...)
+	err := row.Scan(&id)
+	if err != nil {
+		return -1, err
+	}
+	return id, nil
+}
+
+// columns of a message and its author, selected FROM messages m JOIN users u ON u.id=m.author_id
+const messageColumns = `m.id, m.message, u.username, m.author_id, u.display_name, m.date_sent, m.room_id, m.from_bot, m.envelope, m.format, COALESCE(m.html, '')`
+
+// scans a row selecting messageColumns
+func scanMessage(scan func(dest ...any) error) (NewMessageEvent, error) {
+	var message NewMessageEvent
+	var envelope sql.NullString
+	err := scan(&message.Id, &message.Message, &message.From, &message.FromId, &message.FromDisplayName, &message.Sent, &message.RoomId, &message.Bot, &envelope, &message.Format, &message.HTML)
+	if err != nil {
+		return message, err
+	}
+	return message, decodeEnvelope(envelope, &message)
+}
+
+func (db *Database) getMessage(id int) (NewMessageEvent, error) {
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id WHERE m.id=$1;`
+	message, err := scanMessage(db.db.QueryRow(sqlStatement, id).Scan)
+	if err == sql.ErrNoRows {
+		return message, MessageNotFoundError
+	}
+	return message, err
+}
+
+func (db *Database) deleteMessage(id int) error {
+	sqlStatement := `DELETE FROM messages WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
 	return err
 }
 
 func (db *Database) getMessages(roomId int) ([]NewMessageEvent, error) {
-	sqlStatement := `SELECT message, author, date_sent, room_id FROM messages WHERE room_id=$1;`
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id WHERE m.room_id=$1 ORDER BY m.date_sent;`
 	var events []NewMessageEvent
 	rows, err := db.db.Query(sqlStatement, roomId)
 	if err != nil {
@@ -167,8 +349,7 @@ func (db *Database) getMessages(roomId int) ([]NewMessageEvent, error) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var event NewMessageEvent
-		err = rows.Scan(&event.Message, &event.From, &event.Sent, &event.RoomId)
+		event, err := scanMessage(rows.Scan)
 		if err != nil {
 			return nil, err
 		}
@@ -177,34 +358,295 @@ func (db *Database) getMessages(roomId int) ([]NewMessageEvent, error) {
 	return events, nil
 }
 
-func (db *Database) getRoomUsers(roomId int) (map[string]bool, error) {
-	sqlStatement := `SELECT username FROM room_users WHERE room_id=$1;`
-	users := make(map[string]bool) 
+// returns the latest limit messages of the room, oldest first
+func (db *Database) getRecentMessages(roomId int, limit int) ([]NewMessageEvent, error) {
+	sqlStatement := `SELECT * FROM (SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id
+		WHERE m.room_id=$1 ORDER BY m.date_sent DESC, m.id DESC LIMIT $2) recent ORDER BY date_sent, id;`
+	rows, err := db.db.Query(sqlStatement, roomId, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []NewMessageEvent{}
+	for rows.Next() {
+		message, err := scanMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// returns the room's members by id
+func (db *Database) getRoomUsers(roomId int) (map[int]User, error) {
+	sqlStatement := `SELECT users.id, users.username, users.display_name, users.is_bot FROM room_users JOIN users ON users.id=room_users.user_id WHERE room_id=$1;`
+	users := make(map[int]User) 
 	rows, err := db.db.Query(sqlStatement, roomId)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var username string
-		err = rows.Scan(&username)
+		var user User
+		err = rows.Scan(&user.id, &user.username, &user.displayName, &user.bot)
 		if err != nil {
 			return nil, err
 		}
-		users[username] = true
+		users[user.id] = user
 	}
 	return users, nil
 }
 
-func (db *Database) addUserToRoom(username string, roomId int) error {
-	sqlStatement := `INSERT INTO room_users (room_id, username) VALUES ($1, $2);`
-	_, err := db.db.Exec(sqlStatement, roomId, username)
+func (db *Database) addUserToRoom(userId int, roomId int, role string) error {
+	sqlStatement := `INSERT INTO room_users (room_id, user_id, role) VALUES ($1, $2, $3);`
+	_, err := db.db.Exec(sqlStatement, roomId, userId, role)
+	return err
+}
+
+func (db *Database) removeUserFromRoom(userId int, roomId int) error {
+	sqlStatement := `DELETE FROM room_users WHERE room_id=$1 AND user_id=$2;`
+	_, err := db.db.Exec(sqlStatement, roomId, userId)
+	return err
+}
+
+func (db *Database) setRoomRole(userId int, roomId int, role string) error {
+	sqlStatement := `UPDATE room_users SET role=$1 WHERE room_id=$2 AND user_id=$3;`
+	_, err := db.db.Exec(sqlStatement, role, roomId, userId)
+	return err
+}
+
+// makes newOwner the owner of the room, the previous owner becomes an admin
+func (db *Database) transferRoomOwnership(roomId int, owner int, newOwner int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`UPDATE room_users SET role=$1 WHERE room_id=$2 AND user_id=$3;`, RoleAdmin, roomId, owner)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE room_users SET role=$1 WHERE room_id=$2 AND user_id=$3;`, RoleOwner, roomId, newOwner)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// returns when the user's mute in a room ends, the zero time if they are not muted.
+// fails with NotRoomMemberError if they are not a member
+func (db *Database) getMutedUntil(roomId int, userId int) (time.Time, error) {
+	sqlStatement := `SELECT muted_until FROM room_users WHERE room_id=$1 AND user_id=$2;`
+	var mutedUntil sql.NullTime
+	row := db.db.QueryRow(sqlStatement, roomId, userId)
+	err := row.Scan(&mutedUntil)
+	switch err {
+	case sql.ErrNoRows:
+		return time.Time{}, NotRoomMemberError
+	case nil:
+		return mutedUntil.Time, nil
+	default:
+		return time.Time{}, err
+	}
+}
+
+// mutes the user until the given time, the zero time lifts the mute
+func (db *Database) setMutedUntil(roomId int, userId int, until time.Time) error {
+	sqlStatement := `UPDATE room_users SET muted_until=$1 WHERE room_id=$2 AND user_id=$3;`
+	var mutedUntil sql.NullTime
+	if !until.IsZero() {
+		mutedUntil = sql.NullTime{Time: until.UTC(), Valid: true}
+	}
+	_, err := db.db.Exec(sqlStatement, mutedUntil, roomId, userId)
+	return err
+}
+
+func (db *Database) pinMessage(roomId int, messageId int, userId int) error {
+	sqlStatement := `INSERT INTO pinned_messages (room_id, message_id, pinned_by) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`
+	_, err := db.db.Exec(sqlStatement, roomId, messageId, userId)
+	return err
+}
+
+func (db *Database) unpinMessage(roomId int, messageId int) error {
+	sqlStatement := `DELETE FROM pinned_messages WHERE room_id=$1 AND message_id=$2;`
+	_, err := db.db.Exec(sqlStatement, roomId, messageId)
+	return err
+}
+
+// returns the messages pinned in the room, the latest pin first
+func (db *Database) getPinnedMessages(roomId int) ([]PinnedMessage, error) {
+	sqlStatement := `SELECT ` + messageColumns + `, COALESCE(pinner.username, ''), p.pinned_at FROM pinned_messages p
+		JOIN messages m ON m.id=p.message_id JOIN users u ON u.id=m.author_id LEFT JOIN users pinner ON pinner.id=p.pinned_by
+		WHERE p.room_id=$1 ORDER BY p.pinned_at DESC, m.id DESC;`
+	rows, err := db.db.Query(sqlStatement, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pins := []PinnedMessage{}
+	for rows.Next() {
+		var pin PinnedMessage
+		pin.NewMessageEvent, err = scanMessage(func(dest ...any) error {
+			return rows.Scan(append(dest, &pin.PinnedBy, &pin.PinnedAt)...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, rows.Err()
+}
+
+func (db *Database) isMessagePinned(messageId int) (bool, error) {
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM pinned_messages WHERE message_id=$1);`
+	var pinned bool
+	err := db.db.QueryRow(sqlStatement, messageId).Scan(&pinned)
+	return pinned, err
+}
+
+func (db *Database) saveMessage(userId int, messageId int) error {
+	sqlStatement := `INSERT INTO saved_messages (user_id, message_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;`
+	_, err := db.db.Exec(sqlStatement, userId, messageId)
+	return err
+}
+
+func (db *Database) unsaveMessage(userId int, messageId int) error {
+	sqlStatement := `DELETE FROM saved_messages WHERE user_id=$1 AND message_id=$2;`
+	_, err := db.db.Exec(sqlStatement, userId, messageId)
+	return err
+}
+
+// returns the messages saved by the user in the rooms they are still a member of, the latest saved first
+func (db *Database) getSavedMessages(userId int) ([]SavedMessage, error) {
+	sqlStatement := `SELECT ` + messageColumns + `, s.saved_at FROM saved_messages s
+		JOIN messages m ON m.id=s.message_id JOIN users u ON u.id=m.author_id
+		JOIN room_users r ON r.room_id=m.room_id AND r.user_id=s.user_id
+		WHERE s.user_id=$1 ORDER BY s.saved_at DESC, m.id DESC;`
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	saved := []SavedMessage{}
+	for rows.Next() {
+		var message SavedMessage
+		message.NewMessageEvent, err = scanMessage(func(dest ...any) error {
+			return rows.Scan(append(dest, &message.SavedAt)...)
+		})
+		if err != nil {
+			return nil, err
+		}
+		saved = append(saved, message)
+	}
+	return saved, rows.Err()
+}
+
+// returns the role of a user in a room, NotRoomMemberError if they are not a member
+func (db *Database) getRoomRole(roomId int, userId int) (string, error) {
+	sqlStatement := `SELECT role FROM room_users WHERE room_id=$1 AND user_id=$2;`
+	var role string
+	row := db.db.QueryRow(sqlStatement, roomId, userId)
+	err := row.Scan(&role)
+	switch err {
+	case sql.ErrNoRows:
+		return "", NotRoomMemberError
+	case nil:
+		return role, nil
+	default:
+		return "", err
+	}
+}
+
+// columns of an invite and its creator, selected FROM room_invites i JOIN users u ON u.id=i.created_by
+const inviteColumns = `i.code, i.room_id, u.username, i.created_by, i.role, i.max_uses, i.uses, i.expires_at, i.created_at`
+
+// scans a row selecting inviteColumns
+func scanInvite(scan func(dest ...any) error) (RoomInvite, error) {
+	var invite RoomInvite
+	var maxUses sql.NullInt64
+	var expiresAt sql.NullTime
+	err := scan(&invite.Code, &invite.RoomId, &invite.CreatedBy, &invite.creatorId, &invite.Role, &maxUses, &invite.Uses, &expiresAt, &invite.CreatedAt)
+	if maxUses.Valid {
+		n := int(maxUses.Int64)
+		invite.MaxUses = &n
+	}
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.Time
+	}
+	return invite, err
+}
+
+// stores the invite, it expires after expiresIn unless it is 0
+func (db *Database) addRoomInvite(invite *RoomInvite, expiresIn time.Duration) error {
+	sqlStatement := `INSERT INTO room_invites (code, room_id, created_by, role, max_uses, expires_at)
+		VALUES ($1, $2, $3, $4, $5, CASE WHEN $6::float8 > 0 THEN NOW() + make_interval(secs => $6::float8) END) RETURNING created_at, expires_at;`
+	var expiresAt sql.NullTime
+	row := db.db.QueryRow(sqlStatement, invite.Code, invite.RoomId, invite.creatorId, invite.Role, invite.MaxUses, expiresIn.Seconds())
+	if err := row.Scan(&invite.CreatedAt, &expiresAt); err != nil {
+		return err
+	}
+	if expiresAt.Valid {
+		invite.ExpiresAt = &expiresAt.Time
+	}
+	return nil
+}
+
+func (db *Database) getRoomInvite(code string) (RoomInvite, error) {
+	sqlStatement := `SELECT ` + inviteColumns + ` FROM room_invites i JOIN users u ON u.id=i.created_by WHERE i.code=$1;`
+	invite, err := scanInvite(db.db.QueryRow(sqlStatement, code).Scan)
+	if err == sql.ErrNoRows {
+		return invite, InviteNotFoundError
+	}
+	return invite, err
+}
+
+func (db *Database) getRoomInvites(roomId int) ([]RoomInvite, error) {
+	sqlStatement := `SELECT ` + inviteColumns + ` FROM room_invites i JOIN users u ON u.id=i.created_by WHERE i.room_id=$1 ORDER BY i.created_at;`
+	rows, err := db.db.Query(sqlStatement, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	invites := []RoomInvite{}
+	for rows.Next() {
+		invite, err := scanInvite(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		invites = append(invites, invite)
+	}
+	return invites, rows.Err()
+}
+
+func (db *Database) deleteRoomInvite(code string) error {
+	sqlStatement := `DELETE FROM room_invites WHERE code=$1;`
+	_, err := db.db.Exec(sqlStatement, code)
+	return err
+}
+
+// counts a use of the invite. fails with false if it expired or was used up
+func (db *Database) useRoomInvite(code string) (bool, error) {
+	sqlStatement := `UPDATE room_invites SET uses=uses+1 WHERE code=$1 AND (max_uses IS NULL OR uses<max_uses) AND (expires_at IS NULL OR expires_at>NOW());`
+	res, err := db.db.Exec(sqlStatement, code)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// gives back a use counted by useRoomInvite, when joining failed afterwards
+func (db *Database) releaseRoomInvite(code string) error {
+	sqlStatement := `UPDATE room_invites SET uses=uses-1 WHERE code=$1 AND uses>0;`
+	_, err := db.db.Exec(sqlStatement, code)
 	return err
 }
 
-func (db *Database) getRoomByUsers(username1 string, username2 string) (int, error) {
-	sqlStatement := `SELECT r.id FROM rooms r, room_users u1, room_users u2 WHERE r.capacity=2 AND r.id=u1.room_id AND r.id=u2.room_id AND u1.username=$1 AND u2.username=$2;`
-	row := db.db.QueryRow(sqlStatement, username1, username2)
+func (db *Database) getRoomByUsers(user1 int, user2 int) (int, error) {
+	sqlStatement := `SELECT r.id FROM rooms r, room_users u1, room_users u2 WHERE r.capacity=2 AND r.id=u1.room_id AND r.id=u2.room_id AND u1.user_id=$1 AND u2.user_id=$2;`
+	row := db.db.QueryRow(sqlStatement, user1, user2)
 	var id int
 	err := row.Scan(&id)
 	if err != nil {
@@ -217,13 +659,1318 @@ func (db *Database) getRoomByUsers(username1 string, username2 string) (int, err
 }
 
 func (db *Database) getLastRoomMessage(roomId int) NewMessageEvent {
-	sqlStatement := `SELECT message, author, date_sent, room_id FROM messages WHERE room_id=$1 ORDER BY date_sent DESC LIMIT 1;`
-	row := db.db.QueryRow(sqlStatement, roomId)
-	var message NewMessageEvent
-	err := row.Scan(&message.Message, &message.From, &message.Sent, &message.RoomId)
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id WHERE m.room_id=$1 ORDER BY m.date_sent DESC LIMIT 1;`
+	message, err := scanMessage(db.db.QueryRow(sqlStatement, roomId).Scan)
 	if err != nil {
 		return NewMessageEvent{}
 	}
 	return message
 }
 
+
+// returns the totp secret, whether 2fa is enabled and the last accepted time step
+func (db *Database) getTOTP(userId int) (string, bool, int64, error) {
+	sqlStatement := `SELECT COALESCE(totp_secret, ''), totp_enabled, totp_last_step FROM users WHERE id=$1;`
+	var secret string
+	var enabled bool
+	var lastStep int64
+	row := db.db.QueryRow(sqlStatement, userId)
+	err := row.Scan(&secret, &enabled, &lastStep)
+	switch err {
+	case sql.ErrNoRows:
+		return "", false, 0, UserNotFoundError
+	case nil:
+		return secret, enabled, lastStep, nil
+	default:
+		return "", false, 0, err
+	}
+}
+
+// stores a pending secret, 2fa stays disabled until it is confirmed
+func (db *Database) setTOTPSecret(userId int, secret string) error {
+	sqlStatement := `UPDATE users SET totp_secret=$1, totp_enabled=FALSE, totp_last_step=0 WHERE id=$2;`
+	_, err := db.db.Exec(sqlStatement, secret, userId)
+	return err
+}
+
+func (db *Database) setTOTPEnabled(userId int, enabled bool) error {
+	sqlStatement := `UPDATE users SET totp_enabled=$1 WHERE id=$2;`
+	if !enabled {
+		sqlStatement = `UPDATE users SET totp_enabled=$1, totp_secret=NULL, totp_last_step=0 WHERE id=$2;`
+	}
+	_, err := db.db.Exec(sqlStatement, enabled, userId)
+	return err
+}
+
+// records the last accepted time step. fails with false if a concurrent login already used it
+func (db *Database) updateTOTPLastStep(userId int, step int64) (bool, error) {
+	sqlStatement := `UPDATE users SET totp_last_step=$1 WHERE id=$2 AND totp_last_step<$1;`
+	res, err := db.db.Exec(sqlStatement, step, userId)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// replaces the user's recovery codes with the given hashes
+func (db *Database) setRecoveryCodes(userId int, hashes []string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM recovery_codes WHERE user_id=$1;`, userId)
+	if err != nil {
+		return err
+	}
+	for _, hash := range hashes {
+		_, err = tx.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2);`, userId, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// returns the ids and hashes of the user's unused recovery codes
+func (db *Database) getRecoveryCodes(userId int) (map[int]string, error) {
+	sqlStatement := `SELECT id, code_hash FROM recovery_codes WHERE user_id=$1 AND used=FALSE;`
+	codes := make(map[int]string)
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var hash string
+		err = rows.Scan(&id, &hash)
+		if err != nil {
+			return nil, err
+		}
+		codes[id] = hash
+	}
+	return codes, nil
+}
+
+// marks a recovery code as used. fails with false if it already was
+func (db *Database) useRecoveryCode(id int) (bool, error) {
+	sqlStatement := `UPDATE recovery_codes SET used=TRUE WHERE id=$1 AND used=FALSE;`
+	res, err := db.db.Exec(sqlStatement, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *Database) blockUser(blocker int, blocked int) error {
+	sqlStatement := `INSERT INTO user_blocks (blocker, blocked) VALUES ($1, $2) ON CONFLICT DO NOTHING;`
+	_, err := db.db.Exec(sqlStatement, blocker, blocked)
+	return err
+}
+
+func (db *Database) unblockUser(blocker int, blocked int) error {
+	sqlStatement := `DELETE FROM user_blocks WHERE blocker=$1 AND blocked=$2;`
+	_, err := db.db.Exec(sqlStatement, blocker, blocked)
+	return err
+}
+
+// returns the ids of the users that blocked userId
+func (db *Database) getBlockers(userId int) (map[int]bool, error) {
+	return db.queryUserSet(`SELECT blocker FROM user_blocks WHERE blocked=$1;`, userId)
+}
+
+// returns the usernames of the users blocked by userId, sorted
+func (db *Database) getBlockedUsernames(userId int) ([]string, error) {
+	sqlStatement := `SELECT users.username FROM user_blocks JOIN users ON users.id=user_blocks.blocked WHERE blocker=$1 ORDER BY users.username;`
+	return db.queryUsernames(sqlStatement, userId)
+}
+
+func (db *Database) isBlockedEitherWay(user1 int, user2 int) (bool, error) {
+	sqlStatement := `SELECT EXISTS (SELECT 1 FROM user_blocks WHERE (blocker=$1 AND blocked=$2) OR (blocker=$2 AND blocked=$1));`
+	var blocked bool
+	row := db.db.QueryRow(sqlStatement, user1, user2)
+	err := row.Scan(&blocked)
+	return blocked, err
+}
+
+func (db *Database) getPrivacySettings(userId int) (PrivacySettings, error) {
+	sqlStatement := `SELECT direct_room_privacy, presence_privacy FROM users WHERE id=$1;`
+	var settings PrivacySettings
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&settings.DirectRooms, &settings.Presence)
+	if err == sql.ErrNoRows {
+		return settings, UserNotFoundError
+	}
+	return settings, err
+}
+
+func (db *Database) setPrivacySettings(userId int, settings PrivacySettings) error {
+	sqlStatement := `UPDATE users SET direct_room_privacy=$1, presence_privacy=$2 WHERE id=$3;`
+	_, err := db.db.Exec(sqlStatement, settings.DirectRooms, settings.Presence, userId)
+	return err
+}
+
+// returns the ids of the users that don't see userId's presence: the users they blocked,
+// and the members of their rooms their presence privacy setting leaves out
+func (db *Database) getPresenceHiddenFrom(userId int) (map[int]bool, error) {
+	sqlStatement := `SELECT blocked FROM user_blocks WHERE blocker=$1
+		UNION SELECT other.user_id FROM users me JOIN room_users mine ON mine.user_id=me.id JOIN room_users other ON other.room_id=mine.room_id
+		WHERE me.id=$1 AND other.user_id<>$1 AND (me.presence_privacy='nobody' OR (me.presence_privacy='contacts' AND NOT EXISTS (SELECT 1 FROM contacts c
+			WHERE c.status='accepted' AND ((c.user_id=$1 AND c.contact_id=other.user_id) OR (c.user_id=other.user_id AND c.contact_id=$1)))));`
+	return db.queryUserSet(sqlStatement, userId)
+}
+
+// returns the ids of the users whose presence userId doesn't see, the reverse of getPresenceHiddenFrom
+func (db *Database) getPresenceHiddenTo(userId int) (map[int]bool, error) {
+	sqlStatement := `SELECT blocker FROM user_blocks WHERE blocked=$1
+		UNION SELECT them.id FROM room_users mine JOIN room_users other ON other.room_id=mine.room_id JOIN users them ON them.id=other.user_id
+		WHERE mine.user_id=$1 AND them.id<>$1 AND (them.presence_privacy='nobody' OR (them.presence_privacy='contacts' AND NOT EXISTS (SELECT 1 FROM contacts c
+			WHERE c.status='accepted' AND ((c.user_id=$1 AND c.contact_id=them.id) OR (c.user_id=them.id AND c.contact_id=$1)))));`
+	return db.queryUserSet(sqlStatement, userId)
+}
+
+// stores a pending contact request, does nothing when there already is one between the users
+func (db *Database) addContactRequest(from int, to int) error {
+	sqlStatement := `INSERT INTO contacts (user_id, contact_id) VALUES ($1, $2) ON CONFLICT DO NOTHING;`
+	_, err := db.db.Exec(sqlStatement, from, to)
+	return err
+}
+
+// returns what other is to userId: ContactAccepted, ContactOutgoing, ContactIncoming, or "" when nothing
+func (db *Database) getContactStatus(userId int, other int) (string, error) {
+	sqlStatement := `SELECT CASE WHEN status='accepted' THEN 'accepted' WHEN user_id=$1 THEN 'outgoing' ELSE 'incoming' END
+		FROM contacts WHERE (user_id=$1 AND contact_id=$2) OR (user_id=$2 AND contact_id=$1);`
+	var status string
+	err := db.db.QueryRow(sqlStatement, userId, other).Scan(&status)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return status, err
+}
+
+// accepts the pending request sent by from to to. fails with false if there is none
+func (db *Database) acceptContactRequest(from int, to int) (bool, error) {
+	sqlStatement := `UPDATE contacts SET status='accepted' WHERE user_id=$1 AND contact_id=$2 AND status='pending';`
+	res, err := db.db.Exec(sqlStatement, from, to)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// removes the contact or the pending request between the users, whoever sent it
+func (db *Database) removeContact(user1 int, user2 int) error {
+	sqlStatement := `DELETE FROM contacts WHERE (user_id=$1 AND contact_id=$2) OR (user_id=$2 AND contact_id=$1);`
+	_, err := db.db.Exec(sqlStatement, user1, user2)
+	return err
+}
+
+// returns the user's contacts and pending requests, sorted by username
+func (db *Database) getContacts(userId int) ([]Contact, error) {
+	sqlStatement := `SELECT u.id, u.username, u.display_name, CASE WHEN c.status='accepted' THEN 'accepted' WHEN c.user_id=$1 THEN 'outgoing' ELSE 'incoming' END
+		FROM contacts c JOIN users u ON u.id = CASE WHEN c.user_id=$1 THEN c.contact_id ELSE c.user_id END
+		WHERE c.user_id=$1 OR c.contact_id=$1 ORDER BY u.username;`
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	contacts := []Contact{}
+	for rows.Next() {
+		var contact Contact
+		if err := rows.Scan(&contact.Id, &contact.Username, &contact.DisplayName, &contact.Status); err != nil {
+			return nil, err
+		}
+		contacts = append(contacts, contact)
+	}
+	return contacts, rows.Err()
+}
+
+// runs a query selecting a single column of user ids
+func (db *Database) queryUserSet(sqlStatement string, args ...any) (map[int]bool, error) {
+	users := make(map[int]bool)
+	rows, err := db.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, err
+		}
+		users[id] = true
+	}
+	return users, rows.Err()
+}
+
+// runs a query selecting a single column of usernames
+func (db *Database) queryUsernames(sqlStatement string, args ...any) ([]string, error) {
+	usernames := []string{}
+	rows, err := db.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		err = rows.Scan(&username)
+		if err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+// site administrators manage global settings such as webhooks for every room
+func (db *Database) isAdmin(userId int) (bool, error) {
+	sqlStatement := `SELECT is_admin FROM users WHERE id=$1;`
+	var admin bool
+	row := db.db.QueryRow(sqlStatement, userId)
+	err := row.Scan(&admin)
+	switch err {
+	case sql.ErrNoRows:
+		return false, UserNotFoundError
+	default:
+		return admin, err
+	}
+}
+
+func (db *Database) addWebhook(webhook *Webhook) error {
+	sqlStatement := `INSERT INTO webhooks (room_id, url, secret, events, created_by) VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at;`
+	var roomId sql.NullInt64
+	if webhook.RoomId != 0 {
+		roomId = sql.NullInt64{Int64: int64(webhook.RoomId), Valid: true}
+	}
+	row := db.db.QueryRow(sqlStatement, roomId, webhook.URL, webhook.secret, pq.Array(webhook.Events), webhook.creatorId)
+	return row.Scan(&webhook.Id, &webhook.CreatedAt)
+}
+
+const webhookColumns = `w.id, COALESCE(w.room_id, 0), w.url, w.secret, w.events, u.username, w.created_by, w.created_at`
+
+func (db *Database) getWebhook(id int) (*Webhook, error) {
+	sqlStatement := `SELECT ` + webhookColumns + ` FROM webhooks w JOIN users u ON u.id=w.created_by WHERE w.id=$1;`
+	var webhook Webhook
+	row := db.db.QueryRow(sqlStatement, id)
+	err := row.Scan(&webhook.Id, &webhook.RoomId, &webhook.URL, &webhook.secret, pq.Array(&webhook.Events), &webhook.CreatedBy, &webhook.creatorId, &webhook.CreatedAt)
+	switch err {
+	case sql.ErrNoRows:
+		return nil, WebhookNotFoundError
+	case nil:
+		return &webhook, nil
+	default:
+		return nil, err
+	}
+}
+
+// returns the webhooks of a room, or the global ones when roomId is 0
+func (db *Database) getWebhooks(roomId int) ([]*Webhook, error) {
+	sqlStatement := `SELECT ` + webhookColumns + ` FROM webhooks w JOIN users u ON u.id=w.created_by WHERE COALESCE(w.room_id, 0)=$1 ORDER BY w.id;`
+	var webhooks []*Webhook
+	rows, err := db.db.Query(sqlStatement, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var webhook Webhook
+		err = rows.Scan(&webhook.Id, &webhook.RoomId, &webhook.URL, &webhook.secret, pq.Array(&webhook.Events), &webhook.CreatedBy, &webhook.creatorId, &webhook.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (db *Database) deleteWebhook(id int) error {
+	sqlStatement := `DELETE FROM webhooks WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
+	return err
+}
+
+// queues a delivery of the event for every webhook of the room and every global webhook subscribed to it
+func (db *Database) enqueueWebhookDeliveries(roomId int, eventType string, payload []byte) (int64, error) {
+	sqlStatement := `INSERT INTO webhook_deliveries (webhook_id, event_type, payload)
+		SELECT id, $1, $2 FROM webhooks WHERE (room_id=$3 OR room_id IS NULL) AND $1=ANY(events);`
+	res, err := db.db.Exec(sqlStatement, eventType, string(payload), roomId)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// claims up to limit deliveries that are due by pushing their next attempt back by lease,
+// so a crashed worker's deliveries are retried once the lease expires
+func (db *Database) claimWebhookDeliveries(limit int, lease time.Duration) ([]webhookDelivery, error) {
+	sqlStatement := `UPDATE webhook_deliveries SET next_attempt_at=NOW() + make_interval(secs => $2)
+		WHERE id IN (SELECT id FROM webhook_deliveries WHERE next_attempt_at<=NOW() ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED)
+		RETURNING id, webhook_id, event_type, payload, attempts;`
+	var deliveries []webhookDelivery
+	rows, err := db.db.Query(sqlStatement, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var delivery webhookDelivery
+		err = rows.Scan(&delivery.id, &delivery.webhookId, &delivery.eventType, &delivery.payload, &delivery.attempts)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (db *Database) completeWebhookDelivery(id int) error {
+	sqlStatement := `DELETE FROM webhook_deliveries WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
+	return err
+}
+
+// records a failed attempt and schedules the next one after backoff
+func (db *Database) retryWebhookDelivery(id int, attempts int, backoff time.Duration, lastError string) error {
+	sqlStatement := `UPDATE webhook_deliveries SET attempts=$1, next_attempt_at=NOW() + make_interval(secs => $2), last_error=$3 WHERE id=$4;`
+	_, err := db.db.Exec(sqlStatement, attempts, backoff.Seconds(), lastError, id)
+	return err
+}
+
+// moves a delivery that failed too many times to the dead letters
+func (db *Database) deadLetterWebhookDelivery(id int, attempts int, lastError string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO webhook_dead_letters (webhook_id, event_type, payload, attempts, last_error, created_at)
+		SELECT webhook_id, event_type, payload, $1, $2, created_at FROM webhook_deliveries WHERE id=$3;`, attempts, lastError, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM webhook_deliveries WHERE id=$1;`, id)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// bots get a password no bcrypt hash can match, so they can't use loginHandler.
+// sets the bot's id
+func (db *Database) addBot(bot *User, owner int) error {
+	sqlStatement := `INSERT INTO users (username, password, is_bot, bot_owner_id) VALUES ($1, '!', TRUE, $2) RETURNING id;`
+	row := db.db.QueryRow(sqlStatement, bot.username, owner)
+	return row.Scan(&bot.id)
+}
+
+// returns the id of the owner of a bot, BotNotFoundError if botId isn't a bot
+func (db *Database) getBotOwner(botId int) (int, error) {
+	sqlStatement := `SELECT bot_owner_id FROM users WHERE id=$1 AND is_bot=TRUE;`
+	var owner int
+	row := db.db.QueryRow(sqlStatement, botId)
+	err := row.Scan(&owner)
+	switch err {
+	case sql.ErrNoRows:
+		return 0, BotNotFoundError
+	default:
+		return owner, err
+	}
+}
+
+func (db *Database) getBots(owner int) ([]*User, error) {
+	sqlStatement := `SELECT id, username FROM users WHERE bot_owner_id=$1 AND is_bot=TRUE ORDER BY username;`
+	bots := []*User{}
+	rows, err := db.db.Query(sqlStatement, owner)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		var username string
+		err = rows.Scan(&id, &username)
+		if err != nil {
+			return nil, err
+		}
+		bot := newUser(id, username)
+		bot.bot = true
+		bots = append(bots, bot)
+	}
+	return bots, rows.Err()
+}
+
+func (db *Database) addBotToken(token *BotToken, hash string) error {
+	sqlStatement := `INSERT INTO bot_tokens (bot_id, token_hash, scopes) VALUES ($1, $2, $3) RETURNING id, created_at;`
+	row := db.db.QueryRow(sqlStatement, token.botId, hash, pq.Array(token.Scopes))
+	return row.Scan(&token.Id, &token.CreatedAt)
+}
+
+// returns the bot's tokens that were not revoked
+func (db *Database) getBotTokens(bot int) ([]BotToken, error) {
+	sqlStatement := `SELECT t.id, u.username, t.bot_id, t.scopes, t.created_at, t.last_used_at FROM bot_tokens t JOIN users u ON u.id=t.bot_id
+		WHERE t.bot_id=$1 AND t.revoked_at IS NULL ORDER BY t.id;`
+	tokens := []BotToken{}
+	rows, err := db.db.Query(sqlStatement, bot)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var token BotToken
+		var lastUsed sql.NullTime
+		err = rows.Scan(&token.Id, &token.Bot, &token.botId, pq.Array(&token.Scopes), &token.CreatedAt, &lastUsed)
+		if err != nil {
+			return nil, err
+		}
+		if lastUsed.Valid {
+			token.LastUsedAt = &lastUsed.Time
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+func (db *Database) revokeBotToken(bot int, id int) error {
+	sqlStatement := `UPDATE bot_tokens SET revoked_at=NOW() WHERE bot_id=$1 AND id=$2 AND revoked_at IS NULL;`
+	res, err := db.db.Exec(sqlStatement, bot, id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return BotTokenNotFoundError
+	}
+	return nil
+}
+
+// returns the bot id and scopes of an unrevoked token and records its use
+func (db *Database) useBotToken(hash string) (int, []string, error) {
+	sqlStatement := `UPDATE bot_tokens SET last_used_at=NOW() WHERE token_hash=$1 AND revoked_at IS NULL RETURNING bot_id, scopes;`
+	var bot int
+	var scopes []string
+	row := db.db.QueryRow(sqlStatement, hash)
+	err := row.Scan(&bot, pq.Array(&scopes))
+	switch err {
+	case sql.ErrNoRows:
+		return 0, nil, BotTokenNotFoundError
+	default:
+		return bot, scopes, err
+	}
+}
+
+// registers a command or updates its description. fails with false if another bot owns it
+func (db *Database) setBotCommand(command BotCommand) (bool, error) {
+	sqlStatement := `INSERT INTO bot_commands (command, bot_id, description) VALUES ($1, $2, $3)
+		ON CONFLICT (command) DO UPDATE SET description=EXCLUDED.description WHERE bot_commands.bot_id=EXCLUDED.bot_id;`
+	res, err := db.db.Exec(sqlStatement, command.Command, command.botId, command.Description)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *Database) deleteBotCommand(bot int, command string) error {
+	sqlStatement := `DELETE FROM bot_commands WHERE bot_id=$1 AND command=$2;`
+	_, err := db.db.Exec(sqlStatement, bot, command)
+	return err
+}
+
+func (db *Database) getBotCommand(command string) (BotCommand, error) {
+	sqlStatement := `SELECT c.command, u.username, c.bot_id, c.description FROM bot_commands c JOIN users u ON u.id=c.bot_id WHERE c.command=$1;`
+	var botCommand BotCommand
+	row := db.db.QueryRow(sqlStatement, command)
+	err := row.Scan(&botCommand.Command, &botCommand.Bot, &botCommand.botId, &botCommand.Description)
+	switch err {
+	case sql.ErrNoRows:
+		return botCommand, CommandNotFoundError
+	default:
+		return botCommand, err
+	}
+}
+
+func (db *Database) getBotCommands() ([]BotCommand, error) {
+	sqlStatement := `SELECT c.command, u.username, c.bot_id, c.description FROM bot_commands c JOIN users u ON u.id=c.bot_id ORDER BY c.command;`
+	var commands []BotCommand
+	rows, err := db.db.Query(sqlStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var command BotCommand
+		err = rows.Scan(&command.Command, &command.Bot, &command.botId, &command.Description)
+		if err != nil {
+			return nil, err
+		}
+		commands = append(commands, command)
+	}
+	return commands, rows.Err()
+}
+
+// stores the mentions of a message in one statement
+func (db *Database) addMentions(messageId int, mentions []Mention) error {
+	if len(mentions) == 0 {
+		return nil
+	}
+	userIds := make([]int64, len(mentions))
+	roomMentions := make([]bool, len(mentions))
+	for i, mention := range mentions {
+		userIds[i] = int64(mention.userId)
+		roomMentions[i] = mention.roomMention
+	}
+	sqlStatement := `INSERT INTO mentions (message_id, user_id, room_mention)
+		SELECT $1, user_id, room_mention FROM unnest($2::int[], $3::boolean[]) AS m(user_id, room_mention) ON CONFLICT DO NOTHING;`
+	_, err := db.db.Exec(sqlStatement, messageId, pq.Array(userIds), pq.Array(roomMentions))
+	return err
+}
+
+// returns the members of a room with their username and notification level
+func (db *Database) getNotificationTargets(roomId int) ([]notificationTarget, error) {
+	sqlStatement := `SELECT ru.user_id, u.username, ru.notification_level FROM room_users ru JOIN users u ON u.id=ru.user_id WHERE ru.room_id=$1;`
+	var targets []notificationTarget
+	rows, err := db.db.Query(sqlStatement, roomId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var target notificationTarget
+		err = rows.Scan(&target.userId, &target.username, &target.level)
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	return targets, rows.Err()
+}
+
+func (db *Database) setNotificationLevel(roomId int, userId int, level string) error {
+	sqlStatement := `UPDATE room_users SET notification_level=$1 WHERE room_id=$2 AND user_id=$3;`
+	res, err := db.db.Exec(sqlStatement, level, roomId, userId)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return NotRoomMemberError
+	}
+	return nil
+}
+
+// stores the notifications of one message in one statement, they differ only by user and kind.
+// sets their id and creation date
+func (db *Database) addNotifications(notifications []Notification) error {
+	if len(notifications) == 0 {
+		return nil
+	}
+	userIds := make([]int64, len(notifications))
+	kinds := make([]string, len(notifications))
+	byUser := make(map[int]*Notification, len(notifications))
+	for i := range notifications {
+		userIds[i] = int64(notifications[i].userId)
+		kinds[i] = notifications[i].Kind
+		byUser[notifications[i].userId] = &notifications[i]
+	}
+	first := notifications[0]
+	sqlStatement := `INSERT INTO notifications (user_id, kind, room_id, message_id, actor_id, preview)
+		SELECT user_id, kind, $3, $4, $5, $6 FROM unnest($1::int[], $2::text[]) AS n(user_id, kind) RETURNING id, user_id, created_at;`
+	rows, err := db.db.Query(sqlStatement, pq.Array(userIds), pq.Array(kinds), first.RoomId, first.MessageId, first.actorId, first.Preview)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, userId int
+		var createdAt time.Time
+		if err := rows.Scan(&id, &userId, &createdAt); err != nil {
+			return err
+		}
+		// the rows come back in no particular order
+		if notification, ok := byUser[userId]; ok {
+			notification.Id = id
+			notification.CreatedAt = createdAt
+		}
+	}
+	return rows.Err()
+}
+
+// returns up to limit notifications older than before, newest first. before <= 0 starts from the newest
+func (db *Database) getNotifications(userId int, before int, limit int, unreadOnly bool) ([]Notification, error) {
+	sqlStatement := `SELECT n.id, n.kind, n.room_id, n.message_id, actor.username, n.preview, n.created_at, n.read_at IS NOT NULL
+		FROM notifications n JOIN users actor ON actor.id=n.actor_id
+		WHERE n.user_id=$1 AND ($2<=0 OR n.id<$2) AND (NOT $3 OR n.read_at IS NULL) ORDER BY n.id DESC LIMIT $4;`
+	notifications := []Notification{}
+	rows, err := db.db.Query(sqlStatement, userId, before, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var notification Notification
+		err = rows.Scan(&notification.Id, &notification.Kind, &notification.RoomId, &notification.MessageId, &notification.Actor, &notification.Preview, &notification.CreatedAt, &notification.Read)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+	}
+	return notifications, rows.Err()
+}
+
+func (db *Database) countUnreadNotifications(userId int) (int, error) {
+	sqlStatement := `SELECT COUNT(*) FROM notifications WHERE user_id=$1 AND read_at IS NULL;`
+	var count int
+	row := db.db.QueryRow(sqlStatement, userId)
+	err := row.Scan(&count)
+	return count, err
+}
+
+// marks one of the user's notifications as read, or all of them when id is 0
+func (db *Database) markNotificationsRead(userId int, id int) error {
+	sqlStatement := `UPDATE notifications SET read_at=NOW() WHERE user_id=$1 AND ($2=0 OR id=$2) AND read_at IS NULL;`
+	_, err := db.db.Exec(sqlStatement, userId, id)
+	return err
+}
+
+// registers a device, or refreshes its keys when the user registered it already.
+// returns false when the endpoint belongs to another user
+func (db *Database) addPushSubscription(subscription PushSubscription) (bool, error) {
+	sqlStatement := `INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth, user_agent) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (endpoint) DO UPDATE SET p256dh=EXCLUDED.p256dh, auth=EXCLUDED.auth, user_agent=EXCLUDED.user_agent
+		WHERE push_subscriptions.user_id=EXCLUDED.user_id;`
+	res, err := db.db.Exec(sqlStatement, subscription.userId, subscription.Endpoint, subscription.Keys.P256dh, subscription.Keys.Auth, subscription.userAgent)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+func (db *Database) deletePushSubscription(userId int, endpoint string) error {
+	sqlStatement := `DELETE FROM push_subscriptions WHERE user_id=$1 AND endpoint=$2;`
+	_, err := db.db.Exec(sqlStatement, userId, endpoint)
+	return err
+}
+
+// removes a subscription the push service reported as expired
+func (db *Database) prunePushSubscription(id int) error {
+	sqlStatement := `DELETE FROM push_subscriptions WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
+	return err
+}
+
+func (db *Database) getPushSubscriptions(userId int) ([]PushSubscription, error) {
+	sqlStatement := `SELECT id, user_id, endpoint, p256dh, auth FROM push_subscriptions WHERE user_id=$1;`
+	var subscriptions []PushSubscription
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var subscription PushSubscription
+		err = rows.Scan(&subscription.id, &subscription.userId, &subscription.Endpoint, &subscription.Keys.P256dh, &subscription.Keys.Auth)
+		if err != nil {
+			return nil, err
+		}
+		subscriptions = append(subscriptions, subscription)
+	}
+	return subscriptions, rows.Err()
+}
+
+// sets the user's identity key, deleting their prekeys if it changed
+func (db *Database) setIdentityKey(userId int, identityKey string) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`DELETE FROM one_time_prekeys WHERE user_id=$1 AND EXISTS (SELECT 1 FROM identity_keys WHERE user_id=$1 AND identity_key<>$2);`, userId, identityKey)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO identity_keys (user_id, identity_key) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET identity_key=EXCLUDED.identity_key, updated_at=CURRENT_TIMESTAMP;`, userId, identityKey)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// fails with ErrNoIdentityKey if the user never published one
+func (db *Database) getIdentityKey(userId int) (string, error) {
+	sqlStatement := `SELECT identity_key FROM identity_keys WHERE user_id=$1;`
+	var identityKey string
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&identityKey)
+	if err == sql.ErrNoRows {
+		return "", ErrNoIdentityKey
+	}
+	return identityKey, err
+}
+
+// stores prekeys until the user has max of them, ignoring ids already used.
+// returns how many the user has
+func (db *Database) addPrekeys(userId int, prekeys []Prekey, max int) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// serialize uploads of the same user so the limit holds
+	_, err = tx.Exec(`SELECT 1 FROM identity_keys WHERE user_id=$1 FOR UPDATE;`, userId)
+	if err != nil {
+		return 0, err
+	}
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM one_time_prekeys WHERE user_id=$1;`, userId).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	for _, prekey := range prekeys {
+		if count >= max {
+			break
+		}
+		result, err := tx.Exec(`INSERT INTO one_time_prekeys (user_id, key_id, public_key) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING;`, userId, prekey.KeyId, prekey.PublicKey)
+		if err != nil {
+			return 0, err
+		}
+		if n, _ := result.RowsAffected(); n == 1 {
+			count++
+		}
+	}
+	return count, tx.Commit()
+}
+
+func (db *Database) countPrekeys(userId int) (int, error) {
+	sqlStatement := `SELECT COUNT(*) FROM one_time_prekeys WHERE user_id=$1;`
+	var count int
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&count)
+	return count, err
+}
+
+// removes and returns one of the user's prekeys, nil if they have none left
+func (db *Database) claimPrekey(userId int) (*Prekey, error) {
+	sqlStatement := `DELETE FROM one_time_prekeys WHERE (user_id, key_id) = (
+		SELECT user_id, key_id FROM one_time_prekeys WHERE user_id=$1 ORDER BY key_id LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING key_id, public_key;`
+	var prekey Prekey
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&prekey.KeyId, &prekey.PublicKey)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &prekey, nil
+}
+
+// turns end-to-end encryption on for a room, it can't be turned off
+func (db *Database) setRoomEncrypted(roomId int) error {
+	sqlStatement := `UPDATE rooms SET encrypted=TRUE WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, roomId)
+	return err
+}
+
+// sets the room's retention policy, nil to follow the server's default
+func (db *Database) setRoomRetention(roomId int, policy *RetentionPolicy) error {
+	sqlStatement := `UPDATE rooms SET retention_days=$1, retention_messages=$2 WHERE id=$3;`
+	var days, messages sql.NullInt64
+	if policy != nil {
+		days = sql.NullInt64{Int64: int64(policy.Days), Valid: true}
+		messages = sql.NullInt64{Int64: int64(policy.Messages), Valid: true}
+	}
+	_, err := db.db.Exec(sqlStatement, days, messages, roomId)
+	return err
+}
+
+// returns the ids of up to limit messages of the room sent before a time, oldest first
+func (db *Database) getExpiredMessages(roomId int, before time.Time, limit int) ([]int, error) {
+	sqlStatement := `SELECT id FROM messages WHERE room_id=$1 AND date_sent<$2 ORDER BY date_sent, id LIMIT $3;`
+	return db.queryIds(sqlStatement, roomId, before, limit)
+}
+
+// returns the ids of up to limit messages of the room that are not among the keep latest
+func (db *Database) getOverflowMessages(roomId int, keep int, limit int) ([]int, error) {
+	sqlStatement := `SELECT id FROM messages WHERE room_id=$1 ORDER BY date_sent DESC, id DESC OFFSET $2 LIMIT $3;`
+	return db.queryIds(sqlStatement, roomId, keep, limit)
+}
+
+// deletes messages, copying them to messages_archive first if archive is set.
+// returns the ids actually deleted
+func (db *Database) purgeMessages(ids []int, archive bool) ([]int, error) {
+	sqlStatement := `DELETE FROM messages WHERE id=ANY($1) RETURNING id;`
+	if archive {
+		sqlStatement = `WITH purged AS (DELETE FROM messages WHERE id=ANY($1) RETURNING *)
+			INSERT INTO messages_archive (id, message, author_id, date_sent, room_id, from_bot, envelope, format, html)
+			SELECT id, message, author_id, date_sent, room_id, from_bot, envelope, format, html FROM purged RETURNING id;`
+	}
+	return db.queryIds(sqlStatement, pq.Array(ids))
+}
+
+func (db *Database) queryIds(sqlStatement string, args ...any) ([]int, error) {
+	var ids []int
+	rows, err := db.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// calls fn with every message of the room, oldest first, and afterBatch after each batch.
+// messages are read through a server side cursor, batchSize at a time
+func (db *Database) streamMessages(ctx context.Context, roomId int, batchSize int, fn func(NewMessageEvent) error, afterBatch func() error) error {
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id WHERE m.room_id=$1 ORDER BY m.date_sent, m.id`
+	return db.streamMessageQuery(ctx, sqlStatement, roomId, batchSize, fn, afterBatch)
+}
+
+// streamMessages over every message written by the user, archived ones included
+func (db *Database) streamAuthoredMessages(ctx context.Context, userId int, batchSize int, fn func(NewMessageEvent) error, afterBatch func() error) error {
+	sqlStatement := `SELECT ` + messageColumns + ` FROM messages m JOIN users u ON u.id=m.author_id WHERE m.author_id=$1
+		UNION ALL SELECT ` + messageColumns + ` FROM messages_archive m JOIN users u ON u.id=m.author_id WHERE m.author_id=$1
+		ORDER BY date_sent, id`
+	return db.streamMessageQuery(ctx, sqlStatement, userId, batchSize, fn, afterBatch)
+}
+
+// runs a query selecting messages through a cursor
+func (db *Database) streamMessageQuery(ctx context.Context, query string, arg any, batchSize int, fn func(NewMessageEvent) error, afterBatch func() error) error {
+	tx, err := db.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DECLARE export_cursor NO SCROLL CURSOR FOR `+query+`;`, arg)
+	if err != nil {
+		return err
+	}
+	fetch := fmt.Sprintf(`FETCH FORWARD %d FROM export_cursor;`, batchSize)
+	for {
+		rows, err := tx.QueryContext(ctx, fetch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			message, err := scanMessage(rows.Scan)
+			if err == nil {
+				err = fn(message)
+			}
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			n++
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		if err := afterBatch(); err != nil {
+			return err
+		}
+		if n < batchSize {
+			return nil
+		}
+	}
+}
+
+func (db *Database) getAccountProfile(userId int) (AccountProfile, error) {
+	sqlStatement := `SELECT users.id, users.username, users.display_name, users.avatar, users.bio, users.status_text, users.direct_room_privacy, users.presence_privacy, users.is_admin, users.is_bot, COALESCE(owners.username, ''), users.totp_enabled, COALESCE(identity_key, '')
+		FROM users LEFT JOIN users owners ON owners.id=users.bot_owner_id LEFT JOIN identity_keys ON identity_keys.user_id=users.id WHERE users.id=$1;`
+	var profile AccountProfile
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&profile.Id, &profile.Username, &profile.DisplayName, &profile.Avatar, &profile.Bio, &profile.StatusText, &profile.Privacy.DirectRooms, &profile.Privacy.Presence, &profile.IsAdmin, &profile.IsBot, &profile.BotOwner, &profile.TOTPEnabled, &profile.IdentityKey)
+	if err == sql.ErrNoRows {
+		return profile, UserNotFoundError
+	}
+	if err != nil {
+		return profile, err
+	}
+
+	profile.BlockedUsers, err = db.getBlockedUsernames(userId)
+	if err != nil {
+		return profile, err
+	}
+	profile.Contacts, err = db.getContacts(userId)
+	if err != nil {
+		return profile, err
+	}
+	profile.Bots, err = db.queryUsernames(`SELECT username FROM users WHERE bot_owner_id=$1 AND is_bot=TRUE ORDER BY username;`, userId)
+	return profile, err
+}
+
+func (db *Database) getRoomMemberships(userId int) ([]RoomMembership, error) {
+	sqlStatement := `SELECT room_id, role, notification_level, muted_until FROM room_users WHERE user_id=$1 ORDER BY room_id;`
+	memberships := []RoomMembership{}
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var membership RoomMembership
+		var mutedUntil sql.NullTime
+		err = rows.Scan(&membership.RoomId, &membership.Role, &membership.NotificationLevel, &mutedUntil)
+		if err != nil {
+			return nil, err
+		}
+		if mutedUntil.Valid {
+			membership.MutedUntil = &mutedUntil.Time
+		}
+		memberships = append(memberships, membership)
+	}
+	return memberships, rows.Err()
+}
+
+func (db *Database) getPushDevices(userId int) ([]PushDevice, error) {
+	sqlStatement := `SELECT endpoint, user_agent, created_at FROM push_subscriptions WHERE user_id=$1 ORDER BY id;`
+	devices := []PushDevice{}
+	rows, err := db.db.Query(sqlStatement, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var device PushDevice
+		if err := rows.Scan(&device.Endpoint, &device.UserAgent, &device.CreatedAt); err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// requeues the exports and erasures that were running when the server stopped
+func (db *Database) resetInterruptedPrivacyJobs() error {
+	_, err := db.db.Exec(`UPDATE data_exports SET status=$1 WHERE status=$2;`, ExportPending, ExportRunning)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec(`UPDATE account_erasures SET started_at=NULL WHERE completed_at IS NULL;`)
+	return err
+}
+
+func (db *Database) addDataExport(userId int) (*DataExport, error) {
+	sqlStatement := `INSERT INTO data_exports (user_id) VALUES ($1) RETURNING id, status, created_at;`
+	export := &DataExport{userId: userId}
+	err := db.db.QueryRow(sqlStatement, userId).Scan(&export.Id, &export.Status, &export.CreatedAt)
+	return export, err
+}
+
+const dataExportColumns = `id, user_id, status, file, error, created_at, completed_at`
+
+func scanDataExport(row *sql.Row) (*DataExport, error) {
+	var export DataExport
+	var completedAt sql.NullTime
+	err := row.Scan(&export.Id, &export.userId, &export.Status, &export.file, &export.Error, &export.CreatedAt, &completedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if completedAt.Valid {
+		export.CompletedAt = &completedAt.Time
+	}
+	return &export, nil
+}
+
+// returns the user's most recent export, nil if they never asked for one
+func (db *Database) getLatestDataExport(userId int) (*DataExport, error) {
+	sqlStatement := `SELECT ` + dataExportColumns + ` FROM data_exports WHERE user_id=$1 ORDER BY id DESC LIMIT 1;`
+	return scanDataExport(db.db.QueryRow(sqlStatement, userId))
+}
+
+// nil if the export doesn't exist or isn't the user's
+func (db *Database) getDataExport(id int, userId int) (*DataExport, error) {
+	sqlStatement := `SELECT ` + dataExportColumns + ` FROM data_exports WHERE id=$1 AND user_id=$2;`
+	return scanDataExport(db.db.QueryRow(sqlStatement, id, userId))
+}
+
+// marks the oldest pending export as running and returns it, nil if none is pending
+func (db *Database) claimDataExport() (*DataExport, error) {
+	sqlStatement := `UPDATE data_exports SET status=$1 WHERE id=(
+		SELECT id FROM data_exports WHERE status=$2 ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING ` + dataExportColumns + `;`
+	return scanDataExport(db.db.QueryRow(sqlStatement, ExportRunning, ExportPending))
+}
+
+func (db *Database) completeDataExport(id int, file string) error {
+	sqlStatement := `UPDATE data_exports SET status=$1, file=$2, completed_at=CURRENT_TIMESTAMP WHERE id=$3;`
+	_, err := db.db.Exec(sqlStatement, ExportReady, file, id)
+	return err
+}
+
+func (db *Database) failDataExport(id int, lastError string) error {
+	sqlStatement := `UPDATE data_exports SET status=$1, error=$2, completed_at=CURRENT_TIMESTAMP WHERE id=$3;`
+	_, err := db.db.Exec(sqlStatement, ExportFailed, lastError, id)
+	return err
+}
+
+// deletes the exports completed more than ttl ago, returns the files to remove
+func (db *Database) deleteExpiredDataExports(ttl time.Duration) ([]string, error) {
+	sqlStatement := `DELETE FROM data_exports WHERE completed_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second' RETURNING file;`
+	return db.queryFiles(sqlStatement, int64(ttl.Seconds()))
+}
+
+func (db *Database) queryFiles(sqlStatement string, args ...any) ([]string, error) {
+	var files []string
+	rows, err := db.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, rows.Err()
+}
+
+// queues the erasure of the account, unless one is already queued
+func (db *Database) addAccountErasure(userId int) error {
+	sqlStatement := `INSERT INTO account_erasures (user_id) SELECT $1
+		WHERE NOT EXISTS (SELECT 1 FROM account_erasures WHERE user_id=$1 AND completed_at IS NULL);`
+	_, err := db.db.Exec(sqlStatement, userId)
+	return err
+}
+
+// marks the oldest queued erasure as started and returns it, id 0 if none is queued
+func (db *Database) claimAccountErasure() (int, int, error) {
+	sqlStatement := `UPDATE account_erasures SET started_at=CURRENT_TIMESTAMP WHERE id=(
+		SELECT id FROM account_erasures WHERE started_at IS NULL AND completed_at IS NULL ORDER BY id LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING id, user_id;`
+	var id, userId int
+	err := db.db.QueryRow(sqlStatement).Scan(&id, &userId)
+	if err == sql.ErrNoRows {
+		return 0, 0, nil
+	}
+	return id, userId, err
+}
+
+func (db *Database) releaseAccountErasure(id int) error {
+	sqlStatement := `UPDATE account_erasures SET started_at=NULL WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
+	return err
+}
+
+// the user id is forgotten too, only the fact an erasure happened is kept
+func (db *Database) completeAccountErasure(id int) error {
+	sqlStatement := `UPDATE account_erasures SET user_id=NULL, completed_at=CURRENT_TIMESTAMP WHERE id=$1;`
+	_, err := db.db.Exec(sqlStatement, id)
+	return err
+}
+
+// deletes the user and everything referring to them, except what they wrote or did
+// in rooms, which is handed over to tombstone. returns the data export files to remove
+func (db *Database) eraseUser(userId int, tombstone int) ([]string, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	for _, sqlStatement := range []string{
+		`UPDATE messages SET author_id=$2 WHERE author_id=$1;`,
+		`UPDATE messages_archive SET author_id=$2 WHERE author_id=$1;`,
+		`UPDATE pinned_messages SET pinned_by=$2 WHERE pinned_by=$1;`,
+		`UPDATE room_invites SET created_by=$2 WHERE created_by=$1;`,
+		`UPDATE notifications SET actor_id=$2 WHERE actor_id=$1;`,
+		`UPDATE webhooks SET created_by=$2 WHERE created_by=$1;`,
+	} {
+		if _, err := tx.Exec(sqlStatement, userId, tombstone); err != nil {
+			return nil, err
+		}
+	}
+	for _, sqlStatement := range []string{
+		`DELETE FROM notifications WHERE user_id=$1;`,
+		`DELETE FROM mentions WHERE user_id=$1;`,
+		`DELETE FROM room_users WHERE user_id=$1;`,
+		`DELETE FROM user_blocks WHERE blocker=$1 OR blocked=$1;`,
+		`DELETE FROM contacts WHERE user_id=$1 OR contact_id=$1;`,
+		`DELETE FROM scheduled_messages WHERE author_id=$1;`,
+		`DELETE FROM saved_messages WHERE user_id=$1;`,
+		`DELETE FROM recovery_codes WHERE user_id=$1;`,
+		`DELETE FROM push_subscriptions WHERE user_id=$1;`,
+		`DELETE FROM one_time_prekeys WHERE user_id=$1;`,
+		`DELETE FROM identity_keys WHERE user_id=$1;`,
+		`DELETE FROM bot_tokens WHERE bot_id=$1;`,
+		`DELETE FROM bot_commands WHERE bot_id=$1;`,
+	} {
+		if _, err := tx.Exec(sqlStatement, userId); err != nil {
+			return nil, err
+		}
+	}
+
+	var files []string
+	rows, err := tx.Query(`DELETE FROM data_exports WHERE user_id=$1 RETURNING file;`, userId)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var file string
+		if err := rows.Scan(&file); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM users WHERE id=$1;`, userId); err != nil {
+		return nil, err
+	}
+	return files, tx.Commit()
+}
+
+// columns of a scheduled message, selected FROM scheduled_messages
+const scheduledMessageColumns = `id, room_id, author_id, message, envelope, format, send_at, status, error, created_at`
+
+// scans a row selecting scheduledMessageColumns
+func scanScheduledMessage(scan func(dest ...any) error) (ScheduledMessage, error) {
+	var message ScheduledMessage
+	var envelope sql.NullString
+	err := scan(&message.Id, &message.RoomId, &message.authorId, &message.Message, &envelope, &message.Format, &message.SendAt, &message.Status, &message.Error, &message.CreatedAt)
+	if err != nil || !envelope.Valid {
+		return message, err
+	}
+	message.Encrypted = true
+	message.Envelope = &EncryptedEnvelope{}
+	return message, json.Unmarshal([]byte(envelope.String), message.Envelope)
+}
+
+func (db *Database) queryScheduledMessages(sqlStatement string, args ...any) ([]ScheduledMessage, error) {
+	rows, err := db.db.Query(sqlStatement, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	messages := []ScheduledMessage{}
+	for rows.Next() {
+		message, err := scanScheduledMessage(rows.Scan)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+func (db *Database) addScheduledMessage(message *ScheduledMessage) error {
+	sqlStatement := `INSERT INTO scheduled_messages (room_id, author_id, message, envelope, format, send_at) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, status, created_at;`
+	var envelope sql.NullString
+	if message.Envelope != nil {
+		data, err := json.Marshal(message.Envelope)
+		if err != nil {
+			return err
+		}
+		envelope = sql.NullString{String: string(data), Valid: true}
+	}
+	row := db.db.QueryRow(sqlStatement, message.RoomId, message.authorId, message.Message, envelope, message.Format, message.SendAt.UTC())
+	return row.Scan(&message.Id, &message.Status, &message.CreatedAt)
+}
+
+// counts the messages the user scheduled that were not posted yet
+func (db *Database) countScheduledMessages(userId int) (int, error) {
+	sqlStatement := `SELECT COUNT(*) FROM scheduled_messages WHERE author_id=$1 AND status<>$2;`
+	var count int
+	err := db.db.QueryRow(sqlStatement, userId, ScheduledFailed).Scan(&count)
+	return count, err
+}
+
+// returns the messages scheduled by the user in the room, in every room when roomId is 0. the next one first
+func (db *Database) getScheduledMessages(userId int, roomId int) ([]ScheduledMessage, error) {
+	sqlStatement := `SELECT ` + scheduledMessageColumns + ` FROM scheduled_messages WHERE author_id=$1 AND ($2=0 OR room_id=$2) ORDER BY send_at, id;`
+	return db.queryScheduledMessages(sqlStatement, userId, roomId)
+}
+
+// deletes a message scheduled by the user unless it is being posted. fails with false if there is none
+func (db *Database) deleteScheduledMessage(id int, userId int) (bool, error) {
+	sqlStatement := `DELETE FROM scheduled_messages WHERE id=$1 AND author_id=$2 AND status<>$3;`
+	res, err := db.db.Exec(sqlStatement, id, userId, ScheduledSending)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// claims up to limit messages due at now, they are posted by whoever claimed them
+func (db *Database) claimScheduledMessages(now time.Time, limit int) ([]ScheduledMessage, error) {
+	sqlStatement := `UPDATE scheduled_messages SET status=$1
+		WHERE id IN (SELECT id FROM scheduled_messages WHERE status=$2 AND send_at<=$3 ORDER BY send_at, id LIMIT $4 FOR UPDATE SKIP LOCKED)
+		RETURNING ` + scheduledMessageColumns + `;`
+	return db.queryScheduledMessages(sqlStatement, ScheduledSending, ScheduledPending, now.UTC(), limit)
+}
+
+// keeps a scheduled message that couldn't be posted, so its author can see why
+func (db *Database) failScheduledMessage(id int, reason string) error {
+	_, err := db.db.Exec(`UPDATE scheduled_messages SET status=$1, error=$2 WHERE id=$3;`, ScheduledFailed, reason, id)
+	return err
+}
+
+// requeues the messages that were being posted when the server stopped. a message
+// that was stored is already gone, addMessage deletes it with the insert
+func (db *Database) resetInterruptedScheduledMessages() error {
+	_, err := db.db.Exec(`UPDATE scheduled_messages SET status=$1 WHERE status=$2;`, ScheduledPending, ScheduledSending)
+	return err
+}
+
+// returns when the next pending message is due, false if there is none
+func (db *Database) getNextScheduledAt() (time.Time, bool, error) {
+	var sendAt sql.NullTime
+	err := db.db.QueryRow(`SELECT MIN(send_at) FROM scheduled_messages WHERE status=$1;`, ScheduledPending).Scan(&sendAt)
+	return sendAt.Time, sendAt.Valid, err
+}
+
+// returns the preview of the link cached less than ttl ago, false when it has to be fetched.
+// links that couldn't be previewed are cached without a title
+func (db *Database) getLinkPreview(url string, ttl time.Duration) (LinkPreview, bool, error) {
+	sqlStatement := `SELECT url, title, description, site_name, image FROM link_previews
+		WHERE url=$1 AND fetched_at > NOW() - make_interval(secs => $2::float8);`
+	var preview LinkPreview
+	err := db.db.QueryRow(sqlStatement, url, ttl.Seconds()).Scan(&preview.URL, &preview.Title, &preview.Description, &preview.SiteName, &preview.Image)
+	if err == sql.ErrNoRows {
+		return preview, false, nil
+	}
+	return preview, err == nil, err
+}
+
+func (db *Database) setLinkPreview(preview LinkPreview) error {
+	sqlStatement := `INSERT INTO link_previews (url, title, description, site_name, image) VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (url) DO UPDATE SET title=EXCLUDED.title, description=EXCLUDED.description,
+		site_name=EXCLUDED.site_name, image=EXCLUDED.image, fetched_at=NOW();`
+	_, err := db.db.Exec(sqlStatement, preview.URL, preview.Title, preview.Description, preview.SiteName, preview.Image)
+	return err
+}
+
+// removes the cached previews fetched more than ttl ago
+func (db *Database) pruneLinkPreviews(ttl time.Duration) error {
+	sqlStatement := `DELETE FROM link_previews WHERE fetched_at <= NOW() - make_interval(secs => $1::float8);`
+	_, err := db.db.Exec(sqlStatement, ttl.Seconds())
+	return err
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+const (
+	// longest base64 encoded public key accepted
+	maxPublicKeyLength = 255
+
+	// one-time prekeys accepted in one upload, and stored per user
+	maxPrekeysPerUpload = 100
+	maxStoredPrekeys = 500
+
+	// largest base64 encoded ciphertext of a message
+	maxCiphertextLength = 64 << 10
+)
+
+var (
+	ErrEncryptionRequired = errors.New("messages in this room must be end-to-end encrypted")
+	ErrRoomNotEncrypted = errors.New("this room is not end-to-end encrypted")
+	ErrNoIdentityKey = errors.New("user has not published an identity key")
+)
+
+// ciphertext of an end-to-end encrypted message and what the recipient needs to decrypt it.
+// the server stores and relays it as is, it never looks inside
+type EncryptedEnvelope struct {
+	// scheme used by the clients, e.g. "x3dh-aes256gcm"
+	Algorithm string `json:"algorithm"`
+	// sender's identity key
+	SenderKey string `json:"sender_key"`
+	// sender's ephemeral key and the recipient's one-time prekey used, when starting a session
+	EphemeralKey string `json:"ephemeral_key,omitempty"`
+	PrekeyId *int `json:"prekey_id,omitempty"`
+	Ciphertext string `json:"ciphertext"`
+}
+
+// a public one-time prekey, used once to start a session with its owner
+type Prekey struct {
+	KeyId int `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// what a client needs to start an encrypted session with a user
+type KeyBundle struct {
+	Username string `json:"username"`
+	IdentityKey string `json:"identity_key"`
+	// nil once the user ran out of prekeys
+	Prekey *Prekey `json:"prekey"`
+}
+
+// checks the envelope of a message posted in an encrypted room, without decrypting anything
+func (e *EncryptedEnvelope) validate() error {
+	if e == nil || e.Ciphertext == "" {
+		return errors.New("encrypted message without ciphertext")
+	}
+	if len(e.Ciphertext) > maxCiphertextLength {
+		return fmt.Errorf("ciphertext is longer than %d characters", maxCiphertextLength)
+	}
+	if len(e.Algorithm) > 64 || len(e.SenderKey) > maxPublicKeyLength || len(e.EphemeralKey) > maxPublicKeyLength {
+		return errors.New("bad envelope")
+	}
+	return nil
+}
+
+// keys are opaque to the server, they only have to look like base64 encoded keys
+func validPublicKey(key string) bool {
+	if key == "" || len(key) > maxPublicKeyLength {
+		return false
+	}
+	if _, err := base64.StdEncoding.DecodeString(key); err == nil {
+		return true
+	}
+	_, err := base64.RawURLEncoding.DecodeString(key)
+	return err == nil
+}
+
+// checks the users of an encrypted room can start a session with each other
+func requireIdentityKeys(h *Hub, users ...*User) error {
+	for _, user := range users {
+		if _, err := h.db.getIdentityKey(user.id); err != nil {
+			if errors.Is(err, ErrNoIdentityKey) {
+				return fmt.Errorf("%s has not published an identity key", user.username)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// encrypted rooms only take ciphertext, which is relayed untouched.
+// drops the part of the message that doesn't match the room
+func (r *Room) checkEncryption(message *SendMessageEvent) error {
+	var encrypted bool
+	r.apply(func(r *Room) {
+		encrypted = r.encrypted
+	})
+	if encrypted && !message.Encrypted {
+		return ErrEncryptionRequired
+	}
+	if !encrypted && message.Encrypted {
+		return ErrRoomNotEncrypted
+	}
+	if message.Encrypted {
+		if err := message.Envelope.validate(); err != nil {
+			return err
+		}
+		message.Message = ""
+	} else {
+		message.Envelope = nil
+	}
+	return nil
+}
+
+// fills the message's envelope from its stored JSON
+func decodeEnvelope(raw sql.NullString, message *NewMessageEvent) error {
+	if !raw.Valid {
+		return nil
+	}
+	message.Encrypted = true
+	message.Envelope = &EncryptedEnvelope{}
+	return json.Unmarshal([]byte(raw.String), message.Envelope)
+}
+
+// publishes the authenticated user's identity key and adds one-time prekeys.
+// changing the identity key discards the prekeys published with the previous one
+func (h *Hub) publishKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type publishKeysRequest struct {
+		IdentityKey string `json:"identity_key"`
+		Prekeys []Prekey `json:"prekeys"`
+	}
+
+	var req publishKeysRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validPublicKey(req.IdentityKey) {
+		http.Error(w, "identity_key must be a base64 encoded public key", http.StatusBadRequest)
+		return
+	}
+	if len(req.Prekeys) > maxPrekeysPerUpload {
+		http.Error(w, fmt.Sprintf("at most %d prekeys can be uploaded at once", maxPrekeysPerUpload), http.StatusBadRequest)
+		return
+	}
+	for _, prekey := range req.Prekeys {
+		if !validPublicKey(prekey.PublicKey) {
+			http.Error(w, fmt.Sprintf("prekey %d is not a base64 encoded public key", prekey.KeyId), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := h.db.setIdentityKey(userId, req.IdentityKey); err != nil {
+		http.Error(w, "Error storing identity key", http.StatusInternalServerError)
+		return
+	}
+	remaining, err := h.db.addPrekeys(userId, req.Prekeys, maxStoredPrekeys)
+	if err != nil {
+		http.Error(w, "Error storing prekeys", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		PrekeysRemaining int `json:"prekeys_remaining"`
+	}
+	writeJSON(w, http.StatusOK, response{PrekeysRemaining: remaining})
+}
+
+// returns the authenticated user's identity key and how many prekeys are left, so clients know when to upload more
+func (h *Hub) getOwnKeysHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	identityKey, err := h.db.getIdentityKey(userId)
+	if err != nil && !errors.Is(err, ErrNoIdentityKey) {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+	remaining, err := h.db.countPrekeys(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		IdentityKey string `json:"identity_key"`
+		PrekeysRemaining int `json:"prekeys_remaining"`
+	}
+	writeJSON(w, http.StatusOK, response{IdentityKey: identityKey, PrekeysRemaining: remaining})
+}
+
+// returns a user's key bundle, handing out one of their one-time prekeys
+func (h *Hub) getKeyBundleHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	target, err := h.db.getUserByUsername(r.PathValue("username"))
+	if errors.Is(err, UserNotFoundError) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+	blocked, err := h.db.isBlockedEitherWay(userId, target.id)
+	if err != nil {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+	if blocked {
+		http.Error(w, ErrUserBlocked.Error(), http.StatusForbidden)
+		return
+	}
+
+	identityKey, err := h.db.getIdentityKey(target.id)
+	if errors.Is(err, ErrNoIdentityKey) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+	prekey, err := h.db.claimPrekey(target.id)
+	if err != nil {
+		http.Error(w, "Error retrieving keys", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, KeyBundle{Username: target.username, IdentityKey: identityKey, Prekey: prekey})
+}
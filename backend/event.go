@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"errors"
+	"strings"
 	"time"
 	"encoding/json"
 )
@@ -15,7 +16,9 @@ type Event struct {
 
 // A User in a Room
 type RoomUser struct {
+	Id       int    `json:"id"`
 	Username string `json:"username"`
+	DisplayName string `json:"display_name"`
 	Online   bool   `json:"online"`
 	Typing   bool	`json:"typing"`
 }
@@ -46,30 +49,84 @@ const (
 	EventUserConnected = "user_connected"
 	// user disconnection
 	EventUserDisconnected = "user_disconnected"
+	// change a room's name, topic, description, avatar or visibility
+	EventUpdateRoom = "update_room"
+	// response to update_room, sent to every member
+	EventRoomUpdated = "room_updated"
+	// announcement of something that happened in a room, e.g. a moderation action
+	EventSystemMessage = "system_message"
 )
 
+const (
+	maxRoomNameLength = 255
+	maxRoomTopicLength = 255
+	maxRoomDescriptionLength = 4096
+	maxRoomAvatarLength = 1024
+)
+
+var (
+	ErrNotRoomAdmin = errors.New("only room admins can do this")
+)
+
+// converts a role to a rank so roles can be compared: owner > admin > member
+func roleRank(role string) int {
+	switch role {
+	case RoleOwner:
+		return 2
+	case RoleAdmin:
+		return 1
+	default:
+		return 0
+	}
+}
+
 type SendMessageEvent struct {
 	Message string `json:"message"`
 	From 	string `json:"from"`
 	RoomId  int    `json:"room_id"`
+	// end-to-end encrypted, message is empty and the content is in the envelope
+	Encrypted bool `json:"encrypted,omitempty"`
+	Envelope *EncryptedEnvelope `json:"envelope,omitempty"`
+	// plain or markdown, plain when empty
+	Format string `json:"format,omitempty"`
+
+	// the scheduled message being posted, 0 for messages posted right away
+	scheduledId int
 }
 
 // returned when responding to send_message or get_messages
 type NewMessageEvent struct {
+	Id int `json:"id"`
 	SendMessageEvent
+	// id of the author, From is their username when the message is read
+	FromId int `json:"from_id"`
+	// author's display name, empty when they have none
+	FromDisplayName string `json:"from_display_name"`
 	Sent time.Time `json:"sent"`
+	// sent by a bot account
+	Bot bool `json:"bot,omitempty"`
+	// sanitized rendering of markdown messages, clients show it instead of the message
+	HTML string `json:"html,omitempty"`
 }
 
 // returned when responding to get_rooms
 type NewRoomEvent struct {
 	Id int `json:"id"`
 	Name string `json:"name"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	Avatar string `json:"avatar"`
+	Encrypted bool `json:"encrypted"`
+	Visibility string `json:"visibility"`
+	Retention RetentionPolicy `json:"retention"`
 	Users []RoomUser `json:"users"`
 	LastMessage NewMessageEvent `json:"last_message"`
 }
 
 type CreateRoomEvent struct {
 	Username string `json:"username"`
+	// turn end-to-end encryption on, both users must have published their keys
+	Encrypted bool `json:"encrypted"`
 }
 
 type GetMessagesEvent struct {
@@ -84,27 +141,125 @@ type UserDisconnectedEvent struct {
 	Username string `json:"username"`
 }
 
+// fields left out are not changed
+type UpdateRoomEvent struct {
+	RoomId int `json:"room_id"`
+	Name *string `json:"name"`
+	Topic *string `json:"topic"`
+	Description *string `json:"description"`
+	Avatar *string `json:"avatar"`
+	// only group rooms can be public
+	Visibility *string `json:"visibility"`
+}
+
+// sent to a room's members by the server itself
+type SystemMessageEvent struct {
+	RoomId int `json:"room_id"`
+	// what happened, e.g. "kick" or "mute"
+	Action string `json:"action"`
+	// who did it
+	Actor string `json:"actor,omitempty"`
+	// who it was done to
+	Target string `json:"target,omitempty"`
+	MessageId int `json:"message_id,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// human readable description
+	Message string `json:"message"`
+	Sent time.Time `json:"sent"`
+}
+
+type RoomUpdatedEvent struct {
+	RoomId int `json:"room_id"`
+	Name string `json:"name"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	Avatar string `json:"avatar"`
+	Visibility string `json:"visibility"`
+	UpdatedBy string `json:"updated_by"`
+}
+
 func SendMessageHandler(event Event, c *Client) error {
 	var chatevent SendMessageEvent
 	if err := json.Unmarshal(event.Payload, &chatevent); err != nil {
 		return fmt.Errorf("bad payload in request: %v", err)
 	}
+	if err := c.checkMessageFeatures(chatevent); err != nil {
+		return err
+	}
+
+	// commands are run instead of being posted
+	if handled, err := c.hub.runCommand(c, chatevent); handled || err != nil {
+		return err
+	}
+
+	_, err := c.hub.postMessage(c.user, chatevent)
+	return err
+}
 
+// stores a message from user in a room, broadcasts it to the room's members and queues it for webhooks.
+// every way of posting a message goes through here
+func (h *Hub) postMessage(user *User, message SendMessageEvent) (NewMessageEvent, error) {
 	var broadMessage NewMessageEvent
+	roomId := message.RoomId
 
-	broadMessage.Sent = time.Now()
-	broadMessage.Message = chatevent.Message
-	broadMessage.From = c.user.username
-	broadMessage.RoomId = chatevent.RoomId
+	room, ok := h.getRoom(roomId)
+	if !ok {
+		return broadMessage, fmt.Errorf("error retrieving room by id: %v", roomId)
+	}
 
-	data, err := json.Marshal(broadMessage)
+	if err := room.checkEncryption(&message); err != nil {
+		return broadMessage, err
+	}
+	html, err := renderMessage(&message)
 	if err != nil {
-		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+		return broadMessage, err
 	}
 
-	err = c.hub.db.addMessage(broadMessage, chatevent.RoomId)
+	// only members that are not muted can post
+	mutedUntil, err := h.db.getMutedUntil(roomId, user.id)
 	if err != nil {
-		return err
+		return broadMessage, err
+	}
+	if time.Now().Before(mutedUntil) {
+		return broadMessage, fmt.Errorf("you are muted in this room until %s", mutedUntil.Format(time.RFC3339))
+	}
+
+	// nothing goes through a direct room once one side blocked the other
+	if room.capacity == 2 {
+		// the members are read on the room's goroutine, postMessage also runs on the scheduler's
+		for _, member := range room.describeTo(user.id, nil).Users {
+			blocked, err := h.db.isBlockedEitherWay(user.id, member.Id)
+			if err != nil {
+				return broadMessage, err
+			}
+			if blocked {
+				return broadMessage, ErrUserBlocked
+			}
+		}
+	}
+
+	broadMessage.Sent = time.Now()
+	broadMessage.Message = message.Message
+	broadMessage.From = user.username
+	broadMessage.FromId = user.id
+	broadMessage.FromDisplayName = user.displayName
+	broadMessage.RoomId = roomId
+	broadMessage.Encrypted = message.Encrypted
+	broadMessage.Envelope = message.Envelope
+	broadMessage.Format = message.Format
+	broadMessage.HTML = html
+	broadMessage.Bot = user.bot
+	broadMessage.scheduledId = message.scheduledId
+
+	id, err := h.db.addMessage(broadMessage, roomId)
+	if err != nil {
+		return broadMessage, err
+	}
+	broadMessage.Id = id
+
+	data, err := json.Marshal(broadMessage)
+	if err != nil {
+		return broadMessage, fmt.Errorf("failed to marshal broadcast message: %v", err)
 	}
 
 	// place payload in an event
@@ -112,19 +267,19 @@ func SendMessageHandler(event Event, c *Client) error {
 	outgoingEvent.Payload = data
 	outgoingEvent.Type = EventNewMessage
 
-	room, ok := c.hub.rooms[broadMessage.RoomId]
-	if !ok {
-		fmt.Errorf("error retrieving room by id: %v", err)
-	}
-
-	room.lastMessage = broadMessage
+	room.setLastMessage(broadMessage)
 	room.broadcast <- outgoingEvent
+	h.webhooks.enqueue(room.id, EventNewMessage, broadMessage)
+	h.notifier.enqueue(room, broadMessage)
+	if h.unfurler != nil {
+		h.unfurler.enqueue(room, broadMessage)
+	}
 
-	return nil
+	return broadMessage, nil
 }
 
 func DisconnectClientHandler(event Event, c *Client) error {
-	c.hub.removeClient(c)
+	c.hub.unregister <- c
 	if c.user.online == false {
 		// broadcast change
 	}
@@ -136,6 +291,10 @@ func GetMessagesHandler(event Event, c *Client) error {
 	if err := json.Unmarshal(event.Payload, &e); err != nil {
 		return fmt.Errorf("bad payload in request: %v", err)
 	}
+	// only members read the history, public rooms are previewed with preview_room
+	if _, err := c.hub.db.getRoomRole(e.RoomId, c.user.id); err != nil {
+		return err
+	}
 	events, err := c.hub.db.getMessages(e.RoomId)
 	if err != nil {
 		return err
@@ -157,28 +316,21 @@ func GetMessagesHandler(event Event, c *Client) error {
 }
 
 func GetRoomsHandler(event Event, c *Client) error {
-	roomIds, err := c.hub.db.getRooms(c.user.username)
+	roomIds, err := c.hub.db.getRooms(c.user.id)
+	if err != nil {
+		return err
+	}
+	// users that blocked us or hide their presence from us appear offline
+	hidden, err := c.hub.db.getPresenceHiddenTo(c.user.id)
 	if err != nil {
 		return err
 	}
 	for i := range roomIds {
-		room := c.hub.rooms[roomIds[i]]
-		roomName := room.name
-		var roomUsers []RoomUser
-		if roomName == "" {
-			users := c.hub.rooms[roomIds[i]].users
-			for username := range users {
-				if (username != c.user.username) {
-					user := RoomUser{Username: username, Online: len(c.hub.clients[username]) > 1, Typing: false}
-					roomName += username
-					roomName += ", ";
-					roomUsers = append(roomUsers, user)
-				}
-			}
-			roomName = roomName[:len(roomName) - 2];
+		room, ok := c.hub.getRoom(roomIds[i])
+		if !ok {
+			continue
 		}
-		lastMessage := c.hub.db.getLastRoomMessage(roomIds[i])
-		event := NewRoomEvent{Id: roomIds[i], Name: roomName, Users: roomUsers, LastMessage: lastMessage}
+		event := room.describeTo(c.user.id, hidden)
 		data, err := json.Marshal(event)
 		if err != nil {
 			return fmt.Errorf("failed to marshal broadcast message: %v", err)
@@ -196,54 +348,100 @@ func GetRoomsHandler(event Event, c *Client) error {
 func CreateRoomHandler(event Event, c *Client) error {
 	var createRoom CreateRoomEvent
 	if err := json.Unmarshal(event.Payload, &createRoom); err != nil {
-		fmt.Errorf("Error unmarshalling event: %v", err)
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if createRoom.Encrypted && !c.supports(FeatureE2EE) {
+		return ErrFeatureNotNegotiated
 	}
 	// check if other user exists
 	user, err := c.hub.db.getUserByUsername(createRoom.Username)
 	if err != nil {
 		return err
 	}
+	hidden, err := c.hub.db.getPresenceHiddenTo(c.user.id)
+	if err != nil {
+		return err
+	}
 	
+
 	// check if room already exists
 	var roomEvent NewRoomEvent
 	var room *Room
-	id, err := c.hub.db.getRoomByUsers(c.user.username, user.username)
+	id, err := c.hub.db.getRoomByUsers(c.user.id, user.id)
 	if err != nil {
 		if !errors.Is(err, RoomNotFoundError) {
 			return err
 		}
+		// no new direct room between users when one blocked the other
+		blocked, err := c.hub.db.isBlockedEitherWay(c.user.id, user.id)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrUserBlocked
+		}
+		if err := c.hub.checkDirectRoomAllowed(c.user, user); err != nil {
+			return err
+		}
+		if createRoom.Encrypted {
+			if err := requireIdentityKeys(c.hub, c.user, user); err != nil {
+				return err
+			}
+		}
 		// create room
 		room = newRoom(c.hub)
+		room.encrypted = createRoom.Encrypted
 		go room.run()
 		id, err = c.hub.db.addRoom(room)
 		if err != nil {
 			return err
 		}
+		room.id = id
 		
 		room.register <- c.user
 		room.register <- user
-		err := c.hub.db.addUserToRoom(c.user.username, id)
+		// whoever starts a direct room owns it, the other side administers it
+		err = c.hub.db.addUserToRoom(c.user.id, id, RoleOwner)
 		if err != nil {
 			return err
 		}
-		err = c.hub.db.addUserToRoom(user.username, id)
+		err = c.hub.db.addUserToRoom(user.id, id, RoleAdmin)
 		if err != nil {
 			return err
 		}
-		c.hub.rooms[id] = room
+		c.hub.registerRoom(room)
+		c.hub.webhooks.enqueue(id, WebhookMemberJoined, WebhookMemberEvent{RoomId: id, Username: c.user.username})
+		c.hub.webhooks.enqueue(id, WebhookMemberJoined, WebhookMemberEvent{RoomId: id, Username: user.username, Actor: c.user.username})
 		var roomUsers []RoomUser
-		roomUser := RoomUser{Username: user.username, Online: false, Typing: false}
+		roomUser := RoomUser{Id: user.id, Username: user.username, DisplayName: user.displayName, Online: false, Typing: false}
 		roomUsers = append(roomUsers, roomUser)
-		roomEvent = NewRoomEvent{Id: id, Name: user.username, Users: roomUsers, LastMessage: NewMessageEvent{}}
+		roomEvent = NewRoomEvent{Id: id, Name: user.username, Encrypted: createRoom.Encrypted, Retention: c.hub.config.Retention.RetentionPolicy, Users: roomUsers, LastMessage: NewMessageEvent{}}
 	} else {
-		room = c.hub.rooms[id]
-		var roomUsers []RoomUser
-		var roomUser RoomUser
-		for user := range room.users {
-			roomUser = RoomUser{Username: user, Online: len(c.hub.clients[user]) > 0, Typing: false}
-			roomUsers = append(roomUsers, roomUser)
+		var ok bool
+		room, ok = c.hub.getRoom(id)
+		if !ok {
+			return RoomNotFoundError
+		}
+		// an existing direct room can be switched to encryption, never back.
+		// switched on the room's goroutine, where messages are checked against it
+		if createRoom.Encrypted {
+			room.apply(func(r *Room) {
+				if r.encrypted {
+					return
+				}
+				if err = requireIdentityKeys(c.hub, c.user, user); err != nil {
+					return
+				}
+				if err = c.hub.db.setRoomEncrypted(r.id); err != nil {
+					return
+				}
+				r.encrypted = true
+			})
+			if err != nil {
+				return err
+			}
 		}
-		roomEvent = NewRoomEvent{Id: id, Name: user.username, Users: roomUsers, LastMessage: room.lastMessage}
+		roomEvent = room.describeTo(c.user.id, hidden)
 	}	
 
 	// broadcast NewRoomEvent
@@ -273,13 +471,22 @@ func ClientConnectedHandler(event Event, c *Client) error {
 	outgoingEvent.Payload = data
 	outgoingEvent.Type = EventUserConnected
 
-	roomIds, err := c.hub.db.getRooms(c.user.username)
+	// users we blocked or hide our presence from don't see it
+	hidden, err := c.hub.db.getPresenceHiddenFrom(c.user.id)
+	if err != nil {
+		return err
+	}
+
+	roomIds, err := c.hub.db.getRooms(c.user.id)
 	if err != nil {
 		return err
 	}
 	for i := range roomIds {
-		room := c.hub.rooms[roomIds[i]]
-		room.broadcast <- outgoingEvent
+		room, ok := c.hub.getRoom(roomIds[i])
+		if !ok {
+			continue
+		}
+		room.broadcastFiltered <- filteredEvent{event: outgoingEvent, skip: hidden}
 	}
 	return nil
 }
@@ -297,13 +504,116 @@ func ClientDisconnectedHandler(event Event, c *Client) error {
 	outgoingEvent.Payload = data
 	outgoingEvent.Type = EventUserDisconnected
 
-	roomIds, err := c.hub.db.getRooms(c.user.username)
+	// users we blocked or hide our presence from don't see it
+	hidden, err := c.hub.db.getPresenceHiddenFrom(c.user.id)
+	if err != nil {
+		return err
+	}
+
+	roomIds, err := c.hub.db.getRooms(c.user.id)
 	if err != nil {
 		return err
 	}
 	for i := range roomIds {
-		room := c.hub.rooms[roomIds[i]]
-		room.broadcast <- outgoingEvent
+		room, ok := c.hub.getRoom(roomIds[i])
+		if !ok {
+			continue
+		}
+		room.broadcastFiltered <- filteredEvent{event: outgoingEvent, skip: hidden}
+	}
+	return nil
+}
+
+func UpdateRoomHandler(event Event, c *Client) error {
+	var update UpdateRoomEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, ok := c.hub.getRoom(update.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+
+	role, err := c.hub.db.getRoomRole(update.RoomId, c.user.id)
+	if err != nil {
+		return err
+	}
+	if roleRank(role) < roleRank(RoleAdmin) {
+		return ErrNotRoomAdmin
+	}
+
+	// validate everything before changing the room
+	if update.Name != nil && len(*update.Name) > maxRoomNameLength {
+		return fmt.Errorf("room name is longer than %d characters", maxRoomNameLength)
+	}
+	if update.Topic != nil && len(*update.Topic) > maxRoomTopicLength {
+		return fmt.Errorf("room topic is longer than %d characters", maxRoomTopicLength)
 	}
+	if update.Description != nil && len(*update.Description) > maxRoomDescriptionLength {
+		return fmt.Errorf("room description is longer than %d characters", maxRoomDescriptionLength)
+	}
+	if update.Avatar != nil && len(*update.Avatar) > maxRoomAvatarLength {
+		return fmt.Errorf("room avatar reference is longer than %d characters", maxRoomAvatarLength)
+	}
+	if update.Visibility != nil && *update.Visibility != RoomPublic && *update.Visibility != RoomPrivate {
+		return fmt.Errorf("room visibility must be %s or %s", RoomPublic, RoomPrivate)
+	}
+	if update.Visibility != nil && *update.Visibility == RoomPublic && room.capacity == 2 {
+		return ErrDirectRoomPublic
+	}
+
+	// merged, stored and applied on the room's goroutine, so concurrent updates don't undo each other
+	var broadcastEvent RoomUpdatedEvent
+	room.apply(func(r *Room) {
+		updated := *r
+		if update.Name != nil {
+			updated.name = strings.TrimSpace(*update.Name)
+		}
+		if update.Topic != nil {
+			updated.topic = strings.TrimSpace(*update.Topic)
+		}
+		if update.Description != nil {
+			updated.description = *update.Description
+		}
+		if update.Avatar != nil {
+			updated.avatar = strings.TrimSpace(*update.Avatar)
+		}
+		if update.Visibility != nil {
+			updated.visibility = *update.Visibility
+		}
+		if err = c.hub.db.updateRoomSettings(&updated); err != nil {
+			return
+		}
+		r.name = updated.name
+		r.topic = updated.topic
+		r.description = updated.description
+		r.avatar = updated.avatar
+		r.visibility = updated.visibility
+
+		broadcastEvent = RoomUpdatedEvent{
+			RoomId: r.id,
+			Name: r.name,
+			Topic: r.topic,
+			Description: r.description,
+			Avatar: r.avatar,
+			Visibility: r.visibility,
+			UpdatedBy: c.user.username,
+		}
+	})
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(broadcastEvent)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventRoomUpdated
+	room.broadcast <- outgoingEvent
+	c.hub.webhooks.enqueue(room.id, EventRoomUpdated, broadcastEvent)
+
 	return nil
 }
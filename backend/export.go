@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// messages fetched from the export cursor at once
+const exportBatchSize = 500
+
+// writes a transcript message by message, so a room's history never has to fit in memory
+type transcriptWriter interface {
+	begin(info transcriptInfo) error
+	message(message NewMessageEvent) error
+	end() error
+}
+
+// what the transcript header shows
+type transcriptInfo struct {
+	RoomId      int
+	Name        string
+	Topic       string
+	Members     []string
+	ExportedBy  string
+	ExportedAt  time.Time
+}
+
+type exportFormat struct {
+	contentType string
+	extension string
+	writer func(w io.Writer) transcriptWriter
+}
+
+var exportFormats = map[string]exportFormat{
+	"jsonl": {"application/x-ndjson", "jsonl", func(w io.Writer) transcriptWriter { return &jsonlTranscript{enc: json.NewEncoder(w)} }},
+	"markdown": {"text/markdown; charset=utf-8", "md", func(w io.Writer) transcriptWriter { return &markdownTranscript{w: w} }},
+	"html": {"text/html; charset=utf-8", "html", func(w io.Writer) transcriptWriter { return &htmlTranscript{w: w} }},
+}
+
+// text shown in place of messages the server can't read
+const encryptedPlaceholder = "[end-to-end encrypted message]"
+
+// streams the history of a room the authenticated user is a member of.
+// ?format= is jsonl (default), markdown or html
+func (h *Hub) exportRoomHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	roomId, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad room id", http.StatusBadRequest)
+		return
+	}
+	room, ok := h.getRoom(roomId)
+	if !ok {
+		http.Error(w, RoomNotFoundError.Error(), http.StatusNotFound)
+		return
+	}
+	_, err = h.db.getRoomRole(roomId, userId)
+	if errors.Is(err, NotRoomMemberError) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving room", http.StatusInternalServerError)
+		return
+	}
+
+	user, err := h.db.getUser(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		name = "jsonl"
+	}
+	format, ok := exportFormats[name]
+	if !ok {
+		http.Error(w, "format must be jsonl, markdown or html", http.StatusBadRequest)
+		return
+	}
+
+	// the room's goroutine lists the other members, the exporting user is one too
+	described := room.describeTo(userId, nil)
+	info := transcriptInfo{
+		RoomId: room.id,
+		Name: described.Name,
+		Topic: described.Topic,
+		Members: []string{user.username},
+		ExportedBy: user.username,
+		ExportedAt: time.Now().UTC(),
+	}
+	for _, member := range described.Users {
+		info.Members = append(info.Members, member.Username)
+	}
+	sort.Strings(info.Members)
+
+	w.Header().Set("Content-Type", format.contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="room-%d.%s"`, room.id, format.extension))
+	w.WriteHeader(http.StatusOK)
+
+	// the status is sent, from here on errors can only cut the transcript short
+	out := bufio.NewWriter(w)
+	transcript := format.writer(out)
+	if err := transcript.begin(info); err != nil {
+		log.Println("Error exporting room: ", err)
+		return
+	}
+	err = h.db.streamMessages(r.Context(), room.id, exportBatchSize, func(message NewMessageEvent) error {
+		return transcript.message(message)
+	}, func() error {
+		// hand each batch to the client before fetching the next one
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		http.NewResponseController(w).Flush()
+		return nil
+	})
+	if err != nil {
+		log.Println("Error exporting room: ", err)
+		return
+	}
+	if err := transcript.end(); err != nil {
+		log.Println("Error exporting room: ", err)
+		return
+	}
+	out.Flush()
+}
+
+// one NewMessageEvent per line, as sent over the websocket
+type jsonlTranscript struct {
+	enc *json.Encoder
+}
+
+func (t *jsonlTranscript) begin(info transcriptInfo) error { return nil }
+
+func (t *jsonlTranscript) message(message NewMessageEvent) error {
+	message.Sent = message.Sent.UTC()
+	return t.enc.Encode(message)
+}
+
+func (t *jsonlTranscript) end() error { return nil }
+
+type markdownTranscript struct {
+	w io.Writer
+}
+
+func (t *markdownTranscript) begin(info transcriptInfo) error {
+	_, err := fmt.Fprintf(t.w, "# %s\n\n", info.Name)
+	if err != nil {
+		return err
+	}
+	if info.Topic != "" {
+		fmt.Fprintf(t.w, "_%s_\n\n", info.Topic)
+	}
+	_, err = fmt.Fprintf(t.w, "Members: %s  \nExported by %s on %s\n\n---\n\n", strings.Join(info.Members, ", "), info.ExportedBy, info.ExportedAt.Format(time.RFC3339))
+	return err
+}
+
+func (t *markdownTranscript) message(message NewMessageEvent) error {
+	author := "**" + message.From + "**"
+	if message.Bot {
+		author += " (bot)"
+	}
+	text := message.Message
+	if message.Encrypted {
+		text = encryptedPlaceholder
+	}
+	// quoting every line keeps the messages' own markdown from breaking the transcript
+	quoted := "> " + strings.ReplaceAll(text, "\n", "\n> ")
+	_, err := fmt.Fprintf(t.w, "%s · %s\n\n%s\n\n", author, message.Sent.UTC().Format(time.RFC3339), quoted)
+	return err
+}
+
+func (t *markdownTranscript) end() error { return nil }
+
+var htmlTranscriptTemplate = template.Must(template.New("transcript").Parse(`
+{{define "begin"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 48rem; margin: 2rem auto; padding: 0 1rem; color: #1f2328; }
+header { border-bottom: 1px solid #d0d7de; margin-bottom: 1rem; }
+.message { margin: 0 0 1rem; }
+.meta { color: #656d76; font-size: 0.85rem; }
+.author { font-weight: 600; color: #1f2328; }
+.text { white-space: pre-wrap; margin: 0.25rem 0 0; }
+.encrypted { font-style: italic; color: #656d76; }
+</style>
+</head>
+<body>
+<header>
+<h1>{{.Name}}</h1>
+{{if .Topic}}<p>{{.Topic}}</p>{{end}}
+<p class="meta">Members: {{range $i, $m := .Members}}{{if $i}}, {{end}}{{$m}}{{end}}<br>
+Exported by {{.ExportedBy}} on <time datetime="{{.ExportedAt.Format "2006-01-02T15:04:05Z07:00"}}">{{.ExportedAt.Format "2006-01-02 15:04 MST"}}</time></p>
+</header>
+<main>
+{{end}}
+{{define "message"}}<article class="message" id="m{{.Id}}">
+<div class="meta"><span class="author">{{.From}}</span>{{if .Bot}} (bot){{end}} · <time datetime="{{.Sent.Format "2006-01-02T15:04:05Z07:00"}}">{{.Sent.Format "2006-01-02 15:04:05 MST"}}</time></div>
+{{if .Encrypted}}<p class="text encrypted">` + encryptedPlaceholder + `</p>{{else}}<p class="text">{{.Message}}</p>{{end}}
+</article>
+{{end}}
+{{define "end"}}</main>
+</body>
+</html>
+{{end}}`))
+
+// a single page with inline styles and no external resources, html/template escapes the messages
+type htmlTranscript struct {
+	w io.Writer
+}
+
+func (t *htmlTranscript) begin(info transcriptInfo) error {
+	return htmlTranscriptTemplate.ExecuteTemplate(t.w, "begin", info)
+}
+
+func (t *htmlTranscript) message(message NewMessageEvent) error {
+	message.Sent = message.Sent.UTC()
+	return htmlTranscriptTemplate.ExecuteTemplate(t.w, "message", message)
+}
+
+func (t *htmlTranscript) end() error {
+	return htmlTranscriptTemplate.ExecuteTemplate(t.w, "end", nil)
+}
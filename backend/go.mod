@@ -1,14 +1,22 @@
-module main
+module gochat
 
 go 1.25.3
 
+require (
+	github.com/golang-jwt/jwt/v5 v5.3.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+	github.com/rs/cors v1.11.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	github.com/yuin/goldmark v1.8.2
+	golang.org/x/crypto v0.43.0
+	golang.org/x/net v0.45.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
 require (
 	github.com/golang-jwt/jwt v3.2.2+incompatible // indirect
-	github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	github.com/rs/cors v1.11.1 // indirect
-	golang.org/x/crypto v0.43.0 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
 )
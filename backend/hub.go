@@ -5,23 +5,14 @@ import (
 	"net/http"
 	"errors"
 	"context"
+	"strings"
+	"sync"
 	"encoding/json"
 
 	"github.com/gorilla/websocket"
 	"golang.org/x/crypto/bcrypt"
 )
 
-var (
-	/*
-	* upgrader upgrades HTTP requests to persistent websocket connection
-	*/
-	upgrader = websocket.Upgrader{
-		CheckOrigin:	 checkOrigin,
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-	}
-)
-
 var (
 	ErrEventNotSupported = errors.New("this event type is not supported")
 )
@@ -31,26 +22,28 @@ var (
 	space	= []byte{' '}
 )
 
-func checkOrigin(r *http.Request) bool {
+// only accept websocket upgrades from the configured origins
+func (h *Hub) checkOrigin(r *http.Request) bool {
 	origin := r.Header.Get("Origin")
 
-	switch origin {
-	case "http://localhost:8080":
-		return true
-	case "http://localhost":
-		return true
-	default:
-		return false
+	for _, allowed := range h.config.Server.AllowedOrigins {
+		if origin == allowed {
+			return true
+		}
 	}
+	return false
 }
 
 // Hub maintains the set of active clients and broadcasts messages to the clients
 type Hub struct {
-	// all rooms
+	// all rooms, guarded by roomsMu as background jobs read it while handlers add rooms
 	rooms map[int]*Room
+	roomsMu sync.RWMutex
 
-	// Registered clients and their associated user's username
-	clients map[string]map[*Client]bool
+	// Registered clients by their user's id. only the hub's goroutine changes it, under clientsMu,
+	// the rooms and background jobs read it through clientsOf and isConnected
+	clients map[int]map[*Client]bool
+	clientsMu sync.RWMutex
 
 	// Register requests from the clients
 	register chan *Client
@@ -58,30 +51,102 @@ type Hub struct {
 	// Unregister requests from clients
 	unregister chan *Client
 
+	// requests to disconnect every client of a user, by the user's id
+	disconnect chan int
+
+	// new usernames and display names, handed to every client of the user
+	rename chan renameRequest
+
 	// handlers -> functions that handle Events
 	handlers map[string]EventHandler
 
+	// built in slash commands, by name
+	commands map[string]*Command
+
+	// hands the other commands to the bot that registered them, tests can replace it to run without a database
+	botCommand func(c *Client, roomId int, name string, args string) (bool, error)
+
 	db *Database
+
+	// outgoing webhooks for room events
+	webhooks *WebhookDispatcher
+
+	// Web Push to offline members, nil when not configured
+	push *PushDispatcher
+
+	// personal data exports and account erasures
+	privacy *PrivacyJobs
+
+	// posts scheduled messages once they are due
+	scheduler *MessageScheduler
+
+	// link previews, nil when disabled
+	unfurler *LinkUnfurler
+
+	// mentions and notifications of the messages posted
+	notifier *Notifier
+
+	// wrong second factor codes of each user
+	secondFactorAttempts *attemptLimiter
+
+	config *Config
+
+	// upgrader upgrades HTTP requests to persistent websocket connection
+	upgrader websocket.Upgrader
 }
 
-func newHub(ctx context.Context) (*Hub, error) {
+func newHub(ctx context.Context, config *Config) (*Hub, error) {
 	h := &Hub{
-		clients: 	make(map[string]map[*Client]bool),
+		clients: 	make(map[int]map[*Client]bool),
 		rooms:		make(map[int]*Room),
 		register:	make(chan *Client),
 		unregister:	make(chan *Client),
+		disconnect:	make(chan int),
+		rename:		make(chan renameRequest),
 		handlers: 	make(map[string]EventHandler),
+		commands:	make(map[string]*Command),
+		botCommand:	dispatchBotCommand,
+		config:		config,
+		secondFactorAttempts: newAttemptLimiter(maxSecondFactorAttempts, secondFactorLockout),
 	}
-	db, err := getDb(h)
+	h.upgrader = websocket.Upgrader{
+		CheckOrigin:	 h.checkOrigin,
+		Subprotocols:    subprotocols,
+		ReadBufferSize:  config.WebSocket.ReadBufferSize,
+		WriteBufferSize: config.WebSocket.WriteBufferSize,
+	}
+	configureAuth(config.Auth)
+	db, err := getDb(h, config.Database)
 	if err != nil {
 		return nil, err
 	}
 	h.db = db
+	h.webhooks = newWebhookDispatcher(db, config.Webhooks)
+	go h.webhooks.run(ctx)
+	h.push, err = newPushDispatcher(db, config.Push)
+	if err != nil {
+		return nil, err
+	}
+	if h.push != nil {
+		h.push.run(ctx)
+	}
+	h.notifier = newNotifier(h)
+	h.notifier.run(ctx)
+	h.unfurler = newLinkUnfurler(db, config.Previews)
+	if h.unfurler != nil {
+		h.unfurler.run(ctx)
+	}
 	h.setupEventHandlers()
+	h.setupCommands()
 	err = h.loadRooms()
 	if err != nil {
 		return nil, err
 	}
+	go h.runRetention(ctx)
+	h.privacy = newPrivacyJobs(h, config.Privacy)
+	go h.privacy.run(ctx)
+	h.scheduler = newMessageScheduler(h, config.Scheduler)
+	go h.scheduler.run(ctx)
 
 	return h, nil
 }
@@ -98,6 +163,32 @@ func (h *Hub) loadRooms() error {
 	return nil
 }
 
+// returns the room with the given id
+func (h *Hub) getRoom(id int) (*Room, bool) {
+	h.roomsMu.RLock()
+	defer h.roomsMu.RUnlock()
+	room, ok := h.rooms[id]
+	return room, ok
+}
+
+// makes a newly created room reachable by its id
+func (h *Hub) registerRoom(room *Room) {
+	h.roomsMu.Lock()
+	defer h.roomsMu.Unlock()
+	h.rooms[room.id] = room
+}
+
+// returns every room, safe to iterate while rooms are being created
+func (h *Hub) allRooms() []*Room {
+	h.roomsMu.RLock()
+	defer h.roomsMu.RUnlock()
+	rooms := make([]*Room, 0, len(h.rooms))
+	for _, room := range h.rooms {
+		rooms = append(rooms, room)
+	}
+	return rooms
+}
+
 // configures and adds all handlers
 func (h *Hub) setupEventHandlers() {
 	h.handlers[EventSendMessage] = SendMessageHandler
@@ -107,10 +198,56 @@ func (h *Hub) setupEventHandlers() {
 	h.handlers[EventCreateRoom] = CreateRoomHandler
 	h.handlers[EventClientConnected] = ClientConnectedHandler
 	h.handlers[EventClientDisconnected] = ClientDisconnectedHandler
+	h.handlers[EventUpdateRoom] = UpdateRoomHandler
+	h.handlers[EventKickMember] = KickMemberHandler
+	h.handlers[EventMuteMember] = MuteMemberHandler
+	h.handlers[EventPinMessage] = PinMessageHandler
+	h.handlers[EventUnpinMessage] = UnpinMessageHandler
+	h.handlers[EventDeleteMessage] = DeleteMessageHandler
+	h.handlers[EventSetRole] = SetRoleHandler
+	h.handlers[EventTransferOwnership] = TransferOwnershipHandler
+	h.handlers[EventBlockUser] = BlockUserHandler
+	h.handlers[EventUnblockUser] = UnblockUserHandler
+	h.handlers[EventGetBlockedUsers] = GetBlockedUsersHandler
+	h.handlers[EventGetNotifications] = GetNotificationsHandler
+	h.handlers[EventMarkNotificationRead] = MarkNotificationReadHandler
+	h.handlers[EventSetNotificationLevel] = SetNotificationLevelHandler
+	h.handlers[EventSetRetention] = SetRetentionHandler
+	h.handlers[EventChangeUsername] = ChangeUsernameHandler
+	h.handlers[EventGetProfile] = GetProfileHandler
+	h.handlers[EventUpdateProfile] = UpdateProfileHandler
+	h.handlers[EventSearchUsers] = SearchUsersHandler
+	h.handlers[EventSendContactRequest] = SendContactRequestHandler
+	h.handlers[EventAcceptContactRequest] = AcceptContactRequestHandler
+	h.handlers[EventDeclineContactRequest] = DeclineContactRequestHandler
+	h.handlers[EventRemoveContact] = RemoveContactHandler
+	h.handlers[EventGetContacts] = GetContactsHandler
+	h.handlers[EventGetPrivacySettings] = GetPrivacySettingsHandler
+	h.handlers[EventSetPrivacySettings] = SetPrivacySettingsHandler
+	h.handlers[EventCreateInvite] = CreateInviteHandler
+	h.handlers[EventGetInvites] = GetInvitesHandler
+	h.handlers[EventRevokeInvite] = RevokeInviteHandler
+	h.handlers[EventJoinByInvite] = JoinByInviteHandler
+	h.handlers[EventCreateChannel] = CreateChannelHandler
+	h.handlers[EventListPublicRooms] = ListPublicRoomsHandler
+	h.handlers[EventPreviewRoom] = PreviewRoomHandler
+	h.handlers[EventJoinRoom] = JoinRoomHandler
+	h.handlers[EventLeaveRoom] = LeaveRoomHandler
+	h.handlers[EventScheduleMessage] = ScheduleMessageHandler
+	h.handlers[EventListScheduled] = ListScheduledHandler
+	h.handlers[EventCancelScheduled] = CancelScheduledHandler
+	h.handlers[EventGetPins] = GetPinsHandler
+	h.handlers[EventSaveMessage] = SaveMessageHandler
+	h.handlers[EventUnsaveMessage] = UnsaveMessageHandler
+	h.handlers[EventGetSaved] = GetSavedHandler
+	h.handlers[EventHello] = HelloHandler
 }
 
 // makes sure the events are handlers are correctly associated
 func (h *Hub) routeEvent(event Event, c *Client) error {
+	if feature, ok := featureRequests[event.Type]; ok && !c.supports(feature) {
+		return ErrFeatureNotNegotiated
+	}
 	if handler, ok := h.handlers[event.Type]; ok {
 		if err := handler(event, c); err != nil {
 			return err
@@ -134,6 +271,10 @@ func (h *Hub) signupHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if err := validateUsername(req.Username); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
 	if _, err := h.db.getUserByUsername(req.Username); err == nil {
 		w.WriteHeader(http.StatusUnauthorized)
@@ -142,7 +283,8 @@ func (h *Hub) signupHandler(w http.ResponseWriter, r *http.Request) {
 
 	bytes, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost) 
 
-	err = h.db.addUser(newUser(req.Username), string(bytes))
+	user := newUser(0, req.Username)
+	err = h.db.addUser(user, string(bytes))
 	if err != nil {
 		http.Error(w, "Error creating user", http.StatusInternalServerError)
 		return
@@ -152,7 +294,7 @@ func (h *Hub) signupHandler(w http.ResponseWriter, r *http.Request) {
 		Token string `json:"token"`
 	}
 
-	token, err := generateJWT(req.Username)
+	token, err := generateJWT(user.id)
 	if err != nil {
 		log.Println("Error generating JWT token: ", err)
 		return
@@ -187,19 +329,35 @@ func (h *Hub) loginHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// authenticate user
-	if password, err := h.db.getPasswordHashByUsername(req.Username); err == nil && bcrypt.CompareHashAndPassword([]byte(password), []byte(req.Password)) == nil {
+	if userId, password, err := h.db.getPasswordHashByUsername(req.Username); err == nil && bcrypt.CompareHashAndPassword([]byte(password), []byte(req.Password)) == nil {
 		type response struct {
-			Token string `json:"token"`
+			Token string `json:"token,omitempty"`
+			MFARequired bool `json:"mfa_required,omitempty"`
+			MFAToken string `json:"mfa_token,omitempty"`
 		}
 
-		token, err := generateJWT(req.Username)
+		_, totpEnabled, _, err := h.db.getTOTP(userId)
 		if err != nil {
-			log.Println("JWT token generation error: ", err)
+			http.Error(w, "Credentials verification error", http.StatusInternalServerError)
 			return
 		}
 
-		resp := response{
-			Token: token,
+		var resp response
+		if totpEnabled {
+			// second step happens in loginTOTPHandler
+			token, err := generateMFAToken(userId)
+			if err != nil {
+				log.Println("JWT token generation error: ", err)
+				return
+			}
+			resp = response{MFARequired: true, MFAToken: token}
+		} else {
+			token, err := generateJWT(userId)
+			if err != nil {
+				log.Println("JWT token generation error: ", err)
+				return
+			}
+			resp = response{Token: token}
 		}
 
 		data, err := json.Marshal(resp)
@@ -217,6 +375,19 @@ func (h *Hub) loginHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusUnauthorized)
 }
 
+// writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Println("Error marshalling message: ", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(data)
+}
+
 // serveWs handles websocket requests from the peer
 func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 	token := r.URL.Query().Get("token")
@@ -226,27 +397,39 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	
-	claims, err := verifyJWT(token)
-	if err != nil {
-		log.Println("Error verificating JWT token: ", err)
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
+	var userId int
+	if strings.HasPrefix(token, botTokenPrefix) {
+		// bots connect with their API token
+		bot, err := h.authenticateBotToken(token, ScopeWebSocket)
+		if err != nil {
+			log.Println("Error verificating bot token: ", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		userId = bot
+	} else {
+		claims, err := verifyJWT(token)
+		if err != nil {
+			log.Println("Error verificating JWT token: ", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
 
-	username, err := claims.GetSubject()
-	if err != nil {
-		log.Println("Error during JWT token analysis: ", err)
-		return
+		userId, err = subjectId(claims)
+		if err != nil {
+			log.Println("Error during JWT token analysis: ", err)
+			return
+		}
 	}
 
-	conn, err := upgrader.Upgrade(w, r, nil)
+	conn, err := h.upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		log.Println("Error during connection promotion: ", err)
 		return
 	}
 
 	
-	user, err := h.db.getUserByUsername(username)
+	user, err := h.db.getUser(userId)
 	if err != nil  {
 		log.Println("User not found: ", err)
 		http.Error(w, "Credentials verification error", http.StatusInternalServerError)
@@ -262,23 +445,59 @@ func (h *Hub) serveWs(w http.ResponseWriter, r *http.Request) {
 	go client.readMessages()
 }
 
+// returns the connected clients of a user
+func (h *Hub) clientsOf(userId int) []*Client {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	clients := make([]*Client, 0, len(h.clients[userId]))
+	for client := range h.clients[userId] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// whether the user has a connected client
+func (h *Hub) isConnected(userId int) bool {
+	h.clientsMu.RLock()
+	defer h.clientsMu.RUnlock()
+	return len(h.clients[userId]) > 0
+}
+
+// sends an event to every connected client of a user
+func (h *Hub) sendToUser(userId int, event Event) {
+	for _, client := range h.clientsOf(userId) {
+		if !client.accepts(event) {
+			continue
+		}
+		select {
+		case client.send <- event:
+		default:
+			log.Println("Client buffer full, dropping event ", event.Type)
+		}
+	}
+}
+
 // add client to the clients list
 func (h *Hub) addClient(client *Client) {
-	if _, ok := h.clients[client.user.username]; !ok {
-		h.clients[client.user.username] = make(map[*Client]bool)
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	if _, ok := h.clients[client.user.id]; !ok {
+		h.clients[client.user.id] = make(map[*Client]bool)
 	}
 	client.user.online = true
-	h.clients[client.user.username][client] = true
+	h.clients[client.user.id][client] = true
 }
 
 // remove client from clients list and end connection
 func (h *Hub) removeClient(client *Client) {
-	if _, ok := h.clients[client.user.username][client]; ok {
-		if len(h.clients[client.user.username]) == 1 {
+	h.clientsMu.Lock()
+	defer h.clientsMu.Unlock()
+	if _, ok := h.clients[client.user.id][client]; ok {
+		if len(h.clients[client.user.id]) == 1 {
 			client.user.online = false;
 		}
 		client.conn.Close()
-		delete(h.clients[client.user.username], client)
+		delete(h.clients[client.user.id], client)
 	}
 }
 
@@ -290,6 +509,15 @@ func (h *Hub) run() {
 			h.addClient(client)
 		case client := <-h.unregister:
 			h.removeClient(client)
+		case request := <-h.rename:
+			for _, client := range h.clientsOf(request.user.id) {
+				client.renamed.Store(request.user)
+			}
+			close(request.done)
+		case userId := <-h.disconnect:
+			for _, client := range h.clientsOf(userId) {
+				h.removeClient(client)
+			}
 		}
 	}
 			
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+// background jobs send to users while the hub adds and removes their clients, run with -race
+func TestHubClientsConcurrentAccess(t *testing.T) {
+	h := &Hub{clients: make(map[int]map[*Client]bool)}
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			client := &Client{hub: h, user: newUser(1, "alice"), send: make(chan Event, 1)}
+			h.addClient(client)
+			// removeClient without closing a connection the test doesn't have
+			h.clientsMu.Lock()
+			delete(h.clients[1], client)
+			h.clientsMu.Unlock()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for range 100 {
+			h.sendToUser(1, Event{Type: EventNotification})
+			h.isConnected(1)
+		}
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	// create an invite code for a group room
+	EventCreateInvite = "create_invite"
+	// response to create_invite
+	EventInvite = "invite"
+	// get the invites of a room
+	EventGetInvites = "get_invites"
+	// delete an invite so it can't be used anymore
+	EventRevokeInvite = "revoke_invite"
+	// response to get_invites and revoke_invite
+	EventInvites = "invites"
+	// join a room with an invite code
+	EventJoinByInvite = "join_by_invite"
+)
+
+// longest an invite can stay valid, invites without expiry are still allowed
+const maxInviteDuration = 30 * 24 * time.Hour
+
+var (
+	ErrInviteExpired = errors.New("this invite has expired or was used up")
+	ErrDirectRoomInvite = errors.New("direct rooms can't have invites")
+)
+
+// a code anyone can use to join a room, within its limits
+type RoomInvite struct {
+	Code string `json:"code"`
+	RoomId int `json:"room_id"`
+	CreatedBy string `json:"created_by"`
+	// role given to whoever joins with it
+	Role string `json:"role"`
+	// nil for no limit
+	MaxUses *int `json:"max_uses"`
+	Uses int `json:"uses"`
+	// nil when it never expires
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// id of the user named in CreatedBy
+	creatorId int
+}
+
+// what someone given an invite code can see of the room before joining
+type InvitePreview struct {
+	Code string `json:"code"`
+	RoomId int `json:"room_id"`
+	Name string `json:"name"`
+	Topic string `json:"topic"`
+	Description string `json:"description"`
+	Avatar string `json:"avatar"`
+	Encrypted bool `json:"encrypted"`
+	Members int `json:"members"`
+	InvitedBy string `json:"invited_by"`
+	Role string `json:"role"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+type CreateInviteEvent struct {
+	RoomId int `json:"room_id"`
+	// member when empty
+	Role string `json:"role"`
+	// 0 for no limit
+	MaxUses int `json:"max_uses"`
+	// Go duration such as "24h", empty for an invite that never expires
+	ExpiresIn string `json:"expires_in"`
+}
+
+type GetInvitesEvent struct {
+	RoomId int `json:"room_id"`
+}
+
+type InviteCodeEvent struct {
+	Code string `json:"code"`
+}
+
+type InvitesEvent struct {
+	RoomId int `json:"room_id"`
+	Invites []RoomInvite `json:"invites"`
+}
+
+func generateInviteCode() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// whether the invite can still be used
+func (i *RoomInvite) usable() bool {
+	if i.MaxUses != nil && i.Uses >= *i.MaxUses {
+		return false
+	}
+	return i.ExpiresAt == nil || time.Now().Before(*i.ExpiresAt)
+}
+
+func CreateInviteHandler(event Event, c *Client) error {
+	var e CreateInviteEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	room, role, err := moderatorRole(c, e.RoomId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if room.capacity == 2 {
+		return ErrDirectRoomInvite
+	}
+
+	if e.Role == "" {
+		e.Role = RoleMember
+	}
+	if e.Role != RoleMember && e.Role != RoleAdmin {
+		return fmt.Errorf("invite role must be %s or %s", RoleMember, RoleAdmin)
+	}
+	// nobody can hand out their own role
+	if roleRank(e.Role) >= roleRank(role) {
+		return ErrInsufficientRole
+	}
+	if e.MaxUses < 0 {
+		return fmt.Errorf("max_uses can't be negative")
+	}
+	var expiresIn time.Duration
+	if e.ExpiresIn != "" {
+		expiresIn, err = time.ParseDuration(e.ExpiresIn)
+		if err != nil {
+			return fmt.Errorf("bad invite expiry: %v", err)
+		}
+		if expiresIn <= 0 || expiresIn > maxInviteDuration {
+			return fmt.Errorf("invite expiry must be between 0 and %s", maxInviteDuration)
+		}
+	}
+
+	code, err := generateInviteCode()
+	if err != nil {
+		return err
+	}
+	invite := RoomInvite{
+		Code: code,
+		RoomId: room.id,
+		CreatedBy: c.user.username,
+		Role: e.Role,
+		creatorId: c.user.id,
+	}
+	if e.MaxUses > 0 {
+		invite.MaxUses = &e.MaxUses
+	}
+	if err := c.hub.db.addRoomInvite(&invite, expiresIn); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(invite)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventInvite
+	c.send <- outgoingEvent
+	return nil
+}
+
+func GetInvitesHandler(event Event, c *Client) error {
+	var e GetInvitesEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if _, _, err := moderatorRole(c, e.RoomId, RoleAdmin); err != nil {
+		return err
+	}
+	return sendInvites(c, e.RoomId)
+}
+
+func RevokeInviteHandler(event Event, c *Client) error {
+	var e InviteCodeEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	invite, err := c.hub.db.getRoomInvite(e.Code)
+	if err != nil {
+		return err
+	}
+	if _, _, err := moderatorRole(c, invite.RoomId, RoleAdmin); err != nil {
+		return err
+	}
+
+	if err := c.hub.db.deleteRoomInvite(invite.Code); err != nil {
+		return err
+	}
+	return sendInvites(c, invite.RoomId)
+}
+
+func sendInvites(c *Client, roomId int) error {
+	invites, err := c.hub.db.getRoomInvites(roomId)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(InvitesEvent{RoomId: roomId, Invites: invites})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventInvites
+	c.send <- outgoingEvent
+	return nil
+}
+
+func JoinByInviteHandler(event Event, c *Client) error {
+	var e InviteCodeEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	invite, err := c.hub.db.getRoomInvite(e.Code)
+	if err != nil {
+		return err
+	}
+	room, ok := c.hub.getRoom(invite.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	// checked before the use is counted
+	if err := room.canJoin(c.user.id); err != nil {
+		return err
+	}
+
+	ok, err = c.hub.db.useRoomInvite(invite.Code)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInviteExpired
+	}
+	if err := c.hub.addRoomMember(room, c.user, invite.Role, ""); err != nil {
+		if releaseErr := c.hub.db.releaseRoomInvite(invite.Code); releaseErr != nil {
+			log.Println("Error releasing invite use: ", releaseErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// shows the room an invite code leads to, without using it
+func (h *Hub) previewInviteHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := authenticateRequest(r); err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	invite, err := h.db.getRoomInvite(r.PathValue("code"))
+	if errors.Is(err, InviteNotFoundError) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving invite", http.StatusInternalServerError)
+		return
+	}
+	if !invite.usable() {
+		http.Error(w, ErrInviteExpired.Error(), http.StatusGone)
+		return
+	}
+	room, ok := h.getRoom(invite.RoomId)
+	if !ok {
+		http.Error(w, RoomNotFoundError.Error(), http.StatusNotFound)
+		return
+	}
+
+	// described to no member in particular, so every member is listed
+	described := room.describeTo(0, nil)
+	writeJSON(w, http.StatusOK, InvitePreview{
+		Code: invite.Code,
+		RoomId: room.id,
+		Name: described.Name,
+		Topic: described.Topic,
+		Description: described.Description,
+		Avatar: described.Avatar,
+		Encrypted: described.Encrypted,
+		Members: len(described.Users),
+		InvitedBy: invite.CreatedBy,
+		Role: invite.Role,
+		ExpiresAt: invite.ExpiresAt,
+	})
+}
@@ -12,33 +12,63 @@ import (
 	"github.com/rs/cors"
 )
 
-var addr = flag.String("addr", ":8080", "http service address")
+var (
+	addr = flag.String("addr", "", "http service address, overrides server.addr")
+	configPath = flag.String("config", "", "path to a YAML config file, defaults to $GOCHAT_CONFIG")
+	printConfig = flag.Bool("print-config", false, "print the effective configuration and exit")
+	generateVAPID = flag.Bool("generate-vapid-keys", false, "print a new VAPID key pair for Web Push and exit")
+)
 
 func main() {
-	// parse addr
+	// parse flags
 	flag.Parse()
 
+	if *generateVAPID {
+		public, private, err := generateVAPIDKeys()
+		if err != nil {
+			log.Fatal("Error generating VAPID keys: ", err)
+		}
+		fmt.Printf("VAPID_PUBLIC_KEY=%s\nVAPID_PRIVATE_KEY=%s\n", public, private)
+		return
+	}
+
 	err := godotenv.Load("../.env")
 	if err != nil {
 		log.Println("No .env file found, relying on system environment variables")
 	}
+	// read after .env is loaded, it can set GOCHAT_CONFIG too
+	if *configPath == "" {
+		*configPath = os.Getenv("GOCHAT_CONFIG")
+	}
+
+	config, err := loadConfig(*configPath)
+	if err != nil {
+		log.Fatal("Invalid configuration: ", err)
+	}
+	if *addr != "" {
+		config.Server.Addr = *addr
+	}
+	if *printConfig {
+		fmt.Print(config)
+		return
+	}
 
 	mux := http.NewServeMux()
 
 	c := cors.New(cors.Options{
-		AllowedOrigins: []string{os.Getenv("ALLOWED_ORIGIN")},
+		AllowedOrigins: config.Server.AllowedOrigins,
 		AllowedMethods: []string{"GET", "POST", "OPTIONS", "PUT", "DELETE"},
 		AllowedHeaders: []string{"*"},
 		AllowCredentials: true,
 	})
 
-	// create root ctx and cancelfunc to cancel retention map goroutine
+	// create root ctx and cancelfunc to stop the background jobs (retention, webhooks, push)
 	rootCtx := context.Background()
 	ctx, cancel := context.WithCancel(rootCtx)
 
 	defer cancel()
 
-	err = setupAPI(ctx, mux)
+	err = setupAPI(ctx, mux, config)
 	if err != nil {
 		log.Fatal("Error setting up the API: ", err)
 		return
@@ -46,7 +76,7 @@ func main() {
 
 	// serve on designated addr
 	// err = http.ListenAndServeTLS(*addr, "localhost+2.pem", "localhost+2-key.pem", c.Handler(mux))
-	err = http.ListenAndServe(*addr, c.Handler(mux))
+	err = http.ListenAndServe(config.Server.Addr, c.Handler(mux))
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 		return
@@ -54,9 +84,9 @@ func main() {
 }
 
 // start all routes and associated handlers
-func setupAPI(ctx context.Context, mux *http.ServeMux) error {
+func setupAPI(ctx context.Context, mux *http.ServeMux, config *Config) error {
 	// hub to handle websocket connections
-	hub, err := newHub(ctx)
+	hub, err := newHub(ctx, config)
 	if err != nil {
 		return err
 	}
@@ -75,7 +105,36 @@ func setupAPI(ctx context.Context, mux *http.ServeMux) error {
 	})
 	mux.HandleFunc("/login", hub.loginHandler)
 	mux.HandleFunc("/signup", hub.signupHandler)
+	mux.HandleFunc("/login/2fa", hub.loginTOTPHandler)
+	mux.HandleFunc("/2fa/enroll", hub.enrollTOTPHandler)
+	mux.HandleFunc("/2fa/confirm", hub.confirmTOTPHandler)
+	mux.HandleFunc("/2fa/disable", hub.disableTOTPHandler)
+	mux.HandleFunc("GET /webhooks", hub.listWebhooksHandler)
+	mux.HandleFunc("POST /webhooks", hub.createWebhookHandler)
+	mux.HandleFunc("DELETE /webhooks/{id}", hub.deleteWebhookHandler)
+	mux.HandleFunc("GET /bots", hub.listBotsHandler)
+	mux.HandleFunc("POST /bots", hub.createBotHandler)
+	mux.HandleFunc("GET /bots/{id}/tokens", hub.listBotTokensHandler)
+	mux.HandleFunc("POST /bots/{id}/tokens", hub.createBotTokenHandler)
+	mux.HandleFunc("DELETE /bots/{id}/tokens/{tokenId}", hub.revokeBotTokenHandler)
+	mux.HandleFunc("POST /bots/{id}/commands", hub.registerBotCommandHandler)
+	mux.HandleFunc("DELETE /bots/{id}/commands/{command}", hub.deleteBotCommandHandler)
+	mux.HandleFunc("POST /bots/{id}/messages", hub.postBotMessageHandler)
+	mux.HandleFunc("GET /rooms/{id}/export", hub.exportRoomHandler)
+	mux.HandleFunc("GET /invites/{code}", hub.previewInviteHandler)
+	mux.HandleFunc("POST /account/data-export", hub.requestDataExportHandler)
+	mux.HandleFunc("GET /account/data-export", hub.dataExportStatusHandler)
+	mux.HandleFunc("GET /account/data-export/{id}", hub.downloadDataExportHandler)
+	mux.HandleFunc("POST /account/erase", hub.requestErasureHandler)
+	mux.HandleFunc("GET /keys", hub.getOwnKeysHandler)
+	mux.HandleFunc("POST /keys", hub.publishKeysHandler)
+	mux.HandleFunc("GET /keys/{username}", hub.getKeyBundleHandler)
+	mux.HandleFunc("GET /push/vapid-public-key", hub.vapidPublicKeyHandler)
+	mux.HandleFunc("POST /push/subscriptions", hub.subscribePushHandler)
+	mux.HandleFunc("DELETE /push/subscriptions", hub.unsubscribePushHandler)
 	mux.HandleFunc("/debug", func(w http.ResponseWriter, r *http.Request) {
+		hub.clientsMu.RLock()
+		defer hub.clientsMu.RUnlock()
 		fmt.Fprint(w, len(hub.clients))
 	})
 	// http.Handle("/frontend/", http.StripPrefix("/frontend", fs))
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/parser"
+	"github.com/yuin/goldmark/text"
+	"github.com/yuin/goldmark/util"
+)
+
+// format of the text of a message
+const (
+	FormatPlain = "plain"
+	// the safe subset of Markdown, rendered to HTML by the server
+	FormatMarkdown = "markdown"
+)
+
+var ErrUnknownFormat = errors.New("message format must be plain or markdown")
+
+// schemes links can have, anything else is rendered as text
+var allowedLinkSchemes = map[string]bool{"http": true, "https": true, "mailto": true}
+
+// renders the subset of Markdown messages can use: emphasis, code, links and lists.
+// raw HTML is dropped rather than escaped, and the renderer is never put in unsafe mode
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Linkify),
+	goldmark.WithParserOptions(
+		parser.WithASTTransformers(util.Prioritized(markdownSubset{}, 1000)),
+	),
+)
+
+// checks the message's format and returns its rendered HTML, empty for plain messages.
+// encrypted messages are rendered by their recipients, the server can't read them
+func renderMessage(message *SendMessageEvent) (string, error) {
+	if message.Format == "" {
+		message.Format = FormatPlain
+	}
+	if message.Format != FormatPlain && message.Format != FormatMarkdown {
+		return "", ErrUnknownFormat
+	}
+	if message.Format == FormatPlain || message.Encrypted {
+		return "", nil
+	}
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(message.Message), &buf); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// markdownSubset rewrites what is outside the subset into what is inside it:
+// headings become paragraphs, quotes lose their quoting, images become links,
+// or their text inside a link, and links to other schemes become their text
+type markdownSubset struct{}
+
+func (markdownSubset) Transform(doc *ast.Document, reader text.Reader, pc parser.Context) {
+	source := reader.Source()
+	// the tree can't be changed while it is walked
+	var nodes []ast.Node
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if entering && n != doc {
+			nodes = append(nodes, n)
+		}
+		return ast.WalkContinue, nil
+	})
+
+	for _, n := range nodes {
+		parent := n.Parent()
+		switch n := n.(type) {
+		case *ast.HTMLBlock, *ast.RawHTML, *ast.ThematicBreak:
+			parent.RemoveChild(parent, n)
+		case *ast.Heading:
+			paragraph := ast.NewParagraph()
+			paragraph.SetLines(n.Lines())
+			moveChildren(n, paragraph)
+			parent.ReplaceChild(parent, n, paragraph)
+		case *ast.Blockquote:
+			unwrapNode(n)
+		case *ast.Image:
+			// anchors can't be nested
+			if !allowedLink(n.Destination) || insideLink(n) {
+				unwrapNode(n)
+				continue
+			}
+			link := ast.NewLink()
+			link.Destination = n.Destination
+			link.Title = n.Title
+			link.SetAttributeString("rel", []byte("nofollow noopener noreferrer"))
+			moveChildren(n, link)
+			parent.ReplaceChild(parent, n, link)
+		case *ast.Link:
+			if !allowedLink(n.Destination) {
+				unwrapNode(n)
+				continue
+			}
+			n.SetAttributeString("rel", []byte("nofollow noopener noreferrer"))
+		case *ast.AutoLink:
+			if n.AutoLinkType == ast.AutoLinkURL && !allowedLink(n.URL(source)) {
+				parent.ReplaceChild(parent, n, ast.NewString(n.Label(source)))
+				continue
+			}
+			n.SetAttributeString("rel", []byte("nofollow noopener noreferrer"))
+		}
+	}
+}
+
+// whether a link to destination is rendered, only absolute links with an allowed scheme are
+func allowedLink(destination []byte) bool {
+	u, err := url.Parse(string(destination))
+	return err == nil && allowedLinkSchemes[strings.ToLower(u.Scheme)]
+}
+
+// whether one of n's ancestors is a link. links are rewritten before what they contain
+func insideLink(n ast.Node) bool {
+	for p := n.Parent(); p != nil; p = p.Parent() {
+		if _, ok := p.(*ast.Link); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func moveChildren(from ast.Node, to ast.Node) {
+	for child := from.FirstChild(); child != nil; child = from.FirstChild() {
+		to.AppendChild(to, child)
+	}
+}
+
+// replaces n by its children
+func unwrapNode(n ast.Node) {
+	parent := n.Parent()
+	for child := n.FirstChild(); child != nil; child = n.FirstChild() {
+		parent.InsertBefore(parent, n, child)
+	}
+	parent.RemoveChild(parent, n)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func renderMarkdown(t *testing.T, text string) string {
+	t.Helper()
+	message := SendMessageEvent{Message: text, Format: FormatMarkdown}
+	html, err := renderMessage(&message)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return html
+}
+
+func TestRenderMessageSubset(t *testing.T) {
+	for text, want := range map[string]string{
+		"**b** _i_ `c`": `<p><strong>b</strong> <em>i</em> <code>c</code></p>`,
+		"- a\n- b": "<ul>\n<li>a</li>\n<li>b</li>\n</ul>",
+		"[x](https://example.com)": `<p><a href="https://example.com" rel="nofollow noopener noreferrer">x</a></p>`,
+		"https://example.com/x": `<p><a href="https://example.com/x" rel="nofollow noopener noreferrer">https://example.com/x</a></p>`,
+		"![cat](https://example.com/cat.png)": `<p><a href="https://example.com/cat.png" rel="nofollow noopener noreferrer">cat</a></p>`,
+		// headings and quotes become paragraphs
+		"# Title\n\ntext": "<p>Title</p>\n<p>text</p>",
+		"> quote": `<p>quote</p>`,
+	} {
+		if got := renderMarkdown(t, text); got != want {
+			t.Errorf("render(%q) =\n%s\nwant\n%s", text, got, want)
+		}
+	}
+}
+
+func TestRenderMessageDropsUnsafeLinks(t *testing.T) {
+	for text, want := range map[string]string{
+		"[x](javascript:alert(1))": `<p>x</p>`,
+		"[x](JavaScript:alert(1))": `<p>x</p>`,
+		"[x](data:text/html,<script>alert(1)</script>)": `<p>x</p>`,
+		"![x](javascript:alert(1))": `<p>x</p>`,
+		"<javascript:alert(1)>": `<p>javascript:alert(1)</p>`,
+		"[x](/relative)": `<p>x</p>`,
+	} {
+		if got := renderMarkdown(t, text); got != want {
+			t.Errorf("render(%q) = %s, want %s", text, got, want)
+		}
+	}
+}
+
+func TestRenderMessageDropsRawHTML(t *testing.T) {
+	got := renderMarkdown(t, "<script>alert(1)</script>\n\nhi <b>bold</b> <img src=x onerror=alert(1)>")
+	if got != "<p>hi bold </p>" {
+		t.Errorf("render = %s, want the raw HTML dropped", got)
+	}
+}
+
+// anchors are never nested, an image inside a link becomes its text
+func TestRenderMessageImageInsideLink(t *testing.T) {
+	for _, text := range []string{
+		"[![logo](https://example.com/logo.png)](https://example.com)",
+		"[![logo ![icon](https://example.com/icon.png)](https://example.com/logo.png)](https://example.com)",
+	} {
+		got := renderMarkdown(t, text)
+		if strings.Count(got, "<a ") != 1 || !strings.Contains(got, `href="https://example.com"`) || strings.Contains(got, ".png") {
+			t.Errorf("render(%q) = %s, want a single link to https://example.com", text, got)
+		}
+	}
+}
+
+func TestRenderMessageFormats(t *testing.T) {
+	message := SendMessageEvent{Message: "**hi**"}
+	if html, err := renderMessage(&message); err != nil || html != "" || message.Format != FormatPlain {
+		t.Errorf("plain message = %q, %v, format %q", html, err, message.Format)
+	}
+	message = SendMessageEvent{Message: "**hi**", Format: FormatMarkdown, Encrypted: true}
+	if html, err := renderMessage(&message); err != nil || html != "" {
+		t.Errorf("encrypted message = %q, %v, want it left to the recipients", html, err)
+	}
+	message = SendMessageEvent{Message: "hi", Format: "html"}
+	if _, err := renderMessage(&message); err != ErrUnknownFormat {
+		t.Errorf("html format = %v, want %v", err, ErrUnknownFormat)
+	}
+}
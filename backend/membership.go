@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrRoomFull = errors.New("this room is full")
+	ErrAlreadyRoomMember = errors.New("already a member of this room")
+)
+
+// adds user to the room with the given role, announces it to the members
+// and sends the room to the new member's clients.
+// actor is who added them, empty when they joined by themselves
+func (h *Hub) addRoomMember(room *Room, user *User, role string, actor string) error {
+	// takes the place before the row is written, the room's goroutine decides who gets the last one
+	if err := room.join(user); err != nil {
+		return err
+	}
+	if err := h.db.addUserToRoom(user.id, room.id, role); err != nil {
+		room.unregister <- user
+		return err
+	}
+
+	message := SystemMessageEvent{
+		Action: "join",
+		Actor: actor,
+		Target: user.username,
+		Message: fmt.Sprintf("%s joined the room", user.username),
+	}
+	if actor != "" {
+		message.Message = fmt.Sprintf("%s added %s to the room", actor, user.username)
+	}
+	if err := room.sendSystemMessage(message); err != nil {
+		return err
+	}
+
+	hidden, err := h.db.getPresenceHiddenTo(user.id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(room.describeTo(user.id, hidden))
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventNewRoom
+	h.sendToUser(user.id, outgoingEvent)
+
+	h.webhooks.enqueue(room.id, WebhookMemberJoined, WebhookMemberEvent{RoomId: room.id, Username: user.username, Actor: actor})
+	return nil
+}
+
+// removes user from the room and announces it.
+// actor is who removed them, empty when they left by themselves
+func (h *Hub) removeRoomMember(room *Room, user *User, actor string) error {
+	if err := h.db.removeUserFromRoom(user.id, room.id); err != nil {
+		return err
+	}
+
+	message := SystemMessageEvent{
+		Action: "leave",
+		Target: user.username,
+		Message: fmt.Sprintf("%s left the room", user.username),
+	}
+	if actor != "" {
+		message.Action = "kick"
+		message.Actor = actor
+		message.Message = fmt.Sprintf("%s removed %s from the room", actor, user.username)
+	}
+	// announce before unregistering so the removed member is told too
+	if err := room.sendSystemMessage(message); err != nil {
+		return err
+	}
+	room.unregister <- user
+
+	h.webhooks.enqueue(room.id, WebhookMemberLeft, WebhookMemberEvent{RoomId: room.id, Username: user.username, Actor: actor})
+	return nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrTooManyAttempts = errors.New("too many wrong codes, try again later")
+)
+
+type totpCodeRequest struct {
+	Code string `json:"code"`
+}
+
+// starts TOTP enrollment for the authenticated user and returns the otpauth URI.
+// 2fa is only enabled once a code generated from the secret is confirmed
+func (h *Hub) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	user, err := h.db.getUser(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+	_, enabled, _, err := h.db.getTOTP(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		log.Println("Error generating TOTP secret: ", err)
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	err = h.db.setTOTPSecret(userId, secret)
+	if err != nil {
+		http.Error(w, "Error storing secret", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+	writeJSON(w, http.StatusOK, response{Secret: secret, URI: totpURI(user.username, secret)})
+}
+
+// enables 2fa once the user proves their authenticator holds the secret.
+// returns the recovery codes, which are only ever shown once
+func (h *Hub) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	secret, enabled, lastStep, err := h.db.getTOTP(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "Two-factor authentication is already enabled", http.StatusConflict)
+		return
+	}
+	if secret == "" {
+		http.Error(w, "No pending enrollment", http.StatusBadRequest)
+		return
+	}
+
+	step, ok := validateTOTP(secret, req.Code, time.Now(), lastStep)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	// claims the code's step, a concurrent request with the same code gets nothing
+	claimed, err := h.db.updateTOTPLastStep(userId, step)
+	if err != nil {
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	codes, err := generateRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		log.Println("Error generating recovery codes: ", err)
+		http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			http.Error(w, "Error generating recovery codes", http.StatusInternalServerError)
+			return
+		}
+		hashes[i] = string(hash)
+	}
+
+	if err := h.db.setRecoveryCodes(userId, hashes); err != nil {
+		http.Error(w, "Error storing recovery codes", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.setTOTPEnabled(userId, true); err != nil {
+		http.Error(w, "Error enabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	writeJSON(w, http.StatusOK, response{RecoveryCodes: codes})
+}
+
+// disables 2fa, requires a valid code or recovery code
+func (h *Hub) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	var req totpCodeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ok, err := h.verifySecondFactor(userId, req.Code)
+	if errors.Is(err, ErrTooManyAttempts) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error verifying code", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if err := h.db.setTOTPEnabled(userId, false); err != nil {
+		http.Error(w, "Error disabling two-factor authentication", http.StatusInternalServerError)
+		return
+	}
+	if err := h.db.setRecoveryCodes(userId, nil); err != nil {
+		http.Error(w, "Error removing recovery codes", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// second step of the login: exchanges the mfa pending token returned by
+// loginHandler and a valid code for an access token
+func (h *Hub) loginTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	type loginTOTPRequest struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	var req loginTOTPRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	claims, err := verifyMFAToken(req.MFAToken)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	userId, err := subjectId(claims)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ok, err := h.verifySecondFactor(userId, req.Code)
+	if errors.Is(err, ErrTooManyAttempts) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Credentials verification error", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	token, err := generateJWT(userId)
+	if err != nil {
+		log.Println("JWT token generation error: ", err)
+		http.Error(w, "Error generating token", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		Token string `json:"token"`
+	}
+	writeJSON(w, http.StatusOK, response{Token: token})
+}
+
+// checks a TOTP code, falling back to the user's unused recovery codes.
+// both are single use. returns ErrTooManyAttempts once the user entered too many wrong codes
+func (h *Hub) verifySecondFactor(userId int, code string) (bool, error) {
+	if !h.secondFactorAttempts.attempt(userId, time.Now()) {
+		return false, ErrTooManyAttempts
+	}
+	ok, err := h.checkSecondFactor(userId, code)
+	if ok {
+		h.secondFactorAttempts.reset(userId)
+	}
+	return ok, err
+}
+
+func (h *Hub) checkSecondFactor(userId int, code string) (bool, error) {
+	secret, enabled, lastStep, err := h.db.getTOTP(userId)
+	if err != nil {
+		return false, err
+	}
+	if !enabled {
+		return false, nil
+	}
+
+	if step, ok := validateTOTP(secret, code, time.Now(), lastStep); ok {
+		return h.db.updateTOTPLastStep(userId, step)
+	}
+
+	codes, err := h.db.getRecoveryCodes(userId)
+	if err != nil {
+		return false, err
+	}
+	code = normalizeRecoveryCode(code)
+	for id, hash := range codes {
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			return h.db.useRecoveryCode(id)
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// remove a member from a room
+	EventKickMember = "kick_member"
+	// prevent a member from sending messages for a while
+	EventMuteMember = "mute_member"
+	// pin a message of the room
+	EventPinMessage = "pin_message"
+	// unpin a message of the room
+	EventUnpinMessage = "unpin_message"
+	// delete a message, moderators can delete other members' messages
+	EventDeleteMessage = "delete_message"
+	// promote or demote a member
+	EventSetRole = "set_role"
+	// give the room to another member
+	EventTransferOwnership = "transfer_ownership"
+)
+
+// longest mute a moderator can give
+const maxMuteDuration = 30 * 24 * time.Hour
+
+var (
+	ErrInsufficientRole = errors.New("your role in this room does not allow this")
+	ErrNotRoomOwner = errors.New("only the room owner can do this")
+)
+
+type ModerateMemberEvent struct {
+	RoomId   int    `json:"room_id"`
+	Username string `json:"username"`
+}
+
+type MuteMemberEvent struct {
+	RoomId   int    `json:"room_id"`
+	Username string `json:"username"`
+	// Go duration such as "10m" or "2h", "0s" lifts the mute
+	Duration string `json:"duration"`
+}
+
+type MessageActionEvent struct {
+	RoomId    int `json:"room_id"`
+	MessageId int `json:"message_id"`
+}
+
+type SetRoleEvent struct {
+	RoomId   int    `json:"room_id"`
+	Username string `json:"username"`
+	Role     string `json:"role"`
+}
+
+// returns the room and the caller's role, checking the caller is at least minRole
+func moderatorRole(c *Client, roomId int, minRole string) (*Room, string, error) {
+	room, ok := c.hub.getRoom(roomId)
+	if !ok {
+		return nil, "", RoomNotFoundError
+	}
+	role, err := c.hub.db.getRoomRole(roomId, c.user.id)
+	if err != nil {
+		return nil, "", err
+	}
+	if roleRank(role) < roleRank(minRole) {
+		return nil, "", ErrInsufficientRole
+	}
+	return room, role, nil
+}
+
+// checks the caller outranks the member named username in the room and returns them
+func checkOutranks(c *Client, roomId int, role string, username string) (*User, error) {
+	target, err := c.hub.db.getUserByUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if target.id == c.user.id {
+		return nil, fmt.Errorf("you can't do this to yourself")
+	}
+	targetRole, err := c.hub.db.getRoomRole(roomId, target.id)
+	if err != nil {
+		return nil, err
+	}
+	if roleRank(targetRole) >= roleRank(role) {
+		return nil, ErrInsufficientRole
+	}
+	return target, nil
+}
+
+func KickMemberHandler(event Event, c *Client) error {
+	var e ModerateMemberEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, role, err := moderatorRole(c, e.RoomId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	target, err := checkOutranks(c, e.RoomId, role, e.Username)
+	if err != nil {
+		return err
+	}
+
+	return c.hub.removeRoomMember(room, target, c.user.username)
+}
+
+func MuteMemberHandler(event Event, c *Client) error {
+	var e MuteMemberEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	duration, err := time.ParseDuration(e.Duration)
+	if err != nil {
+		return fmt.Errorf("bad mute duration: %v", err)
+	}
+	if duration < 0 || duration > maxMuteDuration {
+		return fmt.Errorf("mute duration must be between 0 and %s", maxMuteDuration)
+	}
+
+	room, role, err := moderatorRole(c, e.RoomId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	target, err := checkOutranks(c, e.RoomId, role, e.Username)
+	if err != nil {
+		return err
+	}
+
+	message := SystemMessageEvent{
+		Actor: c.user.username,
+		Target: e.Username,
+	}
+	var until time.Time
+	if duration == 0 {
+		message.Action = "unmute"
+		message.Message = fmt.Sprintf("%s unmuted %s", c.user.username, e.Username)
+	} else {
+		until = time.Now().Add(duration)
+		message.Action = "mute"
+		message.Until = &until
+		message.Message = fmt.Sprintf("%s muted %s for %s", c.user.username, e.Username, duration)
+	}
+
+	if err := c.hub.db.setMutedUntil(e.RoomId, target.id, until); err != nil {
+		return err
+	}
+	return room.sendSystemMessage(message)
+}
+
+// returns the message, checking it belongs to the room
+func roomMessage(c *Client, roomId int, messageId int) (NewMessageEvent, error) {
+	message, err := c.hub.db.getMessage(messageId)
+	if err != nil {
+		return message, err
+	}
+	if message.RoomId != roomId {
+		return message, MessageNotFoundError
+	}
+	return message, nil
+}
+
+func PinMessageHandler(event Event, c *Client) error {
+	var e MessageActionEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, _, err := moderatorRole(c, e.RoomId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+	if _, err := roomMessage(c, e.RoomId, e.MessageId); err != nil {
+		return err
+	}
+
+	if err := c.hub.db.pinMessage(e.RoomId, e.MessageId, c.user.id); err != nil {
+		return err
+	}
+	if err := room.sendSystemMessage(SystemMessageEvent{
+		Action: "pin",
+		Actor: c.user.username,
+		MessageId: e.MessageId,
+		Message: fmt.Sprintf("%s pinned a message", c.user.username),
+	}); err != nil {
+		return err
+	}
+	return room.broadcastPins()
+}
+
+func UnpinMessageHandler(event Event, c *Client) error {
+	var e MessageActionEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, _, err := moderatorRole(c, e.RoomId, RoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	if err := c.hub.db.unpinMessage(e.RoomId, e.MessageId); err != nil {
+		return err
+	}
+	if err := room.sendSystemMessage(SystemMessageEvent{
+		Action: "unpin",
+		Actor: c.user.username,
+		MessageId: e.MessageId,
+		Message: fmt.Sprintf("%s unpinned a message", c.user.username),
+	}); err != nil {
+		return err
+	}
+	return room.broadcastPins()
+}
+
+// members can delete their own messages, moderators the messages of members they outrank
+func DeleteMessageHandler(event Event, c *Client) error {
+	var e MessageActionEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, role, err := moderatorRole(c, e.RoomId, RoleMember)
+	if err != nil {
+		return err
+	}
+	message, err := roomMessage(c, e.RoomId, e.MessageId)
+	if err != nil {
+		return err
+	}
+
+	if message.FromId != c.user.id {
+		if roleRank(role) < roleRank(RoleAdmin) {
+			return ErrInsufficientRole
+		}
+		// authors that left the room can't outrank anyone
+		authorRole, err := c.hub.db.getRoomRole(e.RoomId, message.FromId)
+		if err != nil && !errors.Is(err, NotRoomMemberError) {
+			return err
+		}
+		if roleRank(authorRole) >= roleRank(role) {
+			return ErrInsufficientRole
+		}
+	}
+
+	// its pin goes away with it
+	pinned, err := c.hub.db.isMessagePinned(e.MessageId)
+	if err != nil {
+		return err
+	}
+	if err := c.hub.db.deleteMessage(e.MessageId); err != nil {
+		return err
+	}
+	lastMessage := c.hub.db.getLastRoomMessage(e.RoomId)
+	room.updateLastMessage <- func(last *NewMessageEvent) {
+		if last.Id == e.MessageId {
+			*last = lastMessage
+		}
+	}
+
+	if err := room.sendSystemMessage(SystemMessageEvent{
+		Action: "delete_message",
+		Actor: c.user.username,
+		Target: message.From,
+		MessageId: e.MessageId,
+		Message: fmt.Sprintf("%s deleted a message", c.user.username),
+	}); err != nil {
+		return err
+	}
+	if pinned {
+		return room.broadcastPins()
+	}
+	return nil
+}
+
+// the owner promotes members to admin or demotes admins
+func SetRoleHandler(event Event, c *Client) error {
+	var e SetRoleEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if e.Role != RoleAdmin && e.Role != RoleMember {
+		return fmt.Errorf("role must be %q or %q, use transfer_ownership to change the owner", RoleAdmin, RoleMember)
+	}
+
+	room, role, err := moderatorRole(c, e.RoomId, RoleOwner)
+	if errors.Is(err, ErrInsufficientRole) {
+		return ErrNotRoomOwner
+	}
+	if err != nil {
+		return err
+	}
+	target, err := checkOutranks(c, e.RoomId, role, e.Username)
+	if err != nil {
+		return err
+	}
+
+	if err := c.hub.db.setRoomRole(target.id, e.RoomId, e.Role); err != nil {
+		return err
+	}
+	return room.sendSystemMessage(SystemMessageEvent{
+		Action: "set_role",
+		Actor: c.user.username,
+		Target: e.Username,
+		Message: fmt.Sprintf("%s made %s %s", c.user.username, e.Username, e.Role),
+	})
+}
+
+func TransferOwnershipHandler(event Event, c *Client) error {
+	var e ModerateMemberEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, _, err := moderatorRole(c, e.RoomId, RoleOwner)
+	if errors.Is(err, ErrInsufficientRole) {
+		return ErrNotRoomOwner
+	}
+	if err != nil {
+		return err
+	}
+	target, err := c.hub.db.getUserByUsername(e.Username)
+	if err != nil {
+		return err
+	}
+	if target.id == c.user.id {
+		return fmt.Errorf("you already own this room")
+	}
+	if _, err := c.hub.db.getRoomRole(e.RoomId, target.id); err != nil {
+		return err
+	}
+
+	if err := c.hub.db.transferRoomOwnership(e.RoomId, c.user.id, target.id); err != nil {
+		return err
+	}
+	return room.sendSystemMessage(SystemMessageEvent{
+		Action: "transfer_ownership",
+		Actor: c.user.username,
+		Target: e.Username,
+		Message: fmt.Sprintf("%s transferred ownership of the room to %s", c.user.username, e.Username),
+	})
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"regexp"
+	"time"
+)
+
+const (
+	// get the user's notifications
+	EventGetNotifications = "get_notifications"
+	// response to get_notifications
+	EventNotifications = "notifications"
+	// mark one or every notification as read
+	EventMarkNotificationRead = "mark_notification_read"
+	// response to mark_notification_read
+	EventNotificationRead = "notification_read"
+	// new notification, pushed to every client of the user
+	EventNotification = "notification"
+	// choose which messages of a room notify the user
+	EventSetNotificationLevel = "set_notification_level"
+	// response to set_notification_level
+	EventNotificationLevel = "notification_level"
+)
+
+// notification levels of a room
+const (
+	NotifyAll = "all"
+	NotifyMentions = "mentions"
+	NotifyMuted = "muted"
+)
+
+// kinds of notification
+const (
+	NotificationMention = "mention"
+	NotificationMessage = "message"
+)
+
+const (
+	// characters of the message kept in a notification
+	notificationPreviewLength = 140
+
+	defaultNotificationsPage = 50
+	maxNotificationsPage = 100
+
+	// messages waiting for a notifier worker, more are dropped
+	notifyQueueSize = 1024
+	notifyWorkers = 4
+)
+
+// @username, not preceded by a word character so e-mail addresses don't match
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@])@([A-Za-z0-9_.-]+)`)
+
+// a mention of "@room" notifies every member
+const roomMention = "room"
+
+type Notification struct {
+	Id        int       `json:"id"`
+	Kind      string    `json:"kind"`
+	RoomId    int       `json:"room_id"`
+	MessageId int       `json:"message_id"`
+	Actor     string    `json:"actor"`
+	Preview   string    `json:"preview"`
+	Read      bool      `json:"read"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// who is notified and who caused it
+	userId int
+	actorId int
+}
+
+// a member of a room, as the notifier sees them
+type notificationTarget struct {
+	userId int
+	username string
+	level string
+}
+
+// a member mentioned by a message
+type Mention struct {
+	userId int
+	// mentioned through @room rather than by name
+	roomMention bool
+}
+
+type GetNotificationsEvent struct {
+	// only return notifications older than this id, for pagination
+	Before     int  `json:"before"`
+	Limit      int  `json:"limit"`
+	UnreadOnly bool `json:"unread_only"`
+}
+
+type NotificationsEvent struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+}
+
+type MarkNotificationReadEvent struct {
+	// 0 marks every notification
+	Id int `json:"id"`
+}
+
+type NotificationReadEvent struct {
+	Id     int `json:"id"`
+	Unread int `json:"unread"`
+}
+
+type NotificationLevelEvent struct {
+	RoomId int    `json:"room_id"`
+	Level  string `json:"level"`
+}
+
+// returns the mentioned usernames and whether @room was used
+func parseMentions(text string) (map[string]bool, bool) {
+	usernames := make(map[string]bool)
+	everyone := false
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if match[1] == roomMention {
+			everyone = true
+			continue
+		}
+		usernames[match[1]] = true
+	}
+	return usernames, everyone
+}
+
+type notifyJob struct {
+	room *Room
+	message NewMessageEvent
+}
+
+// Notifier stores the mentions and notifications of the messages posted, off the path of the sender
+type Notifier struct {
+	hub *Hub
+
+	jobs chan notifyJob
+}
+
+func newNotifier(h *Hub) *Notifier {
+	return &Notifier{
+		hub: h,
+		jobs: make(chan notifyJob, notifyQueueSize),
+	}
+}
+
+// starts the workers, they stop when ctx is cancelled
+func (n *Notifier) run(ctx context.Context) {
+	for i := 0; i < notifyWorkers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-n.jobs:
+					n.notify(job.room, job.message)
+				}
+			}
+		}()
+	}
+}
+
+// queues the message. never blocks, the message notifies no one if the queue is full
+func (n *Notifier) enqueue(room *Room, message NewMessageEvent) {
+	select {
+	case n.jobs <- notifyJob{room: room, message: message}:
+	default:
+		log.Println("Notification queue full, dropping notifications of message ", message.Id)
+	}
+}
+
+// persists the message's mentions and notifies the members of the room according to their notification level.
+// failures are logged, the message was already sent
+func (n *Notifier) notify(room *Room, message NewMessageEvent) {
+	h := n.hub
+	// the server can't read encrypted messages: no mentions, and notifications have no preview
+	mentioned, everyone := map[string]bool{}, false
+	if !message.Encrypted {
+		mentioned, everyone = parseMentions(message.Message)
+	}
+
+	members, err := h.db.getNotificationTargets(room.id)
+	if err != nil {
+		log.Println("Error retrieving notification levels: ", err)
+		return
+	}
+	// members that blocked the author are never notified by them
+	blockers, err := h.db.getBlockers(message.FromId)
+	if err != nil {
+		log.Println("Error retrieving blockers: ", err)
+		return
+	}
+
+	preview := []rune(message.Message)
+	if len(preview) > notificationPreviewLength {
+		preview = append(preview[:notificationPreviewLength], '…')
+	}
+
+	var mentions []Mention
+	var notifications []Notification
+	for _, member := range members {
+		if member.userId == message.FromId {
+			continue
+		}
+
+		mentionedByName := mentioned[member.username]
+		isMention := everyone || mentionedByName
+		if isMention {
+			mentions = append(mentions, Mention{userId: member.userId, roomMention: !mentionedByName})
+		}
+
+		if blockers[member.userId] || member.level == NotifyMuted || (member.level == NotifyMentions && !isMention) {
+			continue
+		}
+
+		notification := Notification{
+			Kind: NotificationMessage,
+			RoomId: room.id,
+			MessageId: message.Id,
+			Actor: message.From,
+			Preview: string(preview),
+			userId: member.userId,
+			actorId: message.FromId,
+		}
+		if isMention {
+			notification.Kind = NotificationMention
+		}
+		notifications = append(notifications, notification)
+	}
+
+	if err := h.db.addMentions(message.Id, mentions); err != nil {
+		log.Println("Error storing mentions: ", err)
+	}
+	if err := h.db.addNotifications(notifications); err != nil {
+		log.Println("Error storing notifications: ", err)
+		return
+	}
+
+	for _, notification := range notifications {
+		data, err := json.Marshal(notification)
+		if err != nil {
+			log.Println("Error marshalling notification: ", err)
+			continue
+		}
+		var outgoingEvent Event
+		outgoingEvent.Payload = data
+		outgoingEvent.Type = EventNotification
+		h.sendToUser(notification.userId, outgoingEvent)
+		h.pushNotification(notification, string(preview))
+	}
+}
+
+func GetNotificationsHandler(event Event, c *Client) error {
+	var e GetNotificationsEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if e.Limit <= 0 {
+		e.Limit = defaultNotificationsPage
+	}
+	e.Limit = min(e.Limit, maxNotificationsPage)
+
+	notifications, err := c.hub.db.getNotifications(c.user.id, e.Before, e.Limit, e.UnreadOnly)
+	if err != nil {
+		return err
+	}
+	unread, err := c.hub.db.countUnreadNotifications(c.user.id)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(NotificationsEvent{Notifications: notifications, Unread: unread})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventNotifications
+	c.send <- outgoingEvent
+	return nil
+}
+
+func MarkNotificationReadHandler(event Event, c *Client) error {
+	var e MarkNotificationReadEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	if err := c.hub.db.markNotificationsRead(c.user.id, e.Id); err != nil {
+		return err
+	}
+	unread, err := c.hub.db.countUnreadNotifications(c.user.id)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(NotificationReadEvent{Id: e.Id, Unread: unread})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	// every client of the user updates its unread count
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventNotificationRead
+	c.hub.sendToUser(c.user.id, outgoingEvent)
+	return nil
+}
+
+func SetNotificationLevelHandler(event Event, c *Client) error {
+	var e NotificationLevelEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	switch e.Level {
+	case NotifyAll, NotifyMentions, NotifyMuted:
+	default:
+		return fmt.Errorf("notification level must be %q, %q or %q", NotifyAll, NotifyMentions, NotifyMuted)
+	}
+
+	if err := c.hub.db.setNotificationLevel(e.RoomId, c.user.id, e.Level); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventNotificationLevel
+	c.hub.sendToUser(c.user.id, outgoingEvent)
+	return nil
+}
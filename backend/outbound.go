@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	errBlockedAddress = errors.New("URL points to a private address")
+)
+
+// networks that are not reachable from the internet, or that reach back into it, besides
+// what netip.Addr already classifies
+var blockedPrefixes = []netip.Prefix{
+	// shared address space of carrier-grade NAT
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	// documentation and benchmarking
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	// NAT64 and 6to4 can embed any IPv4 address
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("64:ff9b:1::/48"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+
+// whether addr can be reached by requests to URLs users gave. only public unicast addresses can
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() || addr.IsLoopback() || addr.IsLinkLocalUnicast() {
+		return false
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// fails when the host of the URL is an IP address that isn't public. hostnames are only
+// checked when connecting, this lets users know early about the obvious cases
+func checkPublicHost(target *url.URL) error {
+	if addr, err := netip.ParseAddr(target.Hostname()); err == nil && !isPublicAddr(addr) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// addrFilter keeps the requests sent to URLs users gave, link previews, webhooks and
+// push endpoints, away from the server's own network. the address is checked when
+// connecting, after DNS resolution, so neither a hostname nor a redirect can get around it
+type addrFilter struct {
+	// addresses that may be connected to, tests can allow loopback to reach an httptest server
+	allowAddr func(netip.Addr) bool
+}
+
+// refuses connections to addresses allowAddr rejects
+func (f *addrFilter) checkAddr(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !f.allowAddr(addr) {
+		return errBlockedAddress
+	}
+	return nil
+}
+
+// returns a transport whose connections are checked by the filter
+func (f *addrFilter) transport(timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: f.checkAddr,
+	}
+	return &http.Transport{
+		// a proxy would be connected to instead of the URL's host
+		Proxy: nil,
+		DialContext: dialer.DialContext,
+		TLSHandshakeTimeout: timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns: 16,
+		IdleConnTimeout: 90 * time.Second,
+	}
+}
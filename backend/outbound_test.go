@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// a filter that lets requests reach httptest servers, on loopback, and public addresses only
+func testAddrFilter() addrFilter {
+	return addrFilter{allowAddr: func(addr netip.Addr) bool {
+		return addr.IsLoopback() || isPublicAddr(addr)
+	}}
+}
+
+func TestAddrFilterRefusesPrivateAddresses(t *testing.T) {
+	reached := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	defer server.Close()
+
+	// the filter as the server builds it, loopback isn't allowed
+	filter := addrFilter{allowAddr: isPublicAddr}
+	client := &http.Client{Transport: filter.transport(time.Second)}
+	_, err := client.Get(server.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("get %s = %v, want %v", server.URL, err, errBlockedAddress)
+	}
+	if reached {
+		t.Error("request reached a loopback server")
+	}
+
+	filter = testAddrFilter()
+	client = &http.Client{Transport: filter.transport(time.Second)}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("get %s with loopback allowed = %v", server.URL, err)
+	}
+	resp.Body.Close()
+}
+
+func TestIsPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34": true,
+		"2606:2800:220:1::1": true,
+		"127.0.0.1": false,
+		"10.1.2.3": false,
+		"172.16.0.1": false,
+		"192.168.1.1": false,
+		"169.254.169.254": false,
+		"100.64.0.1": false,
+		"0.0.0.0": false,
+		"::1": false,
+		"fe80::1": false,
+		"fd00::1": false,
+		"::ffff:127.0.0.1": false,
+		"64:ff9b::a00:1": false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("isPublicAddr(%s) = %v, want %v", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+const (
+	// get the messages pinned in a room
+	EventGetPins = "get_pins"
+	// response to get_pins, also sent to the members whenever the room's pins change
+	EventPinsUpdated = "pins_updated"
+	// bookmark a message for ourselves
+	EventSaveMessage = "save_message"
+	// remove a message from our saved messages
+	EventUnsaveMessage = "unsave_message"
+	// get our saved messages
+	EventGetSaved = "get_saved"
+	// response to get_saved, save_message and unsave_message
+	EventSavedMessages = "saved_messages"
+)
+
+type PinnedMessage struct {
+	NewMessageEvent
+	// username of who pinned it
+	PinnedBy string `json:"pinned_by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// a message the user saved, only they can see it
+type SavedMessage struct {
+	NewMessageEvent
+	SavedAt time.Time `json:"saved_at"`
+}
+
+type PinsUpdatedEvent struct {
+	RoomId int `json:"room_id"`
+	// the latest pin first
+	Pins []PinnedMessage `json:"pins"`
+}
+
+type SavedMessagesEvent struct {
+	// the latest saved first
+	Messages []SavedMessage `json:"messages"`
+}
+
+type SaveMessageEvent struct {
+	MessageId int `json:"message_id"`
+}
+
+func GetPinsHandler(event Event, c *Client) error {
+	var e RoomIdEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if _, ok := c.hub.getRoom(e.RoomId); !ok {
+		return RoomNotFoundError
+	}
+	if _, err := c.hub.db.getRoomRole(e.RoomId, c.user.id); err != nil {
+		return err
+	}
+
+	outgoingEvent, err := pinsUpdatedEvent(c.hub, e.RoomId)
+	if err != nil {
+		return err
+	}
+	c.send <- outgoingEvent
+	return nil
+}
+
+// sends the room's pins to its members
+func (r *Room) broadcastPins() error {
+	outgoingEvent, err := pinsUpdatedEvent(r.hub, r.id)
+	if err != nil {
+		return err
+	}
+	r.broadcast <- outgoingEvent
+	return nil
+}
+
+func pinsUpdatedEvent(h *Hub, roomId int) (Event, error) {
+	var outgoingEvent Event
+	pins, err := h.db.getPinnedMessages(roomId)
+	if err != nil {
+		return outgoingEvent, err
+	}
+	data, err := json.Marshal(PinsUpdatedEvent{RoomId: roomId, Pins: pins})
+	if err != nil {
+		return outgoingEvent, fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventPinsUpdated
+	return outgoingEvent, nil
+}
+
+func SaveMessageHandler(event Event, c *Client) error {
+	var e SaveMessageEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	message, err := c.hub.db.getMessage(e.MessageId)
+	if err != nil {
+		return err
+	}
+	// only members can read the message in the first place
+	if _, err := c.hub.db.getRoomRole(message.RoomId, c.user.id); err != nil {
+		return err
+	}
+
+	if err := c.hub.db.saveMessage(c.user.id, message.Id); err != nil {
+		return err
+	}
+	return c.hub.sendSavedMessages(c.user.id)
+}
+
+func UnsaveMessageHandler(event Event, c *Client) error {
+	var e SaveMessageEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := c.hub.db.unsaveMessage(c.user.id, e.MessageId); err != nil {
+		return err
+	}
+	return c.hub.sendSavedMessages(c.user.id)
+}
+
+func GetSavedHandler(event Event, c *Client) error {
+	return c.hub.sendSavedMessages(c.user.id)
+}
+
+// sends their saved messages to every client of the user, so they stay in sync
+func (h *Hub) sendSavedMessages(userId int) error {
+	messages, err := h.db.getSavedMessages(userId)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(SavedMessagesEvent{Messages: messages})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventSavedMessages
+	h.sendToUser(userId, outgoingEvent)
+	return nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+const (
+	// the previews of the links of a message, sent to the room's members once they are fetched
+	EventMessagePreview = "message_preview"
+)
+
+const (
+	// messages waiting for their links to be previewed
+	unfurlQueueSize = 256
+
+	// links longer than this are not previewed
+	maxPreviewURLLength = 2048
+
+	// redirects followed when fetching a link
+	maxPreviewRedirects = 5
+
+	// fields of a preview are cut to these lengths
+	maxPreviewTitleLength = 300
+	maxPreviewDescriptionLength = 1000
+)
+
+var (
+	errNotPreviewable = errors.New("link has no preview")
+)
+
+// http and https links, trailing punctuation is trimmed by extractLinks
+var linkPattern = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"'` + "`" + `]+`)
+
+// the preview of a link, without a title when it couldn't be previewed
+type LinkPreview struct {
+	URL string `json:"url"`
+	Title string `json:"title"`
+	Description string `json:"description,omitempty"`
+	SiteName string `json:"site_name,omitempty"`
+	// absolute http or https URL
+	Image string `json:"image,omitempty"`
+}
+
+type MessagePreviewEvent struct {
+	RoomId int `json:"room_id"`
+	MessageId int `json:"message_id"`
+	Previews []LinkPreview `json:"previews"`
+}
+
+type unfurlJob struct {
+	room *Room
+	message NewMessageEvent
+}
+
+// where previews are kept between fetches, the database outside of tests
+type previewCache interface {
+	// returns the preview of url if it was stored less than ttl ago
+	getLinkPreview(url string, ttl time.Duration) (LinkPreview, bool, error)
+	setLinkPreview(preview LinkPreview) error
+	// deletes the previews stored more than ttl ago
+	pruneLinkPreviews(ttl time.Duration) error
+}
+
+// LinkUnfurler previews the links of the messages posted in unencrypted rooms.
+// previews are best effort: a full queue or a failed fetch only means no preview
+type LinkUnfurler struct {
+	cache previewCache
+
+	config PreviewConfig
+
+	fetcher *linkFetcher
+
+	jobs chan unfurlJob
+}
+
+// returns nil when previews are disabled
+func newLinkUnfurler(db *Database, config PreviewConfig) *LinkUnfurler {
+	if !config.Enabled {
+		return nil
+	}
+	return &LinkUnfurler{
+		cache: db,
+		config: config,
+		fetcher: newLinkFetcher(config),
+		jobs: make(chan unfurlJob, unfurlQueueSize),
+	}
+}
+
+// starts the workers and the cache pruning, they stop when ctx is cancelled
+func (u *LinkUnfurler) run(ctx context.Context) {
+	for i := 0; i < u.config.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-u.jobs:
+					u.unfurl(ctx, job)
+				}
+			}
+		}()
+	}
+	go func() {
+		ticker := time.NewTicker(time.Duration(u.config.CacheTTL))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := u.cache.pruneLinkPreviews(time.Duration(u.config.CacheTTL)); err != nil {
+					log.Println("Error pruning link previews: ", err)
+				}
+			}
+		}
+	}()
+}
+
+// queues the message if it has links. never blocks, the message is dropped if the queue is full
+func (u *LinkUnfurler) enqueue(room *Room, message NewMessageEvent) {
+	if message.Encrypted || !linkPattern.MatchString(message.Message) {
+		return
+	}
+	select {
+	case u.jobs <- unfurlJob{room: room, message: message}:
+	default:
+		log.Println("Preview queue full, dropping previews of message ", message.Id)
+	}
+}
+
+// previews the links of the message and sends the previews to the room
+func (u *LinkUnfurler) unfurl(ctx context.Context, job unfurlJob) {
+	var previews []LinkPreview
+	for _, link := range extractLinks(job.message.Message, u.config.MaxLinks) {
+		if preview, ok := u.preview(ctx, link); ok {
+			previews = append(previews, preview)
+		}
+	}
+	if len(previews) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(MessagePreviewEvent{RoomId: job.room.id, MessageId: job.message.Id, Previews: previews})
+	if err != nil {
+		log.Println("failed to marshal broadcast message: ", err)
+		return
+	}
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventMessagePreview
+	job.room.broadcast <- outgoingEvent
+}
+
+// returns the preview of the link from the cache, fetching it when it isn't cached
+func (u *LinkUnfurler) preview(ctx context.Context, link string) (LinkPreview, bool) {
+	ttl := time.Duration(u.config.CacheTTL)
+	preview, found, err := u.cache.getLinkPreview(link, ttl)
+	if err != nil {
+		log.Println("Error retrieving link preview: ", err)
+		return preview, false
+	}
+	if found {
+		return preview, preview.Title != ""
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(u.config.Timeout))
+	defer cancel()
+	preview, err = u.fetcher.fetch(ctx, link)
+	if err != nil {
+		// failures are cached too, so a broken link isn't fetched for every message
+		preview = LinkPreview{URL: link}
+	}
+	if err := u.cache.setLinkPreview(preview); err != nil {
+		log.Println("Error caching link preview: ", err)
+	}
+	return preview, preview.Title != ""
+}
+
+// returns the distinct http and https links of text, at most limit
+func extractLinks(text string, limit int) []string {
+	var links []string
+	seen := map[string]bool{}
+	for _, match := range linkPattern.FindAllString(text, -1) {
+		match = strings.TrimRight(match, ".,;:!?")
+		// a closing parenthesis is part of the link only if it opened one
+		for strings.HasSuffix(match, ")") && strings.Count(match, "(") < strings.Count(match, ")") {
+			match = strings.TrimSuffix(match, ")")
+		}
+		if len(match) > maxPreviewURLLength {
+			continue
+		}
+		u, err := url.Parse(match)
+		if err != nil || u.Host == "" || u.User != nil {
+			continue
+		}
+		u.Fragment = ""
+		link := u.String()
+		if seen[link] {
+			continue
+		}
+		seen[link] = true
+		links = append(links, link)
+		if len(links) == limit {
+			break
+		}
+	}
+	return links
+}
+
+// linkFetcher reads the OpenGraph and oEmbed metadata of links.
+// its addrFilter keeps it, and the redirects it follows, away from private addresses
+type linkFetcher struct {
+	addrFilter
+
+	client *http.Client
+
+	maxBodySize int64
+}
+
+func newLinkFetcher(config PreviewConfig) *linkFetcher {
+	f := &linkFetcher{
+		addrFilter: addrFilter{allowAddr: isPublicAddr},
+		maxBodySize: config.MaxBodySize,
+	}
+	timeout := time.Duration(config.Timeout)
+	f.client = &http.Client{
+		Timeout: timeout,
+		Transport: f.transport(timeout),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxPreviewRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxPreviewRedirects)
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("redirect to unsupported scheme %q", req.URL.Scheme)
+			}
+			return nil
+		},
+	}
+	return f
+}
+
+// GETs the link and returns the body, at most maxBodySize bytes of it, if its type is one of types
+func (f *linkFetcher) get(ctx context.Context, link string, accept string, types ...string) ([]byte, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return nil, nil, fmt.Errorf("unsupported scheme %q", req.URL.Scheme)
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "gochat-link-preview/1.0")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	supported := false
+	for _, t := range types {
+		supported = supported || mediaType == t
+	}
+	if !supported {
+		return nil, nil, errNotPreviewable
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, f.maxBodySize))
+	if err != nil {
+		return nil, nil, err
+	}
+	// the final URL, after redirects, is what relative URLs resolve against
+	return body, resp.Request.URL, nil
+}
+
+// fetches the page and builds its preview from its OpenGraph tags,
+// falling back to its oEmbed endpoint and its plain HTML metadata
+func (f *linkFetcher) fetch(ctx context.Context, link string) (LinkPreview, error) {
+	preview := LinkPreview{URL: link}
+	body, base, err := f.get(ctx, link, "text/html,application/xhtml+xml", "text/html", "application/xhtml+xml")
+	if err != nil {
+		return preview, err
+	}
+	meta := parsePageMeta(body)
+
+	preview.Title = firstNonEmpty(meta.properties["og:title"], meta.properties["twitter:title"])
+	preview.Description = firstNonEmpty(meta.properties["og:description"], meta.properties["twitter:description"], meta.properties["description"])
+	preview.SiteName = meta.properties["og:site_name"]
+	image := firstNonEmpty(meta.properties["og:image"], meta.properties["og:image:url"], meta.properties["twitter:image"])
+
+	if (preview.Title == "" || image == "") && meta.oembed != "" {
+		if oembedURL, err := base.Parse(meta.oembed); err == nil {
+			if oembed, err := f.fetchOEmbed(ctx, oembedURL.String()); err == nil {
+				preview.Title = firstNonEmpty(preview.Title, oembed.Title)
+				preview.SiteName = firstNonEmpty(preview.SiteName, oembed.ProviderName)
+				image = firstNonEmpty(image, oembed.ThumbnailURL)
+			}
+		}
+	}
+	preview.Title = firstNonEmpty(preview.Title, meta.title)
+	if preview.Title == "" {
+		return preview, errNotPreviewable
+	}
+
+	if image != "" {
+		if imageURL, err := base.Parse(image); err == nil && (imageURL.Scheme == "http" || imageURL.Scheme == "https") {
+			preview.Image = imageURL.String()
+		}
+	}
+	preview.Title = truncateText(preview.Title, maxPreviewTitleLength)
+	preview.Description = truncateText(preview.Description, maxPreviewDescriptionLength)
+	preview.SiteName = truncateText(preview.SiteName, maxPreviewTitleLength)
+	return preview, nil
+}
+
+// the fields of an oEmbed response a preview uses, its html is never relayed
+type oEmbedResponse struct {
+	Title string `json:"title"`
+	ProviderName string `json:"provider_name"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+func (f *linkFetcher) fetchOEmbed(ctx context.Context, link string) (oEmbedResponse, error) {
+	var oembed oEmbedResponse
+	body, _, err := f.get(ctx, link, "application/json", "application/json", "application/json+oembed", "text/javascript")
+	if err != nil {
+		return oembed, err
+	}
+	err = json.Unmarshal(body, &oembed)
+	return oembed, err
+}
+
+// what parsePageMeta finds in the head of a page
+type pageMeta struct {
+	// content of the meta tags by property or name, lowercased
+	properties map[string]string
+	title string
+	// href of the JSON oEmbed discovery link
+	oembed string
+}
+
+// reads the meta tags, title and oEmbed discovery link of an HTML page, stopping at its body
+func parsePageMeta(body []byte) pageMeta {
+	meta := pageMeta{properties: map[string]string{}}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	inTitle := false
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return meta
+		case html.TextToken:
+			if inTitle && meta.title == "" {
+				meta.title = string(z.Text())
+			}
+		case html.EndTagToken:
+			if name, _ := z.TagName(); atom.Lookup(name) == atom.Title {
+				inTitle = false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			attrs := map[string]string{}
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = z.TagAttr()
+				attrs[string(key)] = string(value)
+			}
+			switch atom.Lookup(name) {
+			case atom.Body:
+				return meta
+			case atom.Title:
+				inTitle = true
+			case atom.Meta:
+				key := strings.ToLower(firstNonEmpty(attrs["property"], attrs["name"]))
+				if _, ok := meta.properties[key]; key != "" && !ok {
+					meta.properties[key] = attrs["content"]
+				}
+			case atom.Link:
+				if strings.EqualFold(attrs["rel"], "alternate") && strings.EqualFold(attrs["type"], "application/json+oembed") && meta.oembed == "" {
+					meta.oembed = attrs["href"]
+				}
+			}
+		}
+	}
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v = strings.TrimSpace(v); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// collapses whitespace and cuts text to limit bytes, on a rune boundary
+func truncateText(text string, limit int) string {
+	text = strings.Join(strings.Fields(strings.ToValidUTF8(text, "")), " ")
+	if len(text) <= limit {
+		return text
+	}
+	cut := limit
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	return strings.TrimSpace(text[:cut]) + "…"
+}
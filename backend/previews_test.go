@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPreviewConfig() PreviewConfig {
+	return PreviewConfig{
+		Enabled: true,
+		Timeout: Duration(5 * time.Second),
+		MaxBodySize: 64 << 10,
+		MaxLinks: 3,
+		CacheTTL: Duration(time.Hour),
+		Workers: 1,
+	}
+}
+
+// a fetcher that can reach httptest servers
+func newTestLinkFetcher(config PreviewConfig) *linkFetcher {
+	f := newLinkFetcher(config)
+	f.addrFilter = testAddrFilter()
+	return f
+}
+
+// serves the pages by path as HTML, and the JSON at paths ending in .json
+func newTestSite(t *testing.T, pages map[string]string) *httptest.Server {
+	t.Helper()
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".json") {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		}
+		fmt.Fprint(w, page)
+	}))
+	t.Cleanup(site.Close)
+	return site
+}
+
+func TestLinkFetcherOpenGraph(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/article": `<!doctype html><html><head>
+			<title>Ignored title</title>
+			<meta property="og:title" content="  The   Article ">
+			<meta property="og:description" content="What it is about">
+			<meta property="og:site_name" content="Example">
+			<meta property="og:image" content="/cover.png">
+			</head><body><meta property="og:title" content="Not in the head"></body></html>`,
+	})
+
+	preview, err := newTestLinkFetcher(testPreviewConfig()).fetch(context.Background(), site.URL+"/article")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LinkPreview{
+		URL: site.URL + "/article",
+		Title: "The Article",
+		Description: "What it is about",
+		SiteName: "Example",
+		Image: site.URL + "/cover.png",
+	}
+	if preview != want {
+		t.Errorf("preview = %+v, want %+v", preview, want)
+	}
+}
+
+func TestLinkFetcherOEmbed(t *testing.T) {
+	site := newTestSite(t, map[string]string{
+		"/video": `<html><head><title>Fallback</title>
+			<link rel="alternate" type="application/json+oembed" href="/oembed.json?url=video">
+			</head></html>`,
+		"/oembed.json": `{"title":"A Video","provider_name":"Tube","thumbnail_url":"https://img.example.com/v.jpg","html":"<iframe></iframe>"}`,
+	})
+
+	preview, err := newTestLinkFetcher(testPreviewConfig()).fetch(context.Background(), site.URL+"/video")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if preview.Title != "A Video" || preview.SiteName != "Tube" || preview.Image != "https://img.example.com/v.jpg" {
+		t.Errorf("preview = %+v, want the oEmbed title, provider and thumbnail", preview)
+	}
+}
+
+func TestLinkFetcherBodySizeLimit(t *testing.T) {
+	config := testPreviewConfig()
+	config.MaxBodySize = 1024
+	padding := `<meta name="padding" content="` + strings.Repeat("x", 2048) + `">`
+	site := newTestSite(t, map[string]string{
+		"/small": `<html><head><meta property="og:title" content="Small"></head></html>`,
+		"/large": `<html><head>` + padding + `<meta property="og:title" content="Too far"><title>Too far</title></head></html>`,
+	})
+	f := newTestLinkFetcher(config)
+
+	if preview, err := f.fetch(context.Background(), site.URL+"/small"); err != nil || preview.Title != "Small" {
+		t.Errorf("fetch(/small) = %+v, %v", preview, err)
+	}
+	// only the first 1024 bytes are read, the title is past them
+	if preview, err := f.fetch(context.Background(), site.URL+"/large"); !errors.Is(err, errNotPreviewable) {
+		t.Errorf("fetch(/large) = %+v, %v, want %v", preview, err, errNotPreviewable)
+	}
+}
+
+func TestLinkFetcherRefusesRedirectToPrivateAddress(t *testing.T) {
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/admin", http.StatusFound)
+	}))
+	defer site.Close()
+
+	_, err := newTestLinkFetcher(testPreviewConfig()).fetch(context.Background(), site.URL)
+	if !errors.Is(err, errBlockedAddress) {
+		t.Errorf("fetch = %v, want %v", err, errBlockedAddress)
+	}
+}
+
+// previewCache kept in memory
+type memoryPreviewCache map[string]LinkPreview
+
+func (c memoryPreviewCache) getLinkPreview(url string, ttl time.Duration) (LinkPreview, bool, error) {
+	preview, ok := c[url]
+	return preview, ok, nil
+}
+
+func (c memoryPreviewCache) setLinkPreview(preview LinkPreview) error {
+	c[preview.URL] = preview
+	return nil
+}
+
+func (c memoryPreviewCache) pruneLinkPreviews(ttl time.Duration) error {
+	return nil
+}
+
+// a link is fetched once, and so is a link that couldn't be previewed
+func TestLinkUnfurlerCache(t *testing.T) {
+	var fetches atomic.Int32
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		if r.URL.Path == "/broken" {
+			http.Error(w, "broken", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprint(w, `<title>Cached</title>`)
+	}))
+	defer site.Close()
+
+	u := newLinkUnfurler(nil, testPreviewConfig())
+	u.cache = memoryPreviewCache{}
+	u.fetcher = newTestLinkFetcher(testPreviewConfig())
+
+	for range 3 {
+		if preview, ok := u.preview(context.Background(), site.URL+"/page"); !ok || preview.Title != "Cached" {
+			t.Errorf("preview(/page) = %+v, %v", preview, ok)
+		}
+		if preview, ok := u.preview(context.Background(), site.URL+"/broken"); ok {
+			t.Errorf("preview(/broken) = %+v, %v", preview, ok)
+		}
+	}
+	if fetches.Load() != 2 {
+		t.Errorf("site was fetched %d times, want once per link", fetches.Load())
+	}
+}
+
+func TestExtractLinks(t *testing.T) {
+	text := "see https://example.com/a, (https://example.com/b_(c)) and https://example.com/a#top or http://user:pw@example.com/ https://example.com/d https://example.com/e"
+	got := extractLinks(text, 3)
+	want := []string{"https://example.com/a", "https://example.com/b_(c)", "https://example.com/d"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("extractLinks = %v, want %v", got, want)
+	}
+}
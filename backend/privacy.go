@@ -0,0 +1,513 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// author of the messages of erased accounts. the row is created by init.sql and can't log in
+const tombstoneUsername = "deleted-user"
+
+// states of a data export
+const (
+	ExportPending = "pending"
+	ExportRunning = "running"
+	ExportReady = "ready"
+	ExportFailed = "failed"
+)
+
+var (
+	ErrExportInProgress = errors.New("a data export is already in progress")
+	ErrExportNotReady = errors.New("the data export is not ready")
+)
+
+// an archive of everything stored about a user, built in the background
+type DataExport struct {
+	Id          int        `json:"id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	// the archive is deleted after this
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	userId int
+	// name of the archive in privacy.export_dir
+	file string
+}
+
+// profile.json of a data export
+type AccountProfile struct {
+	Id           int             `json:"id"`
+	Username     string          `json:"username"`
+	DisplayName  string          `json:"display_name"`
+	Avatar       string          `json:"avatar"`
+	Bio          string          `json:"bio"`
+	StatusText   string          `json:"status_text"`
+	Privacy      PrivacySettings `json:"privacy"`
+	IsAdmin      bool            `json:"is_admin"`
+	IsBot        bool            `json:"is_bot"`
+	BotOwner     string          `json:"bot_owner,omitempty"`
+	TOTPEnabled  bool            `json:"totp_enabled"`
+	IdentityKey  string          `json:"identity_key,omitempty"`
+	BlockedUsers []string        `json:"blocked_users"`
+	Contacts     []Contact       `json:"contacts"`
+	Bots         []string        `json:"bots"`
+}
+
+// an entry of rooms.json
+type RoomMembership struct {
+	RoomId            int        `json:"room_id"`
+	Name              string     `json:"name"`
+	Role              string     `json:"role"`
+	NotificationLevel string     `json:"notification_level"`
+	MutedUntil        *time.Time `json:"muted_until,omitempty"`
+}
+
+// a device registered for push notifications, in sessions.json
+type PushDevice struct {
+	Endpoint  string    `json:"endpoint"`
+	UserAgent string    `json:"user_agent"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// sessions.json of a data export
+type AccountSessions struct {
+	// access tokens are signed JWTs, the server keeps no record of them
+	Note              string       `json:"note"`
+	PushSubscriptions []PushDevice `json:"push_subscriptions"`
+	BotTokens         []BotToken   `json:"bot_tokens"`
+}
+
+// PrivacyJobs builds data exports and erases accounts in the background.
+// both are queued in the database so a restart doesn't lose them
+type PrivacyJobs struct {
+	hub *Hub
+
+	config PrivacyConfig
+
+	// wakes the worker up when a job is queued
+	wake chan struct{}
+}
+
+func newPrivacyJobs(h *Hub, config PrivacyConfig) *PrivacyJobs {
+	return &PrivacyJobs{
+		hub: h,
+		config: config,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// runs queued jobs until ctx is cancelled
+func (p *PrivacyJobs) run(ctx context.Context) {
+	if err := os.MkdirAll(p.config.ExportDir, 0o700); err != nil {
+		log.Println("Error creating the data export directory: ", err)
+	}
+	// jobs interrupted by a restart start over
+	if err := p.hub.db.resetInterruptedPrivacyJobs(); err != nil {
+		log.Println("Error resetting privacy jobs: ", err)
+	}
+
+	ticker := time.NewTicker(time.Duration(p.config.PollInterval))
+	defer ticker.Stop()
+	for {
+		p.processErasures(ctx)
+		p.processExports(ctx)
+		p.removeExpiredExports()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.wake:
+		}
+	}
+}
+
+func (p *PrivacyJobs) notify() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *PrivacyJobs) processExports(ctx context.Context) {
+	for ctx.Err() == nil {
+		export, err := p.hub.db.claimDataExport()
+		if err != nil {
+			log.Println("Error claiming data export: ", err)
+			return
+		}
+		if export == nil {
+			return
+		}
+		file, err := p.buildExport(ctx, export)
+		if err != nil {
+			log.Printf("data export %d failed: %v", export.Id, err)
+			if err := p.hub.db.failDataExport(export.Id, err.Error()); err != nil {
+				log.Println("Error updating data export: ", err)
+			}
+			continue
+		}
+		if err := p.hub.db.completeDataExport(export.Id, file); err != nil {
+			log.Println("Error updating data export: ", err)
+			os.Remove(filepath.Join(p.config.ExportDir, file))
+		}
+	}
+}
+
+// writes the user's data to a ZIP in the export directory and returns its name
+func (p *PrivacyJobs) buildExport(ctx context.Context, export *DataExport) (string, error) {
+	db := p.hub.db
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("export-%d-%s.zip", export.Id, hex.EncodeToString(suffix))
+	path := filepath.Join(p.config.ExportDir, name)
+
+	// written under a temporary name so a half written archive is never served
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(path + ".tmp")
+	defer f.Close()
+	archive := zip.NewWriter(f)
+
+	profile, err := db.getAccountProfile(export.userId)
+	if err != nil {
+		return "", err
+	}
+	if err := writeZipJSON(archive, "profile.json", profile); err != nil {
+		return "", err
+	}
+
+	memberships, err := db.getRoomMemberships(export.userId)
+	if err != nil {
+		return "", err
+	}
+	for i := range memberships {
+		if room, ok := p.hub.getRoom(memberships[i].RoomId); ok {
+			memberships[i].Name = room.describeTo(export.userId, nil).Name
+		}
+	}
+	if err := writeZipJSON(archive, "rooms.json", memberships); err != nil {
+		return "", err
+	}
+
+	sessions := AccountSessions{Note: "access tokens are short-lived signed tokens and are not stored by the server"}
+	sessions.PushSubscriptions, err = db.getPushDevices(export.userId)
+	if err != nil {
+		return "", err
+	}
+	bots, err := db.getBots(export.userId)
+	if err != nil {
+		return "", err
+	}
+	sessions.BotTokens = []BotToken{}
+	for _, bot := range bots {
+		tokens, err := db.getBotTokens(bot.id)
+		if err != nil {
+			return "", err
+		}
+		sessions.BotTokens = append(sessions.BotTokens, tokens...)
+	}
+	if err := writeZipJSON(archive, "sessions.json", sessions); err != nil {
+		return "", err
+	}
+
+	// authored messages can be many, they are streamed one JSON object per line
+	w, err := archive.Create("messages.jsonl")
+	if err != nil {
+		return "", err
+	}
+	enc := json.NewEncoder(w)
+	err = db.streamAuthoredMessages(ctx, export.userId, exportBatchSize, func(message NewMessageEvent) error {
+		message.Sent = message.Sent.UTC()
+		return enc.Encode(message)
+	}, func() error { return nil })
+	if err != nil {
+		return "", err
+	}
+
+	if err := archive.Close(); err != nil {
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+	return name, os.Rename(path+".tmp", path)
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v any) error {
+	w, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (p *PrivacyJobs) removeExpiredExports() {
+	files, err := p.hub.db.deleteExpiredDataExports(time.Duration(p.config.ExportTTL))
+	if err != nil {
+		log.Println("Error expiring data exports: ", err)
+		return
+	}
+	for _, file := range files {
+		if err := os.Remove(filepath.Join(p.config.ExportDir, file)); err != nil && !os.IsNotExist(err) {
+			log.Println("Error removing data export: ", err)
+		}
+	}
+}
+
+func (p *PrivacyJobs) processErasures(ctx context.Context) {
+	for ctx.Err() == nil {
+		id, userId, err := p.hub.db.claimAccountErasure()
+		if err != nil {
+			log.Println("Error claiming account erasure: ", err)
+			return
+		}
+		if id == 0 {
+			return
+		}
+		if err := p.hub.eraseAccount(userId); err != nil {
+			// stays queued, retried on the next run
+			log.Printf("erasure of account %d failed: %v", id, err)
+			if err := p.hub.db.releaseAccountErasure(id); err != nil {
+				log.Println("Error updating account erasure: ", err)
+			}
+			return
+		}
+		if err := p.hub.db.completeAccountErasure(id); err != nil {
+			log.Println("Error updating account erasure: ", err)
+		}
+	}
+}
+
+// deletes everything stored about the user and their bots. their messages stay
+// in the rooms, authored by the tombstone user
+func (h *Hub) eraseAccount(userId int) error {
+	user, err := h.db.getUser(userId)
+	if err != nil {
+		return err
+	}
+	tombstone, err := h.db.getUserByUsername(tombstoneUsername)
+	if err != nil {
+		return err
+	}
+	if userId == tombstone.id {
+		return errors.New("the tombstone account can't be erased")
+	}
+
+	bots, err := h.db.getBots(userId)
+	if err != nil {
+		return err
+	}
+	for _, bot := range bots {
+		if err := h.eraseAccount(bot.id); err != nil {
+			return err
+		}
+	}
+
+	// the other members see them leave
+	roomIds, err := h.db.getRooms(userId)
+	if err != nil {
+		return err
+	}
+	for _, roomId := range roomIds {
+		if room, ok := h.getRoom(roomId); ok {
+			if err := h.removeRoomMember(room, user, ""); err != nil {
+				return err
+			}
+		}
+	}
+	// the hub goroutine owns the clients map, it closes the connections
+	h.disconnect <- userId
+
+	files, err := h.db.eraseUser(userId, tombstone.id)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		os.Remove(filepath.Join(h.config.Privacy.ExportDir, file))
+	}
+
+	for _, room := range h.allRooms() {
+		room.updateLastMessage <- func(last *NewMessageEvent) {
+			if last.FromId == userId {
+				last.From = tombstone.username
+				last.FromId = tombstone.id
+				last.FromDisplayName = tombstone.displayName
+			}
+		}
+	}
+	return nil
+}
+
+// queues an export of the authenticated user's data
+func (h *Hub) requestDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	latest, err := h.db.getLatestDataExport(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving data export", http.StatusInternalServerError)
+		return
+	}
+	if latest != nil && (latest.Status == ExportPending || latest.Status == ExportRunning) {
+		http.Error(w, ErrExportInProgress.Error(), http.StatusConflict)
+		return
+	}
+
+	export, err := h.db.addDataExport(userId)
+	if err != nil {
+		http.Error(w, "Error queueing data export", http.StatusInternalServerError)
+		return
+	}
+	h.privacy.notify()
+	writeJSON(w, http.StatusAccepted, export)
+}
+
+// returns the state of the authenticated user's latest export
+func (h *Hub) dataExportStatusHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	export, err := h.db.getLatestDataExport(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving data export", http.StatusInternalServerError)
+		return
+	}
+	if export == nil {
+		http.Error(w, "no data export requested", http.StatusNotFound)
+		return
+	}
+	h.setExportExpiry(export)
+	writeJSON(w, http.StatusOK, export)
+}
+
+func (h *Hub) downloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad export id", http.StatusBadRequest)
+		return
+	}
+	export, err := h.db.getDataExport(id, userId)
+	if err != nil {
+		http.Error(w, "Error retrieving data export", http.StatusInternalServerError)
+		return
+	}
+	if export == nil {
+		http.Error(w, "data export not found", http.StatusNotFound)
+		return
+	}
+	if export.Status != ExportReady {
+		http.Error(w, ErrExportNotReady.Error(), http.StatusConflict)
+		return
+	}
+
+	user, err := h.db.getUser(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(h.config.Privacy.ExportDir, export.file))
+	if err != nil {
+		http.Error(w, "data export not found", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gochat-%s.zip"`, user.username))
+	io.Copy(w, f)
+}
+
+func (h *Hub) setExportExpiry(export *DataExport) {
+	if export.CompletedAt != nil && export.Status == ExportReady {
+		expiresAt := export.CompletedAt.Add(time.Duration(h.config.Privacy.ExportTTL))
+		export.ExpiresAt = &expiresAt
+	}
+}
+
+// queues the erasure of the authenticated user's account.
+// the password, and a second factor when enabled, must be given again
+func (h *Hub) requestErasureHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type erasureRequest struct {
+		Password string `json:"password"`
+		Code     string `json:"code"`
+	}
+
+	var req erasureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	password, err := h.db.getPasswordHash(userId)
+	if err != nil || bcrypt.CompareHashAndPassword([]byte(password), []byte(req.Password)) != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	_, totpEnabled, _, err := h.db.getTOTP(userId)
+	if err != nil {
+		http.Error(w, "Credentials verification error", http.StatusInternalServerError)
+		return
+	}
+	if totpEnabled {
+		ok, err := h.verifySecondFactor(userId, req.Code)
+		if errors.Is(err, ErrTooManyAttempts) {
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Error verifying code", http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	if err := h.db.addAccountErasure(userId); err != nil {
+		http.Error(w, "Error queueing erasure", http.StatusInternalServerError)
+		return
+	}
+	h.privacy.notify()
+	w.WriteHeader(http.StatusAccepted)
+}
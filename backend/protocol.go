@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+)
+
+const (
+	// first event of a session, the client's protocol version and features
+	EventHello = "hello"
+	// response to hello
+	EventWelcome = "welcome"
+	// a request failed
+	EventError = "error"
+)
+
+// versions of the websocket protocol
+const (
+	// spoken by clients that never send hello. errors are bare strings
+	ProtocolV1 = 1
+	// errors are objects naming the event that failed. optional features can only be
+	// used, and their events and fields are only sent, once negotiated
+	ProtocolV2 = 2
+
+	currentProtocolVersion = ProtocolV2
+	// oldest version still served, raised when the deprecation window of a version ends
+	minProtocolVersion = ProtocolV1
+)
+
+// optional features a client can negotiate in hello
+const (
+	// message_preview events with the previews of links
+	FeatureLinkPreviews = "link_previews"
+	// the html of markdown messages
+	FeatureMarkdown = "markdown"
+	// end-to-end encrypted rooms
+	FeatureE2EE = "e2ee"
+	// schedule_message and the events around it
+	FeatureScheduledMessages = "scheduled_messages"
+)
+
+// events only sent to the clients that negotiated their feature
+var featureEvents = map[string]string{
+	EventMessagePreview: FeatureLinkPreviews,
+	EventMessageScheduled: FeatureScheduledMessages,
+	EventScheduledMessages: FeatureScheduledMessages,
+	EventScheduledMessageFailed: FeatureScheduledMessages,
+}
+
+// requests only handled for the clients that negotiated their feature
+var featureRequests = map[string]string{
+	EventScheduleMessage: FeatureScheduledMessages,
+	EventListScheduled: FeatureScheduledMessages,
+	EventCancelScheduled: FeatureScheduledMessages,
+}
+
+var (
+	ErrAlreadyNegotiated = errors.New("the protocol was already negotiated for this session")
+	ErrFeatureNotNegotiated = errors.New("this feature was not negotiated in hello")
+)
+
+type HelloEvent struct {
+	// highest protocol version the client speaks
+	Version int `json:"version"`
+	Features []string `json:"features"`
+}
+
+// limits of the server a client should check before sending a request
+type ServerLimits struct {
+	// bytes of an event sent by the client
+	MaxMessageSize int64 `json:"max_message_size"`
+	MaxRoomNameLength int `json:"max_room_name_length"`
+	MaxRoomTopicLength int `json:"max_room_topic_length"`
+	MaxRoomDescriptionLength int `json:"max_room_description_length"`
+	MaxChannelMembers int `json:"max_channel_members"`
+	MaxScheduledMessages int `json:"max_scheduled_messages"`
+}
+
+type WelcomeEvent struct {
+	// version both sides speak, the lowest of the client's and the server's
+	Version int `json:"version"`
+	// features both sides support
+	Features []string `json:"features"`
+	Limits ServerLimits `json:"limits"`
+	// identifies this connection, for support and logs
+	SessionId string `json:"session_id"`
+}
+
+// error payload from ProtocolV2 on
+type ErrorEvent struct {
+	// type of the event that failed
+	Event string `json:"event"`
+	Message string `json:"message"`
+}
+
+// what was negotiated in hello
+type clientProtocol struct {
+	version int
+	features map[string]bool
+}
+
+func HelloHandler(event Event, c *Client) error {
+	var e HelloEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if e.Version < minProtocolVersion {
+		return fmt.Errorf("protocol version %d is not supported anymore, versions %d to %d are", e.Version, minProtocolVersion, currentProtocolVersion)
+	}
+
+	protocol := &clientProtocol{
+		version: min(e.Version, currentProtocolVersion),
+		features: map[string]bool{},
+	}
+	supported := c.hub.features()
+	for _, feature := range e.Features {
+		if slices.Contains(supported, feature) {
+			protocol.features[feature] = true
+		}
+	}
+	if !c.protocol.CompareAndSwap(nil, protocol) {
+		return ErrAlreadyNegotiated
+	}
+
+	welcome := WelcomeEvent{
+		Version: protocol.version,
+		Features: []string{},
+		Limits: ServerLimits{
+			MaxMessageSize: c.hub.config.WebSocket.MaxMessageSize,
+			MaxRoomNameLength: maxRoomNameLength,
+			MaxRoomTopicLength: maxRoomTopicLength,
+			MaxRoomDescriptionLength: maxRoomDescriptionLength,
+			MaxChannelMembers: maxChannelMembers,
+			MaxScheduledMessages: c.hub.config.Scheduler.MaxPerUser,
+		},
+		SessionId: c.sessionId,
+	}
+	for _, feature := range supported {
+		if protocol.features[feature] {
+			welcome.Features = append(welcome.Features, feature)
+		}
+	}
+	data, err := json.Marshal(welcome)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventWelcome
+	c.send <- outgoingEvent
+	return nil
+}
+
+// the optional features this server supports
+func (h *Hub) features() []string {
+	features := []string{FeatureMarkdown, FeatureE2EE, FeatureScheduledMessages}
+	if h.unfurler != nil {
+		features = append(features, FeatureLinkPreviews)
+	}
+	return features
+}
+
+// the protocol version negotiated by the client, ProtocolV1 until it sends hello.
+// handlers check it to keep serving the old shape of a payload they changed
+func (c *Client) protocolVersion() int {
+	if protocol := c.protocol.Load(); protocol != nil {
+		return protocol.version
+	}
+	return ProtocolV1
+}
+
+// whether the client negotiated the feature. ProtocolV1 clients have every feature,
+// as they did before features were negotiated
+func (c *Client) supports(feature string) bool {
+	protocol := c.protocol.Load()
+	return protocol == nil || protocol.version < ProtocolV2 || protocol.features[feature]
+}
+
+// whether the client should be sent the event
+func (c *Client) accepts(event Event) bool {
+	feature, ok := featureEvents[event.Type]
+	return !ok || c.supports(feature)
+}
+
+// fails if the message uses a feature the client didn't negotiate
+func (c *Client) checkMessageFeatures(message SendMessageEvent) error {
+	if message.Encrypted && !c.supports(FeatureE2EE) {
+		return ErrFeatureNotNegotiated
+	}
+	if message.Format == FormatMarkdown && !c.supports(FeatureMarkdown) {
+		return ErrFeatureNotNegotiated
+	}
+	return nil
+}
+
+// returns the event without the fields of the features the client didn't negotiate.
+// only the html of markdown messages is such a field, wherever a message is in the payload
+func (c *Client) adapt(event Event) Event {
+	if c.supports(FeatureMarkdown) || !bytes.Contains(event.Payload, []byte(`"html":`)) {
+		return event
+	}
+	d := json.NewDecoder(bytes.NewReader(event.Payload))
+	// ids stay integers rather than becoming floats
+	d.UseNumber()
+	var payload any
+	if err := d.Decode(&payload); err != nil {
+		return event
+	}
+	data, err := json.Marshal(withoutHTML(payload))
+	if err != nil {
+		return event
+	}
+	event.Payload = data
+	return event
+}
+
+// removes the html keys of the objects in v
+func withoutHTML(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		delete(v, "html")
+		for _, value := range v {
+			withoutHTML(value)
+		}
+	case []any:
+		for _, value := range v {
+			withoutHTML(value)
+		}
+	}
+	return v
+}
+
+// the event telling the client a request failed, in the shape of its protocol version
+func (c *Client) errorEvent(eventType string, err error) Event {
+	var payload any = err.Error()
+	if c.protocolVersion() >= ProtocolV2 {
+		payload = ErrorEvent{Event: eventType, Message: err.Error()}
+	}
+	// a string or an ErrorEvent always marshals
+	data, _ := json.Marshal(payload)
+	return Event{Type: EventError, Payload: data}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+// a client that said hello with the given version and features
+func newTestClient(version int, features ...string) *Client {
+	c := &Client{}
+	if version > 0 {
+		protocol := &clientProtocol{version: version, features: map[string]bool{}}
+		for _, feature := range features {
+			protocol.features[feature] = true
+		}
+		c.protocol.Store(protocol)
+	}
+	return c
+}
+
+func TestClientSupports(t *testing.T) {
+	for _, c := range []*Client{newTestClient(0), newTestClient(ProtocolV1)} {
+		if !c.supports(FeatureMarkdown) || !c.accepts(Event{Type: EventMessagePreview}) {
+			t.Error("a ProtocolV1 client doesn't have every feature")
+		}
+	}
+
+	c := newTestClient(ProtocolV2, FeatureLinkPreviews)
+	if !c.supports(FeatureLinkPreviews) || !c.accepts(Event{Type: EventMessagePreview}) {
+		t.Error("a negotiated feature isn't supported")
+	}
+	if c.supports(FeatureScheduledMessages) || c.accepts(Event{Type: EventScheduledMessageFailed}) {
+		t.Error("a feature that wasn't negotiated is supported")
+	}
+	if !c.accepts(Event{Type: EventNewMessage}) {
+		t.Error("an event outside of any feature isn't accepted")
+	}
+}
+
+func TestClientCheckMessageFeatures(t *testing.T) {
+	encrypted := SendMessageEvent{Encrypted: true, Envelope: &EncryptedEnvelope{}}
+	markdown := SendMessageEvent{Message: "**hi**", Format: FormatMarkdown}
+
+	c := newTestClient(ProtocolV2)
+	if err := c.checkMessageFeatures(encrypted); !errors.Is(err, ErrFeatureNotNegotiated) {
+		t.Errorf("encrypted message = %v, want %v", err, ErrFeatureNotNegotiated)
+	}
+	if err := c.checkMessageFeatures(markdown); !errors.Is(err, ErrFeatureNotNegotiated) {
+		t.Errorf("markdown message = %v, want %v", err, ErrFeatureNotNegotiated)
+	}
+	if err := c.checkMessageFeatures(SendMessageEvent{Message: "hi"}); err != nil {
+		t.Errorf("plain message = %v", err)
+	}
+
+	c = newTestClient(ProtocolV2, FeatureE2EE, FeatureMarkdown)
+	if c.checkMessageFeatures(encrypted) != nil || c.checkMessageFeatures(markdown) != nil {
+		t.Error("negotiated features are refused")
+	}
+}
+
+func TestClientAdaptStripsHTML(t *testing.T) {
+	message := NewMessageEvent{Id: 9007199254740993, HTML: "<p><strong>hi</strong></p>"}
+	message.Message = "**hi**"
+	message.Format = FormatMarkdown
+	data, err := json.Marshal(NewRoomEvent{Id: 1, LastMessage: message})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := Event{Type: EventNewRoom, Payload: data}
+
+	if got := newTestClient(ProtocolV2, FeatureMarkdown).adapt(event); string(got.Payload) != string(data) {
+		t.Errorf("payload changed for a client that negotiated markdown: %s", got.Payload)
+	}
+	if got := newTestClient(ProtocolV1).adapt(event); string(got.Payload) != string(data) {
+		t.Errorf("payload changed for a ProtocolV1 client: %s", got.Payload)
+	}
+
+	var room NewRoomEvent
+	if err := json.Unmarshal(newTestClient(ProtocolV2).adapt(event).Payload, &room); err != nil {
+		t.Fatal(err)
+	}
+	if room.LastMessage.HTML != "" || room.LastMessage.Message != "**hi**" || room.LastMessage.Id != 9007199254740993 {
+		t.Errorf("adapted last message = %+v, want it without its html only", room.LastMessage)
+	}
+}
@@ -0,0 +1,479 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// record size of the aes128gcm content coding, the payload must fit in one record
+	pushRecordSize = 4096
+
+	// largest payload sent, leaving room for the padding delimiter and the AEAD tag
+	maxPushPayload = pushRecordSize - 17
+
+	// lifetime of the VAPID JWT, push services reject more than 24h
+	vapidTokenLifetime = 12 * time.Hour
+
+	// push jobs waiting for a worker, more are dropped
+	pushQueueSize = 1024
+)
+
+var (
+	ErrPushDisabled = errors.New("web push is not configured on this server")
+	ErrPushPayloadTooLarge = errors.New("push payload is too large")
+	ErrEndpointTaken = errors.New("this endpoint is registered by another user")
+)
+
+var pushEncoding = base64.RawURLEncoding
+
+// a browser's push subscription, as returned by PushManager.subscribe()
+type PushSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys struct {
+		// client public key, uncompressed P-256 point
+		P256dh string `json:"p256dh"`
+		// client authentication secret
+		Auth string `json:"auth"`
+	} `json:"keys"`
+
+	id int
+	userId int
+	userAgent string
+}
+
+// payload of the push messages, read by the client's service worker
+type PushPayload struct {
+	Type      string `json:"type"`
+	RoomId    int    `json:"room_id"`
+	MessageId int    `json:"message_id"`
+	From      string `json:"from"`
+	Body      string `json:"body"`
+}
+
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+	// base64url encoded uncompressed public key
+	public string
+}
+
+// parses the configured key pair and checks the public key matches the private one
+func parseVAPIDKeys(public string, private string) (*vapidKeys, error) {
+	raw, err := pushEncoding.DecodeString(private)
+	if err != nil {
+		return nil, fmt.Errorf("bad VAPID private key: %v", err)
+	}
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), raw)
+	if err != nil {
+		return nil, fmt.Errorf("bad VAPID private key: %v", err)
+	}
+	derived, err := key.PublicKey.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	if pushEncoding.EncodeToString(derived) != public {
+		return nil, errors.New("VAPID public key does not match the private key")
+	}
+	return &vapidKeys{private: key, public: public}, nil
+}
+
+// returns a new base64url encoded VAPID key pair
+func generateVAPIDKeys() (string, string, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	private, err := key.Bytes()
+	if err != nil {
+		return "", "", err
+	}
+	public, err := key.PublicKey.Bytes()
+	if err != nil {
+		return "", "", err
+	}
+	return pushEncoding.EncodeToString(public), pushEncoding.EncodeToString(private), nil
+}
+
+// returns the Authorization header of a request to endpoint (RFC 8292)
+func (k *vapidKeys) authorization(endpoint string, subject string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(vapidTokenLifetime).Unix(),
+		"sub": subject,
+	})
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		return "", err
+	}
+	return "vapid t=" + signed + ", k=" + k.public, nil
+}
+
+// encrypts plaintext for a subscription with the aes128gcm content coding (RFC 8291, RFC 8188)
+func encryptPushPayload(p256dh string, auth string, plaintext []byte) ([]byte, error) {
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptPushPayloadWith(p256dh, auth, plaintext, asPrivate, salt)
+}
+
+// encryptPushPayload with a given application server key pair and salt
+func encryptPushPayloadWith(p256dh string, auth string, plaintext []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(plaintext) > maxPushPayload {
+		return nil, ErrPushPayloadTooLarge
+	}
+	uaPublicBytes, err := pushEncoding.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return nil, fmt.Errorf("bad p256dh key: %v", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, fmt.Errorf("bad p256dh key: %v", err)
+	}
+	authSecret, err := pushEncoding.DecodeString(strings.TrimRight(auth, "="))
+	if err != nil || len(authSecret) != 16 {
+		return nil, errors.New("bad auth secret")
+	}
+
+	ecdhSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	asPublicBytes := asPrivate.PublicKey().Bytes()
+
+	// IKM = HKDF(auth_secret, ecdh_secret, "WebPush: info" || 0x00 || ua_public || as_public, 32)
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublicBytes...)
+	ikm, err := hkdf.Key(sha256.New, ecdhSecret, authSecret, string(keyInfo), 32)
+	if err != nil {
+		return nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// header: salt || record size || key id length || key id (the application server public key)
+	var body bytes.Buffer
+	body.Write(salt)
+	binary.Write(&body, binary.BigEndian, uint32(pushRecordSize))
+	body.WriteByte(byte(len(asPublicBytes)))
+	body.Write(asPublicBytes)
+
+	// a single, last, record: plaintext followed by the 0x02 delimiter
+	record := append(append([]byte{}, plaintext...), 0x02)
+	body.Write(gcm.Seal(nil, nonce, record, nil))
+	return body.Bytes(), nil
+}
+
+type pushJob struct {
+	userId int
+	payload []byte
+	urgency string
+}
+
+// PushDispatcher sends Web Push messages to the devices of users that are offline or idle
+type PushDispatcher struct {
+	// endpoints are given by clients, they must not reach the server's network
+	addrFilter
+
+	db *Database
+
+	keys *vapidKeys
+
+	config PushConfig
+
+	client *http.Client
+
+	jobs chan pushJob
+}
+
+// returns nil when push isn't configured
+func newPushDispatcher(db *Database, config PushConfig) (*PushDispatcher, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	keys, err := parseVAPIDKeys(config.VAPIDPublicKey, config.VAPIDPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	d := &PushDispatcher{
+		addrFilter: addrFilter{allowAddr: isPublicAddr},
+		db: db,
+		keys: keys,
+		config: config,
+		jobs: make(chan pushJob, pushQueueSize),
+	}
+	d.client = &http.Client{
+		Timeout: time.Duration(config.Timeout),
+		Transport: d.transport(time.Duration(config.Timeout)),
+		// push services answer directly, a redirect is a failure
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d, nil
+}
+
+// starts the workers, they stop when ctx is cancelled
+func (d *PushDispatcher) run(ctx context.Context) {
+	for i := 0; i < d.config.Workers; i++ {
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-d.jobs:
+					d.sendToDevices(ctx, job)
+				}
+			}
+		}()
+	}
+}
+
+// queues a push to every device of the user. never blocks, the job is dropped if the queue is full
+func (d *PushDispatcher) enqueue(userId int, payload PushPayload, urgency string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error marshalling push payload: ", err)
+		return
+	}
+	select {
+	case d.jobs <- pushJob{userId: userId, payload: data, urgency: urgency}:
+	default:
+		log.Println("Push queue full, dropping push to user ", userId)
+	}
+}
+
+func (d *PushDispatcher) sendToDevices(ctx context.Context, job pushJob) {
+	subscriptions, err := d.db.getPushSubscriptions(job.userId)
+	if err != nil {
+		log.Println("Error retrieving push subscriptions: ", err)
+		return
+	}
+	for _, subscription := range d.deliver(ctx, subscriptions, job) {
+		if err := d.db.prunePushSubscription(subscription.id); err != nil {
+			log.Println("Error pruning push subscription: ", err)
+		}
+	}
+}
+
+// sends the job to the subscriptions and returns those the push services no longer know
+func (d *PushDispatcher) deliver(ctx context.Context, subscriptions []PushSubscription, job pushJob) []PushSubscription {
+	var gone []PushSubscription
+	for _, subscription := range subscriptions {
+		err := d.send(ctx, subscription, job.payload, job.urgency)
+		if errors.Is(err, errSubscriptionGone) {
+			gone = append(gone, subscription)
+			continue
+		}
+		if err != nil {
+			log.Printf("push to user %d failed: %v", job.userId, err)
+		}
+	}
+	return gone
+}
+
+// returned by send when the push service no longer knows the subscription
+var errSubscriptionGone = errors.New("push subscription expired")
+
+// encrypts payload and POSTs it to the subscription's push service
+func (d *PushDispatcher) send(ctx context.Context, subscription PushSubscription, payload []byte, urgency string) error {
+	body, err := encryptPushPayload(subscription.Keys.P256dh, subscription.Keys.Auth, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := d.keys.authorization(subscription.Endpoint, d.config.Subject)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(time.Duration(d.config.TTL).Seconds())))
+	if urgency != "" {
+		req.Header.Set("Urgency", urgency)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return errSubscriptionGone
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("push service answered %s", resp.Status)
+	}
+	return nil
+}
+
+// true if the user has no client, or none of them was active for push.idle_after
+func (h *Hub) isAway(userId int) bool {
+	threshold := time.Now().Add(-time.Duration(h.config.Push.IdleAfter)).UnixNano()
+	for _, client := range h.clientsOf(userId) {
+		if client.lastActive.Load() > threshold {
+			return false
+		}
+	}
+	return true
+}
+
+// pushes a notification to the user's devices if they are away
+func (h *Hub) pushNotification(notification Notification, body string) {
+	if h.push == nil || !h.isAway(notification.userId) {
+		return
+	}
+	urgency := "normal"
+	if notification.Kind == NotificationMention {
+		urgency = "high"
+	}
+	h.push.enqueue(notification.userId, PushPayload{
+		Type: notification.Kind,
+		RoomId: notification.RoomId,
+		MessageId: notification.MessageId,
+		From: notification.Actor,
+		Body: body,
+	}, urgency)
+}
+
+// returns the key browsers need to subscribe
+func (h *Hub) vapidPublicKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if h.push == nil {
+		http.Error(w, ErrPushDisabled.Error(), http.StatusNotFound)
+		return
+	}
+	type response struct {
+		PublicKey string `json:"public_key"`
+	}
+	writeJSON(w, http.StatusOK, response{PublicKey: h.push.keys.public})
+}
+
+// registers a device of the authenticated user
+func (h *Hub) subscribePushHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if h.push == nil {
+		http.Error(w, ErrPushDisabled.Error(), http.StatusNotFound)
+		return
+	}
+
+	var subscription PushSubscription
+	if err := json.NewDecoder(r.Body).Decode(&subscription); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endpoint, err := url.Parse(subscription.Endpoint)
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" || len(subscription.Endpoint) > 2048 {
+		http.Error(w, "endpoint must be an https URL", http.StatusBadRequest)
+		return
+	}
+	if err := checkPublicHost(endpoint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// encrypting a dummy payload validates both keys
+	if _, err := encryptPushPayload(subscription.Keys.P256dh, subscription.Keys.Auth, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	subscription.userId = userId
+	subscription.userAgent = r.UserAgent()
+	if len(subscription.userAgent) > 512 {
+		subscription.userAgent = subscription.userAgent[:512]
+	}
+	added, err := h.db.addPushSubscription(subscription)
+	if err != nil {
+		http.Error(w, "Error storing subscription", http.StatusInternalServerError)
+		return
+	}
+	if !added {
+		http.Error(w, ErrEndpointTaken.Error(), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// unregisters a device of the authenticated user
+func (h *Hub) unsubscribePushHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type unsubscribeRequest struct {
+		Endpoint string `json:"endpoint"`
+	}
+
+	var req unsubscribeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := h.db.deletePushSubscription(userId, req.Endpoint); err != nil {
+		http.Error(w, "Error deleting subscription", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
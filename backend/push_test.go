@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RFC 8291, Appendix A
+func TestEncryptPushPayloadVector(t *testing.T) {
+	plaintext, _ := pushEncoding.DecodeString("V2hlbiBJIGdyb3cgdXAsIEkgd2FudCB0byBiZSBhIHdhdGVybWVsb24")
+	asPrivateBytes, _ := pushEncoding.DecodeString("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	salt, _ := pushEncoding.DecodeString("DGv6ra1nlYgDCS1FRnbzlw")
+	const uaPublic = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	const authSecret = "BTBZMqHH6r4Tts7J_aSIgg"
+	const want = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+
+	asPrivate, err := ecdh.P256().NewPrivateKey(asPrivateBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := encryptPushPayloadWith(uaPublic, authSecret, plaintext, asPrivate, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := pushEncoding.EncodeToString(body); got != want {
+		t.Errorf("encrypted body =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// a browser's subscription to a push service at endpoint
+func newTestPushSubscription(t *testing.T, endpoint string) PushSubscription {
+	t.Helper()
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := make([]byte, 16)
+	rand.Read(auth)
+	var subscription PushSubscription
+	subscription.Endpoint = endpoint
+	subscription.Keys.P256dh = pushEncoding.EncodeToString(key.PublicKey().Bytes())
+	subscription.Keys.Auth = pushEncoding.EncodeToString(auth)
+	return subscription
+}
+
+// a dispatcher that can reach httptest servers
+func newTestPushDispatcher(t *testing.T) *PushDispatcher {
+	t.Helper()
+	public, private, err := generateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := newPushDispatcher(nil, PushConfig{
+		VAPIDPublicKey: public,
+		VAPIDPrivateKey: private,
+		Subject: "mailto:admin@example.com",
+		TTL: Duration(time.Hour),
+		Timeout: Duration(5 * time.Second),
+		Workers: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.addrFilter = testAddrFilter()
+	return d
+}
+
+// a push service that accepts /live and forgot /expired and /unknown
+func TestPushDeliverPrunesGoneSubscriptions(t *testing.T) {
+	d := newTestPushDispatcher(t)
+
+	received := 0
+	service := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/expired":
+			w.WriteHeader(http.StatusGone)
+			return
+		case "/unknown":
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		received++
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") != "3600" || r.Header.Get("Urgency") != "high" {
+			t.Errorf("headers = %v", r.Header)
+		}
+		// the VAPID token is signed by the server's key and addressed to the push service
+		authorization, ok := strings.CutPrefix(r.Header.Get("Authorization"), "vapid t=")
+		token, key, _ := strings.Cut(authorization, ", k=")
+		if !ok || key != d.keys.public {
+			t.Errorf("Authorization = %s", r.Header.Get("Authorization"))
+		}
+		claims := jwt.MapClaims{}
+		if _, err := jwt.ParseWithClaims(token, claims, func(*jwt.Token) (any, error) {
+			return &d.keys.private.PublicKey, nil
+		}); err != nil {
+			t.Errorf("VAPID token: %v", err)
+		}
+		if claims["aud"] != "http://"+r.Host {
+			t.Errorf("aud = %v, want http://%s", claims["aud"], r.Host)
+		}
+		body, _ := io.ReadAll(r.Body)
+		// salt, record size, key id length and the 65 bytes key, then the record
+		if len(body) != 86+len(`{"type":"mention"}`)+1+16 {
+			t.Errorf("body is %d bytes", len(body))
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer service.Close()
+
+	live := newTestPushSubscription(t, service.URL+"/live")
+	expired := newTestPushSubscription(t, service.URL+"/expired")
+	unknown := newTestPushSubscription(t, service.URL+"/unknown")
+	expired.id, unknown.id = 2, 3
+
+	job := pushJob{userId: 1, payload: []byte(`{"type":"mention"}`), urgency: "high"}
+	gone := d.deliver(context.Background(), []PushSubscription{live, expired, unknown}, job)
+	if received != 1 {
+		t.Errorf("push service received %d pushes, want 1", received)
+	}
+	if len(gone) != 2 || gone[0].id != 2 || gone[1].id != 3 {
+		t.Errorf("gone = %v, want the expired and unknown subscriptions", gone)
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// change how long a room keeps its messages
+	EventSetRetention = "set_retention"
+	// response to set_retention, sent to every member
+	EventRetentionUpdated = "retention_updated"
+	// messages were removed by the retention policy, sent to every member
+	EventMessagesPurged = "messages_purged"
+)
+
+// how long messages are kept. a message is purged once it is older than Days
+// or once Messages newer ones were posted. zero values keep messages forever
+type RetentionPolicy struct {
+	Days     int `json:"days" yaml:"days"`
+	Messages int `json:"messages" yaml:"messages"`
+}
+
+func (p RetentionPolicy) validate() error {
+	if p.Days < 0 || p.Messages < 0 {
+		return fmt.Errorf("retention days and messages can't be negative")
+	}
+	return nil
+}
+
+func (p RetentionPolicy) keepsForever() bool {
+	return p.Days == 0 && p.Messages == 0
+}
+
+type SetRetentionEvent struct {
+	RoomId int `json:"room_id"`
+	// null goes back to the server's default policy
+	Retention *RetentionPolicy `json:"retention"`
+}
+
+type RetentionUpdatedEvent struct {
+	RoomId int `json:"room_id"`
+	// policy now in effect
+	Retention RetentionPolicy `json:"retention"`
+	// the room follows the server's default policy
+	Default bool `json:"default"`
+	UpdatedBy string `json:"updated_by"`
+}
+
+type MessagesPurgedEvent struct {
+	RoomId int `json:"room_id"`
+	MessageIds []int `json:"message_ids"`
+	// new last message of the room, empty if none is left
+	LastMessage NewMessageEvent `json:"last_message"`
+}
+
+// returns the policy in effect in the room, on the room's goroutine
+func (r *Room) retentionPolicy() RetentionPolicy {
+	if r.retention != nil {
+		return *r.retention
+	}
+	return r.hub.config.Retention.RetentionPolicy
+}
+
+// purges expired messages every retention.interval until ctx is cancelled
+func (h *Hub) runRetention(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(h.config.Retention.Interval))
+	defer ticker.Stop()
+	for {
+		h.purgeExpiredMessages(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *Hub) purgeExpiredMessages(ctx context.Context) {
+	for _, room := range h.allRooms() {
+		if ctx.Err() != nil {
+			return
+		}
+		var policy RetentionPolicy
+		room.apply(func(r *Room) {
+			policy = r.retentionPolicy()
+		})
+		if policy.keepsForever() {
+			continue
+		}
+		if err := h.purgeRoom(ctx, room, policy); err != nil {
+			log.Printf("Error purging messages of room %d: %v", room.id, err)
+		}
+	}
+}
+
+// removes the room's expired messages batch by batch, telling the members after each batch
+func (h *Hub) purgeRoom(ctx context.Context, room *Room, policy RetentionPolicy) error {
+	batchSize := h.config.Retention.BatchSize
+	for ctx.Err() == nil {
+		var ids []int
+		var err error
+		if policy.Days > 0 {
+			ids, err = h.db.getExpiredMessages(room.id, time.Now().AddDate(0, 0, -policy.Days), batchSize)
+			if err != nil {
+				return err
+			}
+		}
+		if len(ids) == 0 && policy.Messages > 0 {
+			ids, err = h.db.getOverflowMessages(room.id, policy.Messages, batchSize)
+			if err != nil {
+				return err
+			}
+		}
+		if len(ids) == 0 {
+			return nil
+		}
+
+		purged, err := h.db.purgeMessages(ids, h.config.Retention.Archive)
+		if err != nil {
+			return err
+		}
+		lastMessage := h.db.getLastRoomMessage(room.id)
+		room.setLastMessage(lastMessage)
+		if len(purged) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(MessagesPurgedEvent{RoomId: room.id, MessageIds: purged, LastMessage: lastMessage})
+		if err != nil {
+			return fmt.Errorf("failed to marshal broadcast message: %v", err)
+		}
+
+		var outgoingEvent Event
+		outgoingEvent.Payload = data
+		outgoingEvent.Type = EventMessagesPurged
+		room.broadcast <- outgoingEvent
+	}
+	return nil
+}
+
+func SetRetentionHandler(event Event, c *Client) error {
+	var e SetRetentionEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	room, ok := c.hub.getRoom(e.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	role, err := c.hub.db.getRoomRole(room.id, c.user.id)
+	if err != nil {
+		return err
+	}
+	if roleRank(role) < roleRank(RoleAdmin) {
+		return ErrNotRoomAdmin
+	}
+	if e.Retention != nil {
+		if err := e.Retention.validate(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.hub.db.setRoomRetention(room.id, e.Retention); err != nil {
+		return err
+	}
+	var policy RetentionPolicy
+	room.apply(func(r *Room) {
+		r.retention = e.Retention
+		policy = r.retentionPolicy()
+	})
+
+	data, err := json.Marshal(RetentionUpdatedEvent{
+		RoomId: room.id,
+		Retention: policy,
+		Default: e.Retention == nil,
+		UpdatedBy: c.user.username,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventRetentionUpdated
+	room.broadcast <- outgoingEvent
+	return nil
+}
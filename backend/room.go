@@ -1,5 +1,13 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"encoding/json"
+)
+
 // A room represents a discussion between two client
 type Room struct {
 	hub *Hub
@@ -10,19 +18,51 @@ type Room struct {
 
 	name string
 
+	topic string
+
+	description string
+
+	// reference to the room's avatar attachment
+	avatar string
+
+	// end-to-end encrypted, the server only sees ciphertext
+	encrypted bool
+
+	// RoomPublic or RoomPrivate
+	visibility string
+
+	// nil when the room follows the server's default retention policy
+	retention *RetentionPolicy
+
+	// only read and written by the room's goroutine, changed through updateLastMessage
 	lastMessage NewMessageEvent
 
-	// Authorized users' username
-	users map[string]bool
+	// Authorized users, by id
+	users map[int]User
 
 	// Inbound messages from the clients
 	broadcast chan Event
 
+	// Inbound messages that some members must not receive
+	broadcastFiltered chan filteredEvent
+
 	// Register requests from the clients
 	register chan *User
 
 	// Unregister requests from clients
 	unregister chan *User
+
+	// changes to lastMessage, applied by the room's goroutine
+	updateLastMessage chan func(last *NewMessageEvent)
+
+	// requests for the NewRoomEvent describing the room to a member
+	describe chan describeRequest
+
+	// checks of whether a user can join, and joins
+	admit chan admitRequest
+
+	// changes to the room's settings, applied by the room's goroutine
+	update chan func(r *Room)
 }
 
 func newRoom(hub *Hub) *Room {
@@ -30,10 +70,140 @@ func newRoom(hub *Hub) *Room {
 		hub: hub,
 		capacity: 2,
 		name: "",
+		visibility: RoomPrivate,
 		broadcast:	make(chan Event),
-		users:		make(map[string]bool),
+		broadcastFiltered: make(chan filteredEvent),
+		users:		make(map[int]User),
 		register:	make(chan *User),
 		unregister:	make(chan *User),
+		updateLastMessage: make(chan func(last *NewMessageEvent)),
+		describe:	make(chan describeRequest),
+		admit:		make(chan admitRequest),
+		update:		make(chan func(r *Room)),
+	}
+}
+
+// an event to broadcast to every member except the skipped ones
+type filteredEvent struct {
+	event Event
+	skip map[int]bool
+}
+
+// asks the room's goroutine for the NewRoomEvent describing the room to one of its members
+type describeRequest struct {
+	userId int
+	hidePresence map[int]bool
+	reply chan NewRoomEvent
+}
+
+// returns the NewRoomEvent describing the room to one of its members,
+// built on the room's goroutine so it sees a consistent room
+func (r *Room) describeTo(userId int, hidePresence map[int]bool) NewRoomEvent {
+	reply := make(chan NewRoomEvent, 1)
+	r.describe <- describeRequest{userId: userId, hidePresence: hidePresence, reply: reply}
+	return <-reply
+}
+
+// asks the room's goroutine whether a user can join the room
+type admitRequest struct {
+	user *User
+	// add the user to the members when they can join
+	register bool
+	reply chan error
+}
+
+// returns ErrAlreadyRoomMember or ErrRoomFull when the user can't join the room,
+// checked on the room's goroutine against its current members
+func (r *Room) canJoin(userId int) error {
+	reply := make(chan error, 1)
+	r.admit <- admitRequest{user: &User{id: userId}, reply: reply}
+	return <-reply
+}
+
+// adds the user to the members if they can join, in one step on the room's goroutine
+// so two joins can't both take the last place
+func (r *Room) join(user *User) error {
+	reply := make(chan error, 1)
+	r.admit <- admitRequest{user: user, register: true, reply: reply}
+	return <-reply
+}
+
+// whether the user can join, on the room's goroutine
+func (r *Room) admissible(userId int) error {
+	if _, ok := r.users[userId]; ok {
+		return ErrAlreadyRoomMember
+	}
+	if len(r.users) >= r.capacity {
+		return ErrRoomFull
+	}
+	return nil
+}
+
+// builds the NewRoomEvent describing the room to one of its members, on the room's goroutine.
+// the room's own name takes priority over the one generated from the other members' usernames.
+// members in hidePresence always appear offline
+func (r *Room) newRoomEvent(userId int, hidePresence map[int]bool) NewRoomEvent {
+	var roomUsers []RoomUser
+	var names []string
+	for member, user := range r.users {
+		if member == userId {
+			continue
+		}
+		online := r.hub.isConnected(member) && !hidePresence[member]
+		roomUsers = append(roomUsers, RoomUser{Id: member, Username: user.username, DisplayName: user.displayName, Online: online, Typing: false})
+		names = append(names, user.username)
+	}
+	sort.Strings(names)
+
+	name := r.name
+	if name == "" {
+		name = strings.Join(names, ", ")
+	}
+	return NewRoomEvent{
+		Id: r.id,
+		Name: name,
+		Topic: r.topic,
+		Description: r.description,
+		Avatar: r.avatar,
+		Encrypted: r.encrypted,
+		Visibility: r.visibility,
+		Retention: r.retentionPolicy(),
+		Users: roomUsers,
+		LastMessage: r.lastMessage,
+	}
+}
+
+// broadcasts a system message to every member of the room
+func (r *Room) sendSystemMessage(message SystemMessageEvent) error {
+	message.RoomId = r.id
+	message.Sent = time.Now()
+	data, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventSystemMessage
+	r.broadcast <- outgoingEvent
+	return nil
+}
+
+// runs f on the room's goroutine, where it can read and change the room's settings, and waits for it.
+// f must not use the room's channels
+func (r *Room) apply(f func(r *Room)) {
+	done := make(chan struct{})
+	r.update <- func(r *Room) {
+		f(r)
+		close(done)
+	}
+	<-done
+}
+
+// replaces the room's last message
+func (r *Room) setLastMessage(message NewMessageEvent) {
+	r.updateLastMessage <- func(last *NewMessageEvent) {
+		*last = message
 	}
 }
 
@@ -41,14 +211,30 @@ func (r *Room) run() {
 	for {
 		select {
 		case user := <-r.register:
-			r.users[user.username] = true
+			// also how a member's new username or display name is picked up
+			r.users[user.id] = *user
 		case user := <-r.unregister:
-			if _, ok := r.users[user.username]; ok {
-				delete(r.users, user.username)
+			if _, ok := r.users[user.id]; ok {
+				delete(r.users, user.id)
+			}
+		case update := <-r.updateLastMessage:
+			update(&r.lastMessage)
+		case update := <-r.update:
+			update(r)
+		case request := <-r.describe:
+			request.reply <- r.newRoomEvent(request.userId, request.hidePresence)
+		case request := <-r.admit:
+			err := r.admissible(request.user.id)
+			if err == nil && request.register {
+				r.users[request.user.id] = *request.user
 			}
+			request.reply <- err
 		case event := <-r.broadcast:
 			for user := range r.users {
-				for client := range r.hub.clients[user] {
+				for _, client := range r.hub.clientsOf(user) {
+					if !client.accepts(event) {
+						continue
+					}
 					select {
 					case client.send <- event:
 					default:
@@ -56,6 +242,22 @@ func (r *Room) run() {
 					}
 				}
 			}
+		case filtered := <-r.broadcastFiltered:
+			for user := range r.users {
+				if filtered.skip[user] {
+					continue
+				}
+				for _, client := range r.hub.clientsOf(user) {
+					if !client.accepts(filtered.event) {
+						continue
+					}
+					select {
+					case client.send <- filtered.event:
+					default:
+						r.hub.unregister <- client
+					}
+				}
+			}
 		}
 	}
 }
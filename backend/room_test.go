@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// a running direct room without a database behind it
+func newTestRoom(t *testing.T) *Room {
+	t.Helper()
+	config := defaultConfig()
+	room := newRoom(&Hub{clients: make(map[int]map[*Client]bool), config: &config})
+	room.id = 1
+	go room.run()
+	return room
+}
+
+func TestRoomCanJoin(t *testing.T) {
+	room := newTestRoom(t)
+	if err := room.canJoin(1); err != nil {
+		t.Errorf("canJoin on an empty room = %v", err)
+	}
+	room.register <- newUser(1, "alice")
+	if err := room.canJoin(1); !errors.Is(err, ErrAlreadyRoomMember) {
+		t.Errorf("canJoin of a member = %v, want %v", err, ErrAlreadyRoomMember)
+	}
+	room.register <- newUser(2, "bob")
+	if err := room.canJoin(3); !errors.Is(err, ErrRoomFull) {
+		t.Errorf("canJoin of a full room = %v, want %v", err, ErrRoomFull)
+	}
+	if got := len(room.describeTo(0, nil).Users); got != 2 {
+		t.Errorf("room described to no member lists %d users, want 2", got)
+	}
+}
+
+// of many users joining at once, only as many as there are places get in
+func TestRoomJoinIsAtomic(t *testing.T) {
+	room := newTestRoom(t)
+	room.capacity = 3
+
+	errs := make(chan error)
+	for id := 1; id <= 10; id++ {
+		go func() {
+			errs <- room.join(newUser(id, fmt.Sprint("user", id)))
+		}()
+	}
+	joined := 0
+	for range 10 {
+		err := <-errs
+		if err == nil {
+			joined++
+		} else if !errors.Is(err, ErrRoomFull) {
+			t.Errorf("join = %v, want %v", err, ErrRoomFull)
+		}
+	}
+	if joined != 3 {
+		t.Errorf("%d users joined a room of 3", joined)
+	}
+	if err := room.join(newUser(1, "user1")); !errors.Is(err, ErrAlreadyRoomMember) && !errors.Is(err, ErrRoomFull) {
+		t.Errorf("second join = %v", err)
+	}
+}
+
+func TestRoomApply(t *testing.T) {
+	room := newTestRoom(t)
+	room.apply(func(r *Room) {
+		r.name = "general"
+		r.topic = "anything"
+	})
+	described := room.describeTo(0, nil)
+	if described.Name != "general" || described.Topic != "anything" {
+		t.Errorf("room described as %q %q after apply", described.Name, described.Topic)
+	}
+}
+
+func TestRoomCheckEncryption(t *testing.T) {
+	room := newTestRoom(t)
+	if err := room.checkEncryption(&SendMessageEvent{Message: "hi"}); err != nil {
+		t.Errorf("plain message in a plain room = %v", err)
+	}
+	room.apply(func(r *Room) {
+		r.encrypted = true
+	})
+	if err := room.checkEncryption(&SendMessageEvent{Message: "hi"}); !errors.Is(err, ErrEncryptionRequired) {
+		t.Errorf("plain message in an encrypted room = %v, want %v", err, ErrEncryptionRequired)
+	}
+}
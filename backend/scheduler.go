@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// schedule a message to be posted later
+	EventScheduleMessage = "schedule_message"
+	// response to schedule_message
+	EventMessageScheduled = "message_scheduled"
+	// get the messages the user scheduled
+	EventListScheduled = "list_scheduled"
+	// delete a scheduled message before it is posted
+	EventCancelScheduled = "cancel_scheduled"
+	// response to list_scheduled and cancel_scheduled
+	EventScheduledMessages = "scheduled_messages"
+	// a scheduled message couldn't be posted, sent to its author
+	EventScheduledMessageFailed = "scheduled_message_failed"
+)
+
+// status of a scheduled message
+const (
+	ScheduledPending = "pending"
+	// claimed by the scheduler, being posted
+	ScheduledSending = "sending"
+	ScheduledFailed = "failed"
+)
+
+// furthest in the future a message can be scheduled
+const maxScheduleAhead = 365 * 24 * time.Hour
+
+var (
+	ErrTooManyScheduled = errors.New("too many scheduled messages")
+	ErrScheduleInPast = errors.New("send_at must be in the future")
+)
+
+// a message waiting to be posted by the scheduler
+type ScheduledMessage struct {
+	Id int `json:"id"`
+	RoomId int `json:"room_id"`
+	Message string `json:"message"`
+	Encrypted bool `json:"encrypted"`
+	Envelope *EncryptedEnvelope `json:"envelope,omitempty"`
+	Format string `json:"format"`
+	SendAt time.Time `json:"send_at"`
+	Status string `json:"status"`
+	// why it couldn't be posted, when it failed
+	Error string `json:"error,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+
+	authorId int
+}
+
+type ScheduleMessageEvent struct {
+	RoomId int `json:"room_id"`
+	Message string `json:"message"`
+	Encrypted bool `json:"encrypted"`
+	Envelope *EncryptedEnvelope `json:"envelope"`
+	// plain or markdown, plain when empty
+	Format string `json:"format"`
+	// RFC 3339
+	SendAt time.Time `json:"send_at"`
+}
+
+type ListScheduledEvent struct {
+	// every room when 0
+	RoomId int `json:"room_id"`
+}
+
+type CancelScheduledEvent struct {
+	Id int `json:"id"`
+}
+
+type ScheduledMessagesEvent struct {
+	RoomId int `json:"room_id"`
+	Messages []ScheduledMessage `json:"messages"`
+}
+
+// MessageScheduler posts scheduled messages once they are due.
+// they are kept in the database so a restart doesn't lose them
+type MessageScheduler struct {
+	hub *Hub
+
+	config SchedulerConfig
+
+	// wakes the scheduler up when a message is scheduled
+	wake chan struct{}
+}
+
+func newMessageScheduler(h *Hub, config SchedulerConfig) *MessageScheduler {
+	return &MessageScheduler{
+		hub: h,
+		config: config,
+		wake: make(chan struct{}, 1),
+	}
+}
+
+// posts due messages until ctx is cancelled
+func (s *MessageScheduler) run(ctx context.Context) {
+	// messages interrupted by a restart are posted again
+	if err := s.hub.db.resetInterruptedScheduledMessages(); err != nil {
+		log.Println("Error resetting scheduled messages: ", err)
+	}
+
+	for {
+		s.postDueMessages(ctx)
+
+		// sleep until the next message is due, checking the database at least every poll interval
+		wait := time.Duration(s.config.PollInterval)
+		next, ok, err := s.hub.db.getNextScheduledAt()
+		if err != nil {
+			log.Println("Error retrieving the next scheduled message: ", err)
+		} else if ok {
+			wait = max(min(wait, time.Until(next)), 0)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// wakes the scheduler up, without blocking
+func (s *MessageScheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *MessageScheduler) postDueMessages(ctx context.Context) {
+	for ctx.Err() == nil {
+		messages, err := s.hub.db.claimScheduledMessages(time.Now(), s.config.BatchSize)
+		if err != nil {
+			log.Println("Error claiming scheduled messages: ", err)
+			return
+		}
+		for _, message := range messages {
+			s.post(message)
+		}
+		if len(messages) < s.config.BatchSize {
+			return
+		}
+	}
+}
+
+// posts the message like its author would have, or tells them why it couldn't be
+func (s *MessageScheduler) post(message ScheduledMessage) {
+	// a posted message was removed from scheduled_messages along with its insert
+	err := s.hub.postScheduledMessage(message)
+	if err == nil {
+		return
+	}
+
+	message.Status = ScheduledFailed
+	message.Error = err.Error()
+	if err := s.hub.db.failScheduledMessage(message.Id, message.Error); err != nil {
+		log.Println("Error failing scheduled message: ", err)
+	}
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("failed to marshal broadcast message: ", err)
+		return
+	}
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventScheduledMessageFailed
+	s.hub.sendToUser(message.authorId, outgoingEvent)
+}
+
+// posts a scheduled message through postMessage, as its author is now.
+// commands were not run when it was scheduled, so it is posted verbatim
+func (h *Hub) postScheduledMessage(message ScheduledMessage) error {
+	user, err := h.db.getUser(message.authorId)
+	if err != nil {
+		return err
+	}
+	_, err = h.postMessage(user, SendMessageEvent{
+		RoomId: message.RoomId,
+		Message: message.Message,
+		Encrypted: message.Encrypted,
+		Envelope: message.Envelope,
+		Format: message.Format,
+		scheduledId: message.Id,
+	})
+	return err
+}
+
+func ScheduleMessageHandler(event Event, c *Client) error {
+	var e ScheduleMessageEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	room, ok := c.hub.getRoom(e.RoomId)
+	if !ok {
+		return RoomNotFoundError
+	}
+	if _, err := c.hub.db.getRoomRole(room.id, c.user.id); err != nil {
+		return err
+	}
+	message := SendMessageEvent{
+		RoomId: room.id,
+		Message: e.Message,
+		Encrypted: e.Encrypted,
+		Envelope: e.Envelope,
+		Format: e.Format,
+	}
+	if err := c.checkMessageFeatures(message); err != nil {
+		return err
+	}
+	if err := room.checkEncryption(&message); err != nil {
+		return err
+	}
+	// rendered again when it is posted, this only checks the format
+	if _, err := renderMessage(&message); err != nil {
+		return err
+	}
+	if !message.Encrypted && message.Message == "" {
+		return fmt.Errorf("can't schedule an empty message")
+	}
+	until := time.Until(e.SendAt)
+	if until <= 0 {
+		return ErrScheduleInPast
+	}
+	if until > maxScheduleAhead {
+		return fmt.Errorf("messages can't be scheduled more than %s ahead", maxScheduleAhead)
+	}
+
+	count, err := c.hub.db.countScheduledMessages(c.user.id)
+	if err != nil {
+		return err
+	}
+	if count >= c.hub.config.Scheduler.MaxPerUser {
+		return ErrTooManyScheduled
+	}
+
+	scheduled := ScheduledMessage{
+		RoomId: room.id,
+		Message: message.Message,
+		Encrypted: message.Encrypted,
+		Envelope: message.Envelope,
+		Format: message.Format,
+		SendAt: e.SendAt,
+		authorId: c.user.id,
+	}
+	if err := c.hub.db.addScheduledMessage(&scheduled); err != nil {
+		return err
+	}
+	c.hub.scheduler.notify()
+
+	data, err := json.Marshal(scheduled)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventMessageScheduled
+	c.send <- outgoingEvent
+	return nil
+}
+
+func ListScheduledHandler(event Event, c *Client) error {
+	var e ListScheduledEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	return sendScheduledMessages(c, e.RoomId)
+}
+
+func CancelScheduledHandler(event Event, c *Client) error {
+	var e CancelScheduledEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	ok, err := c.hub.db.deleteScheduledMessage(e.Id, c.user.id)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ScheduledMessageNotFoundError
+	}
+	return sendScheduledMessages(c, 0)
+}
+
+func sendScheduledMessages(c *Client, roomId int) error {
+	messages, err := c.hub.db.getScheduledMessages(c.user.id, roomId)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(ScheduledMessagesEvent{RoomId: roomId, Messages: messages})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventScheduledMessages
+	c.send <- outgoingEvent
+	return nil
+}
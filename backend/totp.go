@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// issuer shown by authenticator apps
+	totpIssuer = "GoChat"
+
+	// RFC 6238 parameters, the defaults every authenticator app supports
+	totpDigits = 6
+	totpPeriod = 30
+
+	// accepted clock drift, in steps, on each side of the current one
+	totpSkew = 1
+
+	// number of recovery codes handed out on confirmation
+	recoveryCodeCount = 10
+
+	// wrong codes a user can enter in a row before the second factor is locked
+	maxSecondFactorAttempts = 5
+	secondFactorLockout = 15 * time.Minute
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// returns a new random base32 encoded 160 bits secret
+func generateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// returns the otpauth URI authenticator apps use to enroll a secret
+func totpURI(username string, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+// computes the HOTP value (RFC 4226) of secret for the given counter
+func hotpCode(secret string, counter int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+// checks code against secret at time t and returns the matching time step.
+// steps lower or equal to lastStep are rejected so a code can't be replayed
+func validateTOTP(secret string, code string, t time.Time, lastStep int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	current := t.Unix() / totpPeriod
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := hotpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// attemptLimiter locks a user out of the second factor after too many wrong codes in a row,
+// so the million codes can't be guessed
+type attemptLimiter struct {
+	mu sync.Mutex
+	max int
+	lockout time.Duration
+	users map[int]*attempts
+	// when the users were last pruned
+	pruned time.Time
+}
+
+type attempts struct {
+	count int
+	last time.Time
+	lockedUntil time.Time
+}
+
+func newAttemptLimiter(max int, lockout time.Duration) *attemptLimiter {
+	return &attemptLimiter{max: max, lockout: lockout, users: make(map[int]*attempts)}
+}
+
+// counts an attempt of the user at time now, returns false while they are locked out.
+// the attempt counts as failed until reset is called
+func (l *attemptLimiter) attempt(userId int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.pruned) >= l.lockout {
+		l.prune(now)
+	}
+	a, ok := l.users[userId]
+	if !ok {
+		a = &attempts{}
+		l.users[userId] = a
+	}
+	if now.Before(a.lockedUntil) {
+		return false
+	}
+	if !a.lockedUntil.IsZero() {
+		*a = attempts{}
+	}
+	a.count++
+	a.last = now
+	if a.count >= l.max {
+		a.lockedUntil = now.Add(l.lockout)
+	}
+	return true
+}
+
+// forgets the users whose lockout is over, and those who made no attempt for as long as a lockout.
+// l.mu must be held
+func (l *attemptLimiter) prune(now time.Time) {
+	for userId, a := range l.users {
+		if !now.Before(a.lockedUntil) && now.Sub(a.last) >= l.lockout {
+			delete(l.users, userId)
+		}
+	}
+	l.pruned = now
+}
+
+// forgets the attempts of the user, after a valid code
+func (l *attemptLimiter) reset(userId int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.users, userId)
+}
+
+// returns n random recovery codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+	for i := range codes {
+		buf := make([]byte, 7)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(totpEncoding.EncodeToString(buf))[:10]
+		codes[i] = s[:5] + "-" + s[5:]
+	}
+	return codes, nil
+}
+
+// normalises user input of a recovery code before hashing or comparing
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(strings.TrimSpace(code))
+	code = strings.ReplaceAll(code, " ", "")
+	if len(code) == 10 {
+		code = code[:5] + "-" + code[5:]
+	}
+	return code
+}
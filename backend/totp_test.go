@@ -0,0 +1,113 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// the SHA1 secret of RFC 6238, "12345678901234567890"
+var rfc6238Secret = totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+// RFC 6238, Appendix B. the RFC's codes have 8 digits, ours are their last 6
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestHOTPCodeVectors(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		code, err := hotpCode(rfc6238Secret, v.unix/totpPeriod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != v.code {
+			t.Errorf("hotpCode at %d = %s, want %s", v.unix, code, v.code)
+		}
+	}
+}
+
+func TestValidateTOTPVectors(t *testing.T) {
+	for _, v := range rfc6238Vectors {
+		now := time.Unix(v.unix, 0)
+		step, ok := validateTOTP(rfc6238Secret, v.code, now, 0)
+		if !ok || step != v.unix/totpPeriod {
+			t.Errorf("validateTOTP(%s) at %d = %d, %v", v.code, v.unix, step, ok)
+		}
+		// one step of clock drift either way is accepted
+		if _, ok := validateTOTP(rfc6238Secret, v.code, now.Add(totpPeriod*time.Second), 0); !ok {
+			t.Errorf("code %s isn't accepted one step later", v.code)
+		}
+		if _, ok := validateTOTP(rfc6238Secret, v.code, now.Add(3*totpPeriod*time.Second), 0); ok {
+			t.Errorf("code %s is accepted three steps later", v.code)
+		}
+		// a used step can't be replayed
+		if _, ok := validateTOTP(rfc6238Secret, v.code, now, step); ok {
+			t.Errorf("code %s is accepted again", v.code)
+		}
+	}
+	if _, ok := validateTOTP(rfc6238Secret, "28708", time.Unix(59, 0), 0); ok {
+		t.Error("a 5 digits code is accepted")
+	}
+}
+
+func TestAttemptLimiter(t *testing.T) {
+	l := newAttemptLimiter(3, time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		if !l.attempt(1, now) {
+			t.Fatalf("attempt %d is refused", i+1)
+		}
+	}
+	if l.attempt(1, now) {
+		t.Error("an attempt is allowed after 3 wrong codes")
+	}
+	if !l.attempt(2, now) {
+		t.Error("another user is locked out")
+	}
+	if l.attempt(1, now.Add(59*time.Second)) {
+		t.Error("an attempt is allowed during the lockout")
+	}
+	if !l.attempt(1, now.Add(time.Minute)) {
+		t.Error("an attempt is refused after the lockout")
+	}
+
+	// a valid code clears the wrong ones
+	l.attempt(2, now)
+	l.reset(2)
+	for i := 0; i < 3; i++ {
+		if !l.attempt(2, now) {
+			t.Fatalf("attempt %d after a reset is refused", i+1)
+		}
+	}
+}
+
+// users whose lockout is over, or who stopped trying, don't stay in memory
+func TestAttemptLimiterPrunes(t *testing.T) {
+	l := newAttemptLimiter(3, time.Minute)
+	now := time.Unix(1700000000, 0)
+
+	for i := 0; i < 3; i++ {
+		l.attempt(1, now)
+	}
+	l.attempt(2, now)
+	l.attempt(3, now.Add(30*time.Second))
+
+	l.attempt(4, now.Add(time.Minute))
+	if _, ok := l.users[1]; ok {
+		t.Error("a user whose lockout is over is kept")
+	}
+	if _, ok := l.users[2]; ok {
+		t.Error("a user who stopped trying is kept")
+	}
+	if _, ok := l.users[3]; !ok {
+		t.Error("a recent attempt is forgotten")
+	}
+}
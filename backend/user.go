@@ -1,16 +1,352 @@
 package main
 
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// change the user's username
+	EventChangeUsername = "change_username"
+	// response to change_username, sent to the user and to every member of their rooms
+	EventUsernameChanged = "username_changed"
+	// get a user's profile
+	EventGetProfile = "get_profile"
+	// response to get_profile
+	EventProfile = "profile"
+	// change the user's display name, avatar, bio or status
+	EventUpdateProfile = "update_profile"
+	// response to update_profile, sent to the user and to every member of their rooms
+	EventProfileUpdated = "profile_updated"
+	// find users by the start of their username or display name
+	EventSearchUsers = "search_users"
+	// response to search_users
+	EventUserSearchResults = "user_search_results"
+)
+
+const (
+	maxDisplayNameLength = 64
+	maxUserAvatarLength = 1024
+	maxBioLength = 1024
+	maxStatusTextLength = 128
+	maxSearchQueryLength = 64
+
+	defaultUserSearchPage = 20
+	maxUserSearchPage = 50
+)
+
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+var (
+	ErrUsernameTaken = errors.New("username already taken")
+	ErrBadUsername = errors.New("username must be 1 to 64 letters, digits, '.', '_' or '-'")
+	ErrEmptySearch = errors.New("search query is empty")
+)
 
 type User struct {
+	// never changes, unlike the username
+	id int
+
 	username string
 
+	// shown instead of the username when not empty
+	displayName string
+
 	online bool
+
+	// bot accounts authenticate with API tokens instead of a password
+	bot bool
 }
 
-func newUser(username string) *User {
+func newUser(id int, username string) *User {
 	return &User{
+		id: id,
 		username: username,
 		online: false,
 	}
 }
 
+// checks a new username can be used. "room" would collide with @room mentions
+func validateUsername(username string) error {
+	if !usernamePattern.MatchString(username) || username == roomMention {
+		return ErrBadUsername
+	}
+	return nil
+}
+
+type ChangeUsernameEvent struct {
+	Username string `json:"username"`
+}
+
+type UsernameChangedEvent struct {
+	UserId int `json:"user_id"`
+	OldUsername string `json:"old_username"`
+	Username string `json:"username"`
+}
+
+// what everyone can see about a user
+type Profile struct {
+	Id int `json:"id"`
+	Username string `json:"username"`
+	DisplayName string `json:"display_name"`
+	// reference to the user's avatar attachment
+	Avatar string `json:"avatar"`
+	Bio string `json:"bio"`
+	StatusText string `json:"status_text"`
+	Bot bool `json:"bot,omitempty"`
+}
+
+// the user is looked up by id, or by username when id is 0. both empty is the user themselves
+type GetProfileEvent struct {
+	Id int `json:"id"`
+	Username string `json:"username"`
+}
+
+// fields left out are not changed
+type UpdateProfileEvent struct {
+	DisplayName *string `json:"display_name"`
+	Avatar *string `json:"avatar"`
+	Bio *string `json:"bio"`
+	StatusText *string `json:"status_text"`
+}
+
+type SearchUsersEvent struct {
+	Query string `json:"query"`
+	// only return users whose username sorts after this one, for pagination
+	After string `json:"after"`
+	Limit int `json:"limit"`
+}
+
+type UserSearchResultsEvent struct {
+	Query string `json:"query"`
+	Users []Profile `json:"users"`
+	// After of the next page, empty on the last one
+	Next string `json:"next"`
+}
+
+func ChangeUsernameHandler(event Event, c *Client) error {
+	var e ChangeUsernameEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	if err := validateUsername(e.Username); err != nil {
+		return err
+	}
+	if e.Username == c.user.username {
+		return nil
+	}
+	if _, err := c.hub.db.getUserByUsername(e.Username); err == nil {
+		return ErrUsernameTaken
+	}
+
+	oldUsername := c.user.username
+	if err := c.hub.db.setUsername(c.user.id, e.Username); err != nil {
+		return err
+	}
+	recipients, err := c.hub.refreshUser(c.user.id)
+	if err != nil {
+		return err
+	}
+	c.applyRename()
+
+	data, err := json.Marshal(UsernameChangedEvent{UserId: c.user.id, OldUsername: oldUsername, Username: e.Username})
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventUsernameChanged
+	c.hub.sendToUsers(recipients, outgoingEvent)
+	return nil
+}
+
+// reloads the user's username and display name everywhere they are held in memory, after they changed.
+// returns the ids of everyone sharing a room with them, themselves included
+func (h *Hub) refreshUser(userId int) (map[int]bool, error) {
+	user, err := h.db.getUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	// each client takes the new names on its own goroutine
+	done := make(chan struct{})
+	h.rename <- renameRequest{user: user, done: done}
+	<-done
+
+	roomIds, err := h.db.getRooms(userId)
+	if err != nil {
+		return nil, err
+	}
+	recipients := map[int]bool{userId: true}
+	for _, roomId := range roomIds {
+		room, ok := h.getRoom(roomId)
+		if !ok {
+			continue
+		}
+		room.register <- user
+		room.updateLastMessage <- func(last *NewMessageEvent) {
+			if last.FromId == userId {
+				last.From = user.username
+				last.FromDisplayName = user.displayName
+			}
+		}
+		for _, member := range room.describeTo(userId, nil).Users {
+			recipients[member.Id] = true
+		}
+	}
+	return recipients, nil
+}
+
+// asks the hub to hand a user's new names to their clients, done is closed once it did
+type renameRequest struct {
+	user *User
+	done chan struct{}
+}
+
+// sends the event once to each recipient, however many rooms they share
+func (h *Hub) sendToUsers(recipients map[int]bool, event Event) {
+	for recipient := range recipients {
+		h.sendToUser(recipient, event)
+	}
+}
+
+func GetProfileHandler(event Event, c *Client) error {
+	var e GetProfileEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	userId := e.Id
+	if userId == 0 && e.Username != "" {
+		user, err := c.hub.db.getUserByUsername(e.Username)
+		if err != nil {
+			return err
+		}
+		userId = user.id
+	}
+	if userId == 0 {
+		userId = c.user.id
+	}
+	if userId != c.user.id {
+		blocked, err := c.hub.db.isBlockedEitherWay(c.user.id, userId)
+		if err != nil {
+			return err
+		}
+		if blocked {
+			return ErrUserBlocked
+		}
+	}
+
+	profile, err := c.hub.db.getProfile(userId)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventProfile
+	c.send <- outgoingEvent
+	return nil
+}
+
+func UpdateProfileHandler(event Event, c *Client) error {
+	var update UpdateProfileEvent
+	if err := json.Unmarshal(event.Payload, &update); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+
+	// validate everything before changing the profile
+	if update.DisplayName != nil && len(strings.TrimSpace(*update.DisplayName)) > maxDisplayNameLength {
+		return fmt.Errorf("display name is longer than %d characters", maxDisplayNameLength)
+	}
+	if update.Avatar != nil && len(*update.Avatar) > maxUserAvatarLength {
+		return fmt.Errorf("avatar reference is longer than %d characters", maxUserAvatarLength)
+	}
+	if update.Bio != nil && len(*update.Bio) > maxBioLength {
+		return fmt.Errorf("bio is longer than %d characters", maxBioLength)
+	}
+	if update.StatusText != nil && len(strings.TrimSpace(*update.StatusText)) > maxStatusTextLength {
+		return fmt.Errorf("status is longer than %d characters", maxStatusTextLength)
+	}
+
+	profile, err := c.hub.db.getProfile(c.user.id)
+	if err != nil {
+		return err
+	}
+	if update.DisplayName != nil {
+		profile.DisplayName = strings.TrimSpace(*update.DisplayName)
+	}
+	if update.Avatar != nil {
+		profile.Avatar = strings.TrimSpace(*update.Avatar)
+	}
+	if update.Bio != nil {
+		profile.Bio = *update.Bio
+	}
+	if update.StatusText != nil {
+		profile.StatusText = strings.TrimSpace(*update.StatusText)
+	}
+	if err := c.hub.db.updateProfile(profile); err != nil {
+		return err
+	}
+	recipients, err := c.hub.refreshUser(c.user.id)
+	if err != nil {
+		return err
+	}
+	c.applyRename()
+
+	data, err := json.Marshal(profile)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventProfileUpdated
+	c.hub.sendToUsers(recipients, outgoingEvent)
+	return nil
+}
+
+func SearchUsersHandler(event Event, c *Client) error {
+	var e SearchUsersEvent
+	if err := json.Unmarshal(event.Payload, &e); err != nil {
+		return fmt.Errorf("bad payload in request: %v", err)
+	}
+	query := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(e.Query), "@"))
+	if query == "" {
+		return ErrEmptySearch
+	}
+	if len(query) > maxSearchQueryLength {
+		return fmt.Errorf("search query is longer than %d characters", maxSearchQueryLength)
+	}
+	if e.Limit <= 0 {
+		e.Limit = defaultUserSearchPage
+	}
+	e.Limit = min(e.Limit, maxUserSearchPage)
+
+	users, err := c.hub.db.searchUsers(c.user.id, query, e.After, e.Limit)
+	if err != nil {
+		return err
+	}
+	results := UserSearchResultsEvent{Query: e.Query, Users: users}
+	if len(users) == e.Limit {
+		results.Next = users[len(users)-1].Username
+	}
+
+	data, err := json.Marshal(results)
+	if err != nil {
+		return fmt.Errorf("failed to marshal broadcast message: %v", err)
+	}
+
+	var outgoingEvent Event
+	outgoingEvent.Payload = data
+	outgoingEvent.Type = EventUserSearchResults
+	c.send <- outgoingEvent
+	return nil
+}
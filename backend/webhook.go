@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// events that can be sent to webhooks, on top of EventNewMessage and EventRoomUpdated
+const (
+	WebhookMemberJoined = "member_joined"
+	WebhookMemberLeft = "member_left"
+)
+
+var webhookEvents = map[string]bool{
+	EventNewMessage: true,
+	EventRoomUpdated: true,
+	WebhookMemberJoined: true,
+	WebhookMemberLeft: true,
+}
+
+var (
+	ErrNotSiteAdmin = errors.New("only administrators can manage global webhooks")
+)
+
+// A Webhook receives signed POST requests for the events of a room, or of every room when RoomId is 0
+type Webhook struct {
+	Id        int       `json:"id"`
+	RoomId    int       `json:"room_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	CreatedBy string    `json:"created_by"`
+	CreatedAt time.Time `json:"created_at"`
+
+	// key of the HMAC signature, only shown when the webhook is created
+	secret string
+
+	// id of the user named in CreatedBy
+	creatorId int
+}
+
+// body of every webhook request
+type webhookPayload struct {
+	Event     string    `json:"event"`
+	RoomId    int       `json:"room_id"`
+	Timestamp time.Time `json:"timestamp"`
+	Data      any       `json:"data"`
+}
+
+// payload of member_joined and member_left
+type WebhookMemberEvent struct {
+	RoomId   int    `json:"room_id"`
+	Username string `json:"username"`
+	// who added or removed the member, empty when they did it themselves
+	Actor string `json:"actor,omitempty"`
+}
+
+// a queued request to a webhook
+type webhookDelivery struct {
+	id        int
+	webhookId int
+	eventType string
+	payload   string
+	attempts  int
+}
+
+// WebhookDispatcher queues webhook deliveries in the database and sends them in the background,
+// retrying failures with exponential backoff
+type WebhookDispatcher struct {
+	// webhook URLs are chosen by room admins, they must not reach the server's network
+	addrFilter
+
+	db *Database
+
+	client *http.Client
+
+	config WebhookConfig
+
+	// wakes the worker up when new deliveries are queued
+	wake chan struct{}
+}
+
+func newWebhookDispatcher(db *Database, config WebhookConfig) *WebhookDispatcher {
+	d := &WebhookDispatcher{
+		addrFilter: addrFilter{allowAddr: isPublicAddr},
+		db: db,
+		config: config,
+		wake: make(chan struct{}, 1),
+	}
+	d.client = &http.Client{
+		Timeout: time.Duration(config.Timeout),
+		Transport: d.transport(time.Duration(config.Timeout)),
+		// a redirect is answered like any other non 2xx status
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	return d
+}
+
+// queues the event for the webhooks subscribed to it. failures are logged, they never fail the chat action
+func (d *WebhookDispatcher) enqueue(roomId int, eventType string, data any) {
+	payload, err := json.Marshal(webhookPayload{
+		Event: eventType,
+		RoomId: roomId,
+		Timestamp: time.Now().UTC(),
+		Data: data,
+	})
+	if err != nil {
+		log.Println("Error marshalling webhook payload: ", err)
+		return
+	}
+
+	n, err := d.db.enqueueWebhookDeliveries(roomId, eventType, payload)
+	if err != nil {
+		log.Println("Error queueing webhook deliveries: ", err)
+		return
+	}
+	if n > 0 {
+		select {
+		case d.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// delivers queued requests until ctx is cancelled
+func (d *WebhookDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Duration(d.config.PollInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-d.wake:
+		}
+		d.processDue(ctx)
+	}
+}
+
+// sends every delivery that is due, batch by batch
+func (d *WebhookDispatcher) processDue(ctx context.Context) {
+	// a claimed delivery is retried by the next poll if this worker dies mid attempt
+	lease := 2 * time.Duration(d.config.Timeout)
+	for ctx.Err() == nil {
+		deliveries, err := d.db.claimWebhookDeliveries(d.config.BatchSize, lease)
+		if err != nil {
+			log.Println("Error claiming webhook deliveries: ", err)
+			return
+		}
+		if len(deliveries) == 0 {
+			return
+		}
+
+		webhooks := make(map[int]*Webhook)
+		for _, delivery := range deliveries {
+			webhook, ok := webhooks[delivery.webhookId]
+			if !ok {
+				webhook, err = d.db.getWebhook(delivery.webhookId)
+				if err != nil {
+					// deleted webhooks take their deliveries with them
+					log.Println("Error retrieving webhook: ", err)
+					continue
+				}
+				webhooks[delivery.webhookId] = webhook
+			}
+			d.attempt(ctx, webhook, delivery)
+		}
+	}
+}
+
+// makes one attempt and records its outcome
+func (d *WebhookDispatcher) attempt(ctx context.Context, webhook *Webhook, delivery webhookDelivery) {
+	err := d.send(ctx, webhook, delivery)
+	if err == nil {
+		if err := d.db.completeWebhookDelivery(delivery.id); err != nil {
+			log.Println("Error completing webhook delivery: ", err)
+		}
+		return
+	}
+
+	attempts := delivery.attempts + 1
+	if backoff, retry := d.retryAfter(attempts); retry {
+		err = d.db.retryWebhookDelivery(delivery.id, attempts, backoff, err.Error())
+	} else {
+		log.Printf("webhook %d: giving up on delivery %d after %d attempts: %v", webhook.Id, delivery.id, attempts, err)
+		err = d.db.deadLetterWebhookDelivery(delivery.id, attempts, err.Error())
+	}
+	if err != nil {
+		log.Println("Error recording webhook delivery failure: ", err)
+	}
+}
+
+// returns the delay before retrying a delivery that failed the given number of attempts,
+// false when it used them all and goes to the dead letters
+func (d *WebhookDispatcher) retryAfter(attempts int) (time.Duration, bool) {
+	if attempts >= d.config.MaxAttempts {
+		return 0, false
+	}
+	return d.backoff(attempts), true
+}
+
+// delay before the attempt following the given number of failed attempts
+func (d *WebhookDispatcher) backoff(attempts int) time.Duration {
+	backoff := time.Duration(d.config.InitialBackoff)
+	for i := 1; i < attempts && backoff < time.Duration(d.config.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	return min(backoff, time.Duration(d.config.MaxBackoff))
+}
+
+// POSTs the delivery's payload to the webhook. any non 2xx answer is a failure
+func (d *WebhookDispatcher) send(ctx context.Context, webhook *Webhook, delivery webhookDelivery) error {
+	body := []byte(delivery.payload)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GoChat-Webhook/1.0")
+	req.Header.Set("X-GoChat-Event", delivery.eventType)
+	req.Header.Set("X-GoChat-Delivery", strconv.Itoa(delivery.id))
+	req.Header.Set("X-GoChat-Timestamp", timestamp)
+	req.Header.Set("X-GoChat-Signature", "sha256="+signWebhook(webhook.secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// HMAC-SHA256 of "timestamp.body". receivers recompute it with their secret
+// and should reject old timestamps to prevent replays
+func signWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte{'.'})
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func generateWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+// room admins manage their room's webhooks, site admins the global ones
+func (h *Hub) checkWebhookAccess(userId int, roomId int) (int, error) {
+	if roomId == 0 {
+		admin, err := h.db.isAdmin(userId)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !admin {
+			return http.StatusForbidden, ErrNotSiteAdmin
+		}
+		return http.StatusOK, nil
+	}
+
+	role, err := h.db.getRoomRole(roomId, userId)
+	if errors.Is(err, NotRoomMemberError) {
+		return http.StatusForbidden, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if roleRank(role) < roleRank(RoleAdmin) {
+		return http.StatusForbidden, ErrNotRoomAdmin
+	}
+	return http.StatusOK, nil
+}
+
+// creates a webhook. the secret is only returned in this response
+func (h *Hub) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	type createWebhookRequest struct {
+		RoomId int      `json:"room_id"`
+		URL    string   `json:"url"`
+		Events []string `json:"events"`
+	}
+
+	var req createWebhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if status, err := h.checkWebhookAccess(userId, req.RoomId); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	target, err := url.Parse(req.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(w, "url must be an absolute http or https URL", http.StatusBadRequest)
+		return
+	}
+	if err := checkPublicHost(target); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Events) == 0 {
+		for event := range webhookEvents {
+			req.Events = append(req.Events, event)
+		}
+	}
+	for _, event := range req.Events {
+		if !webhookEvents[event] {
+			http.Error(w, fmt.Sprintf("unknown event %q", event), http.StatusBadRequest)
+			return
+		}
+	}
+
+	secret, err := generateWebhookSecret()
+	if err != nil {
+		http.Error(w, "Error generating secret", http.StatusInternalServerError)
+		return
+	}
+	creator, err := h.db.getUser(userId)
+	if err != nil {
+		http.Error(w, "Error retrieving user", http.StatusInternalServerError)
+		return
+	}
+
+	webhook := &Webhook{
+		RoomId: req.RoomId,
+		URL: target.String(),
+		Events: req.Events,
+		CreatedBy: creator.username,
+		secret: secret,
+		creatorId: creator.id,
+	}
+	if err := h.db.addWebhook(webhook); err != nil {
+		http.Error(w, "Error creating webhook", http.StatusInternalServerError)
+		return
+	}
+
+	type response struct {
+		*Webhook
+		Secret string `json:"secret"`
+	}
+	writeJSON(w, http.StatusCreated, response{Webhook: webhook, Secret: secret})
+}
+
+// lists the webhooks of ?room_id=, or the global ones without it
+func (h *Hub) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	roomId := 0
+	if v := r.URL.Query().Get("room_id"); v != "" {
+		roomId, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, "bad room_id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if status, err := h.checkWebhookAccess(userId, roomId); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	webhooks, err := h.db.getWebhooks(roomId)
+	if err != nil {
+		http.Error(w, "Error retrieving webhooks", http.StatusInternalServerError)
+		return
+	}
+	if webhooks == nil {
+		webhooks = []*Webhook{}
+	}
+	writeJSON(w, http.StatusOK, webhooks)
+}
+
+func (h *Hub) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	userId, err := authenticateRequest(r)
+	if err != nil {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, "bad webhook id", http.StatusBadRequest)
+		return
+	}
+
+	webhook, err := h.db.getWebhook(id)
+	if errors.Is(err, WebhookNotFoundError) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Error retrieving webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if status, err := h.checkWebhookAccess(userId, webhook.RoomId); err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	if err := h.db.deleteWebhook(id); err != nil {
+		http.Error(w, "Error deleting webhook", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
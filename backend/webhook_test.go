@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testWebhookConfig() WebhookConfig {
+	return WebhookConfig{
+		Timeout: Duration(5 * time.Second),
+		PollInterval: Duration(time.Second),
+		MaxAttempts: 5,
+		InitialBackoff: Duration(time.Second),
+		MaxBackoff: Duration(5 * time.Second),
+		BatchSize: 10,
+	}
+}
+
+// a dispatcher that can reach httptest servers
+func newTestWebhookDispatcher() *WebhookDispatcher {
+	d := newWebhookDispatcher(nil, testWebhookConfig())
+	d.addrFilter = testAddrFilter()
+	return d
+}
+
+func TestWebhookSignature(t *testing.T) {
+	const secret = "whsec_test"
+	const payload = `{"event":"new_message","room_id":1}`
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if string(body) != payload {
+			t.Errorf("body = %s, want %s", body, payload)
+		}
+		if r.Header.Get("X-GoChat-Event") != EventNewMessage || r.Header.Get("X-GoChat-Delivery") != "7" {
+			t.Errorf("event headers = %q %q", r.Header.Get("X-GoChat-Event"), r.Header.Get("X-GoChat-Delivery"))
+		}
+		// what a receiver does to verify the request
+		want := "sha256=" + signWebhook(secret, r.Header.Get("X-GoChat-Timestamp"), body)
+		if !hmac.Equal([]byte(r.Header.Get("X-GoChat-Signature")), []byte(want)) {
+			t.Errorf("signature = %s, want %s", r.Header.Get("X-GoChat-Signature"), want)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	d := newTestWebhookDispatcher()
+	webhook := &Webhook{Id: 1, URL: receiver.URL, secret: secret}
+	delivery := webhookDelivery{id: 7, webhookId: 1, eventType: EventNewMessage, payload: payload}
+	if err := d.send(context.Background(), webhook, delivery); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSignWebhook(t *testing.T) {
+	// HMAC-SHA256 of "1700000000.{}" with the key "secret"
+	const want = "b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := signWebhook("secret", "1700000000", []byte("{}")); got != want {
+		t.Errorf("signWebhook = %s, want %s", got, want)
+	}
+}
+
+// the receiver fails the first attempts, the delivery goes through once it recovers
+func TestWebhookRetryBackoff(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer receiver.Close()
+
+	d := newTestWebhookDispatcher()
+	webhook := &Webhook{Id: 1, URL: receiver.URL, secret: "whsec_test"}
+	delivery := webhookDelivery{id: 1, webhookId: 1, eventType: EventNewMessage, payload: "{}"}
+
+	var backoffs []time.Duration
+	for {
+		err := d.send(context.Background(), webhook, delivery)
+		if err == nil {
+			break
+		}
+		delivery.attempts++
+		backoff, retry := d.retryAfter(delivery.attempts)
+		if !retry {
+			t.Fatalf("dead lettered after %d attempts: %v", delivery.attempts, err)
+		}
+		backoffs = append(backoffs, backoff)
+	}
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}
+	if len(backoffs) != len(want) {
+		t.Fatalf("backoffs = %v, want %v", backoffs, want)
+	}
+	for i := range want {
+		if backoffs[i] != want[i] {
+			t.Errorf("backoffs = %v, want %v", backoffs, want)
+		}
+	}
+	if got := d.backoff(10); got != 5*time.Second {
+		t.Errorf("backoff(10) = %s, want it capped at 5s", got)
+	}
+}
+
+// a receiver that never recovers gets MaxAttempts attempts before the delivery is dead lettered
+func TestWebhookDeadLetter(t *testing.T) {
+	var calls atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "broken", http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	d := newTestWebhookDispatcher()
+	webhook := &Webhook{Id: 1, URL: receiver.URL, secret: "whsec_test"}
+	delivery := webhookDelivery{id: 1, webhookId: 1, eventType: EventNewMessage, payload: "{}"}
+
+	for {
+		err := d.send(context.Background(), webhook, delivery)
+		if err == nil {
+			t.Fatal("delivery succeeded against a broken receiver")
+		}
+		if !strings.Contains(err.Error(), "500") {
+			t.Errorf("error = %v, want the receiver's status", err)
+		}
+		delivery.attempts++
+		if _, retry := d.retryAfter(delivery.attempts); !retry {
+			break
+		}
+	}
+	if int(calls.Load()) != d.config.MaxAttempts {
+		t.Errorf("receiver got %d attempts, want %d", calls.Load(), d.config.MaxAttempts)
+	}
+}
+
+func TestWebhookDoesNotFollowRedirects(t *testing.T) {
+	var redirected atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/internal" {
+			redirected.Store(true)
+			return
+		}
+		http.Redirect(w, r, "/internal", http.StatusTemporaryRedirect)
+	}))
+	defer receiver.Close()
+
+	d := newTestWebhookDispatcher()
+	webhook := &Webhook{Id: 1, URL: receiver.URL, secret: "whsec_test"}
+	if err := d.send(context.Background(), webhook, webhookDelivery{id: 1, payload: "{}"}); err == nil {
+		t.Error("a redirect counted as a delivery")
+	}
+	if redirected.Load() {
+		t.Error("the redirect was followed")
+	}
+}
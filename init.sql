@@ -1,25 +1,285 @@
 CREATE TABLE IF NOT EXISTS rooms (
     id SERIAL PRIMARY KEY,
     name VARCHAR(255) NOT NULL,
-    capacity INT NOT NULL
+    capacity INT NOT NULL,
+    topic VARCHAR(255) NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    avatar VARCHAR(1024) NOT NULL DEFAULT '',
+    encrypted BOOLEAN NOT NULL DEFAULT FALSE,
+    -- public rooms can be found and joined by anyone
+    visibility VARCHAR(16) NOT NULL DEFAULT 'private',
+    -- NULL follows the server's default retention policy, 0 keeps messages forever
+    retention_days INT,
+    retention_messages INT
 );
 
+CREATE INDEX IF NOT EXISTS rooms_public ON rooms (id) WHERE visibility='public';
+
 CREATE TABLE IF NOT EXISTS users (
-    username VARCHAR(255) PRIMARY KEY,
+    id SERIAL PRIMARY KEY,
+    -- can be changed, everything else refers to users by id
+    username VARCHAR(255) NOT NULL UNIQUE,
     password VARCHAR(255) NOT NULL,
-    room_id INT REFERENCES rooms(id)
+    display_name VARCHAR(64) NOT NULL DEFAULT '',
+    -- reference to the user's avatar attachment
+    avatar VARCHAR(1024) NOT NULL DEFAULT '',
+    bio TEXT NOT NULL DEFAULT '',
+    status_text VARCHAR(128) NOT NULL DEFAULT '',
+    -- who can start a direct room with the user: everyone or contacts
+    direct_room_privacy VARCHAR(16) NOT NULL DEFAULT 'everyone',
+    -- who sees the user online: everyone, contacts or nobody
+    presence_privacy VARCHAR(16) NOT NULL DEFAULT 'everyone',
+    room_id INT REFERENCES rooms(id),
+    totp_secret VARCHAR(64),
+    totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    totp_last_step BIGINT NOT NULL DEFAULT 0,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    bot_owner_id INT REFERENCES users(id)
 );
 
+-- prefix search of search_users
+CREATE INDEX IF NOT EXISTS users_username_prefix ON users (lower(username) text_pattern_ops);
+CREATE INDEX IF NOT EXISTS users_display_name_prefix ON users (lower(display_name) text_pattern_ops);
+
 CREATE TABLE IF NOT EXISTS messages (
     id SERIAL PRIMARY KEY,
     message TEXT NOT NULL,
-    author VARCHAR(255) REFERENCES users(username),
+    author_id INT REFERENCES users(id),
     date_sent TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    room_id INT REFERENCES rooms(id)
+    room_id INT REFERENCES rooms(id),
+    from_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    -- JSON envelope of end-to-end encrypted messages, whose message is empty
+    envelope TEXT,
+    -- plain or markdown
+    format VARCHAR(16) NOT NULL DEFAULT 'plain',
+    -- sanitized rendering of markdown messages
+    html TEXT
 );
 
 CREATE TABLE IF NOT EXISTS room_users (
     room_id INT REFERENCES rooms(id),
-    username VARCHAR(255) REFERENCES users(username),
-    PRIMARY KEY (room_id, username)
+    user_id INT REFERENCES users(id),
+    role VARCHAR(16) NOT NULL DEFAULT 'member',
+    muted_until TIMESTAMP,
+    notification_level VARCHAR(16) NOT NULL DEFAULT 'all',
+    PRIMARY KEY (room_id, user_id)
 );
+
+CREATE TABLE IF NOT EXISTS pinned_messages (
+    room_id INT REFERENCES rooms(id),
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by INT REFERENCES users(id),
+    pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (room_id, message_id)
+);
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker INT REFERENCES users(id),
+    blocked INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker, blocked)
+);
+
+CREATE TABLE IF NOT EXISTS room_invites (
+    code VARCHAR(32) PRIMARY KEY,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    created_by INT REFERENCES users(id),
+    -- role given to whoever joins with the code
+    role VARCHAR(16) NOT NULL DEFAULT 'member',
+    -- NULL for no limit
+    max_uses INT,
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS room_invites_by_room ON room_invites (room_id);
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id SERIAL PRIMARY KEY,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    author_id INT REFERENCES users(id),
+    message TEXT NOT NULL,
+    envelope TEXT,
+    format VARCHAR(16) NOT NULL DEFAULT 'plain',
+    -- UTC
+    send_at TIMESTAMP NOT NULL,
+    -- pending, sending while it is being posted, or failed
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS scheduled_messages_due ON scheduled_messages (send_at) WHERE status='pending';
+CREATE INDEX IF NOT EXISTS scheduled_messages_by_author ON scheduled_messages (author_id);
+
+CREATE TABLE IF NOT EXISTS saved_messages (
+    user_id INT REFERENCES users(id),
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    saved_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id)
+);
+
+-- links that couldn't be previewed are kept without a title, so they aren't fetched again until the entry expires
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,
+    title TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    site_name TEXT NOT NULL DEFAULT '',
+    image TEXT NOT NULL DEFAULT '',
+    fetched_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS link_previews_by_age ON link_previews (fetched_at);
+
+-- a contact request from user_id to contact_id, both are contacts of each other once accepted
+CREATE TABLE IF NOT EXISTS contacts (
+    user_id INT REFERENCES users(id),
+    contact_id INT REFERENCES users(id),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, contact_id)
+);
+-- at most one request between two users, whoever sent it
+CREATE UNIQUE INDEX IF NOT EXISTS contacts_pair ON contacts (LEAST(user_id, contact_id), GREATEST(user_id, contact_id));
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    code_hash VARCHAR(255) NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT FALSE
+);
+
+-- room_id NULL means the webhook receives the events of every room
+CREATE TABLE IF NOT EXISTS webhooks (
+    id SERIAL PRIMARY KEY,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    url VARCHAR(2048) NOT NULL,
+    secret VARCHAR(255) NOT NULL,
+    events TEXT[] NOT NULL,
+    created_by INT REFERENCES users(id),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id SERIAL PRIMARY KEY,
+    webhook_id INT REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_due ON webhook_deliveries (next_attempt_at);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+    id SERIAL PRIMARY KEY,
+    webhook_id INT REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(64) NOT NULL,
+    payload TEXT NOT NULL,
+    attempts INT NOT NULL,
+    last_error TEXT NOT NULL,
+    created_at TIMESTAMP,
+    failed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS bot_tokens (
+    id SERIAL PRIMARY KEY,
+    bot_id INT REFERENCES users(id),
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- slash commands handed to the bot that registered them
+CREATE TABLE IF NOT EXISTS bot_commands (
+    command VARCHAR(32) PRIMARY KEY,
+    bot_id INT REFERENCES users(id),
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
+
+CREATE TABLE IF NOT EXISTS mentions (
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    user_id INT REFERENCES users(id),
+    -- mentioned through @room rather than by name
+    room_mention BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (message_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    kind VARCHAR(16) NOT NULL,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    actor_id INT REFERENCES users(id),
+    preview TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    read_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notifications_by_user ON notifications (user_id, id);
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id),
+    endpoint VARCHAR(2048) NOT NULL UNIQUE,
+    p256dh VARCHAR(255) NOT NULL,
+    auth VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- public keys of end-to-end encrypted rooms, the private keys never leave the clients
+CREATE TABLE IF NOT EXISTS identity_keys (
+    user_id INT PRIMARY KEY REFERENCES users(id),
+    identity_key VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS one_time_prekeys (
+    user_id INT REFERENCES users(id),
+    key_id INT NOT NULL,
+    public_key VARCHAR(255) NOT NULL,
+    PRIMARY KEY (user_id, key_id)
+);
+
+-- messages removed by the retention policy when retention.archive is set
+CREATE TABLE IF NOT EXISTS messages_archive (
+    id INT PRIMARY KEY,
+    message TEXT NOT NULL,
+    author_id INT REFERENCES users(id),
+    date_sent TIMESTAMP,
+    room_id INT REFERENCES rooms(id),
+    from_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    envelope TEXT,
+    format VARCHAR(16) NOT NULL DEFAULT 'plain',
+    html TEXT,
+    archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS messages_by_room ON messages (room_id, date_sent);
+
+CREATE TABLE IF NOT EXISTS data_exports (
+    id SERIAL PRIMARY KEY,
+    user_id INT REFERENCES users(id) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    file VARCHAR(255) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- no foreign key on user_id, it must not prevent the deletion and is cleared once done
+CREATE TABLE IF NOT EXISTS account_erasures (
+    id SERIAL PRIMARY KEY,
+    user_id INT,
+    requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- author of the messages of erased accounts, '!' is no bcrypt hash so nobody can log in as it
+INSERT INTO users (username, password) VALUES ('deleted-user', '!') ON CONFLICT (username) DO NOTHING;
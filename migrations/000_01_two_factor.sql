@@ -0,0 +1,14 @@
+-- adds two-factor authentication: the TOTP secret of users and their recovery codes
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_01_two_factor.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) REFERENCES users(username),
+    code_hash VARCHAR(255) NOT NULL,
+    used BOOLEAN NOT NULL DEFAULT FALSE
+);
@@ -0,0 +1,9 @@
+-- adds the topic, description and avatar of rooms and the role of their members.
+-- existing members become plain members, 010_room_owners.sql gives the rooms an owner
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_02_room_details.sql
+
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS topic VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS avatar VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE room_users ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'member';
@@ -0,0 +1,13 @@
+-- adds muting room members and pinned messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_03_moderation.sql
+
+ALTER TABLE room_users ADD COLUMN IF NOT EXISTS muted_until TIMESTAMP;
+
+CREATE TABLE IF NOT EXISTS pinned_messages (
+    room_id INT REFERENCES rooms(id),
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    pinned_by VARCHAR(255) REFERENCES users(username),
+    pinned_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (room_id, message_id)
+);
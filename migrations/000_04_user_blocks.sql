@@ -0,0 +1,10 @@
+-- adds user blocking
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_04_user_blocks.sql
+
+CREATE TABLE IF NOT EXISTS user_blocks (
+    blocker VARCHAR(255) REFERENCES users(username),
+    blocked VARCHAR(255) REFERENCES users(username),
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (blocker, blocked)
+);
@@ -0,0 +1,24 @@
+-- adds bot accounts, their API tokens and their commands
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_06_bots.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner VARCHAR(255) REFERENCES users(username);
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS from_bot BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS bot_tokens (
+    id SERIAL PRIMARY KEY,
+    bot VARCHAR(255) REFERENCES users(username),
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    scopes TEXT[] NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP
+);
+
+-- slash commands handed to the bot that registered them
+CREATE TABLE IF NOT EXISTS bot_commands (
+    command VARCHAR(32) PRIMARY KEY,
+    bot VARCHAR(255) REFERENCES users(username),
+    description VARCHAR(255) NOT NULL DEFAULT ''
+);
@@ -0,0 +1,27 @@
+-- adds notification levels, mentions and the notifications feed
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_07_notifications.sql
+
+ALTER TABLE room_users ADD COLUMN IF NOT EXISTS notification_level VARCHAR(16) NOT NULL DEFAULT 'all';
+
+CREATE TABLE IF NOT EXISTS mentions (
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    username VARCHAR(255) REFERENCES users(username),
+    -- mentioned through @room rather than by name
+    room_mention BOOLEAN NOT NULL DEFAULT FALSE,
+    PRIMARY KEY (message_id, username)
+);
+
+CREATE TABLE IF NOT EXISTS notifications (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) REFERENCES users(username),
+    kind VARCHAR(16) NOT NULL,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    actor VARCHAR(255) REFERENCES users(username),
+    preview TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    read_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notifications_by_user ON notifications (username, id);
@@ -0,0 +1,13 @@
+-- adds Web Push subscriptions
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_08_push.sql
+
+CREATE TABLE IF NOT EXISTS push_subscriptions (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) REFERENCES users(username),
+    endpoint VARCHAR(2048) NOT NULL UNIQUE,
+    p256dh VARCHAR(255) NOT NULL,
+    auth VARCHAR(255) NOT NULL,
+    user_agent VARCHAR(512) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
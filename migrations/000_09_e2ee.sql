@@ -0,0 +1,20 @@
+-- adds end-to-end encrypted rooms: the envelope of messages and the public keys of users
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_09_e2ee.sql
+
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS encrypted BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS envelope TEXT;
+
+-- public keys of end-to-end encrypted rooms, the private keys never leave the clients
+CREATE TABLE IF NOT EXISTS identity_keys (
+    username VARCHAR(255) PRIMARY KEY REFERENCES users(username),
+    identity_key VARCHAR(255) NOT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS one_time_prekeys (
+    username VARCHAR(255) REFERENCES users(username),
+    key_id INT NOT NULL,
+    public_key VARCHAR(255) NOT NULL,
+    PRIMARY KEY (username, key_id)
+);
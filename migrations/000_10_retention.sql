@@ -0,0 +1,20 @@
+-- adds the retention policies of rooms and the archive of purged messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_10_retention.sql
+
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS retention_days INT;
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS retention_messages INT;
+
+-- messages removed by the retention policy when retention.archive is set
+CREATE TABLE IF NOT EXISTS messages_archive (
+    id INT PRIMARY KEY,
+    message TEXT NOT NULL,
+    author VARCHAR(255) REFERENCES users(username),
+    date_sent TIMESTAMP,
+    room_id INT REFERENCES rooms(id),
+    from_bot BOOLEAN NOT NULL DEFAULT FALSE,
+    envelope TEXT,
+    archived_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS messages_by_room ON messages (room_id, date_sent);
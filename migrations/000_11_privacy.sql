@@ -0,0 +1,25 @@
+-- adds personal data exports, account erasures and the author of erased messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/000_11_privacy.sql
+
+CREATE TABLE IF NOT EXISTS data_exports (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255) REFERENCES users(username) ON DELETE CASCADE,
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    file VARCHAR(255) NOT NULL DEFAULT '',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- no foreign key on username, it must not prevent the deletion and is cleared once done
+CREATE TABLE IF NOT EXISTS account_erasures (
+    id SERIAL PRIMARY KEY,
+    username VARCHAR(255),
+    requested_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    started_at TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- author of the messages of erased accounts, '!' is no bcrypt hash so nobody can log in as it
+INSERT INTO users (username, password) VALUES ('deleted-user', '!') ON CONFLICT DO NOTHING;
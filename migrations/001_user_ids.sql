@@ -0,0 +1,71 @@
+-- moves a database created before users had ids to the schema of init.sql:
+-- users get a numeric id as primary key and every reference to a user goes
+-- through it, so usernames can change.
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/001_user_ids.sql
+--
+-- every row referring to a user keeps referring to the same user.
+-- stop the server first, it can't run against the old schema
+
+ALTER TABLE users ADD COLUMN id SERIAL;
+
+-- adds column to table, filled with the id of the user named in old_column,
+-- then drops old_column along with its foreign key and the keys it is part of
+CREATE FUNCTION pg_temp.to_user_id(tbl TEXT, old_column TEXT, new_column TEXT) RETURNS VOID AS $$
+BEGIN
+    EXECUTE format('ALTER TABLE %I ADD COLUMN %I INT', tbl, new_column || '_new');
+    EXECUTE format('UPDATE %I t SET %I = u.id FROM users u WHERE u.username = t.%I', tbl, new_column || '_new', old_column);
+    EXECUTE format('ALTER TABLE %I DROP COLUMN %I', tbl, old_column);
+    EXECUTE format('ALTER TABLE %I RENAME COLUMN %I TO %I', tbl, new_column || '_new', new_column);
+END
+$$ LANGUAGE plpgsql;
+
+SELECT pg_temp.to_user_id('users', 'bot_owner', 'bot_owner_id');
+SELECT pg_temp.to_user_id('messages', 'author', 'author_id');
+SELECT pg_temp.to_user_id('messages_archive', 'author', 'author_id');
+SELECT pg_temp.to_user_id('room_users', 'username', 'user_id');
+SELECT pg_temp.to_user_id('pinned_messages', 'pinned_by', 'pinned_by');
+SELECT pg_temp.to_user_id('user_blocks', 'blocker', 'blocker');
+SELECT pg_temp.to_user_id('user_blocks', 'blocked', 'blocked');
+SELECT pg_temp.to_user_id('recovery_codes', 'username', 'user_id');
+SELECT pg_temp.to_user_id('webhooks', 'created_by', 'created_by');
+SELECT pg_temp.to_user_id('bot_tokens', 'bot', 'bot_id');
+SELECT pg_temp.to_user_id('bot_commands', 'bot', 'bot_id');
+SELECT pg_temp.to_user_id('mentions', 'username', 'user_id');
+SELECT pg_temp.to_user_id('notifications', 'username', 'user_id');
+SELECT pg_temp.to_user_id('notifications', 'actor', 'actor_id');
+SELECT pg_temp.to_user_id('push_subscriptions', 'username', 'user_id');
+SELECT pg_temp.to_user_id('identity_keys', 'username', 'user_id');
+SELECT pg_temp.to_user_id('one_time_prekeys', 'username', 'user_id');
+SELECT pg_temp.to_user_id('data_exports', 'username', 'user_id');
+SELECT pg_temp.to_user_id('account_erasures', 'username', 'user_id');
+
+-- nothing refers to the username anymore
+ALTER TABLE users DROP CONSTRAINT users_pkey;
+ALTER TABLE users ADD PRIMARY KEY (id);
+ALTER TABLE users ADD CONSTRAINT users_username_key UNIQUE (username);
+
+ALTER TABLE users ADD FOREIGN KEY (bot_owner_id) REFERENCES users(id);
+ALTER TABLE messages ADD FOREIGN KEY (author_id) REFERENCES users(id);
+ALTER TABLE messages_archive ADD FOREIGN KEY (author_id) REFERENCES users(id);
+ALTER TABLE room_users ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE room_users ADD PRIMARY KEY (room_id, user_id);
+ALTER TABLE pinned_messages ADD FOREIGN KEY (pinned_by) REFERENCES users(id);
+ALTER TABLE user_blocks ADD FOREIGN KEY (blocker) REFERENCES users(id);
+ALTER TABLE user_blocks ADD FOREIGN KEY (blocked) REFERENCES users(id);
+ALTER TABLE user_blocks ADD PRIMARY KEY (blocker, blocked);
+ALTER TABLE recovery_codes ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE webhooks ADD FOREIGN KEY (created_by) REFERENCES users(id);
+ALTER TABLE bot_tokens ADD FOREIGN KEY (bot_id) REFERENCES users(id);
+ALTER TABLE bot_commands ADD FOREIGN KEY (bot_id) REFERENCES users(id);
+ALTER TABLE mentions ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE mentions ADD PRIMARY KEY (message_id, user_id);
+ALTER TABLE notifications ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE notifications ADD FOREIGN KEY (actor_id) REFERENCES users(id);
+CREATE INDEX IF NOT EXISTS notifications_by_user ON notifications (user_id, id);
+ALTER TABLE push_subscriptions ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE identity_keys ADD PRIMARY KEY (user_id);
+ALTER TABLE identity_keys ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE one_time_prekeys ADD FOREIGN KEY (user_id) REFERENCES users(id);
+ALTER TABLE one_time_prekeys ADD PRIMARY KEY (user_id, key_id);
+ALTER TABLE data_exports ADD FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
@@ -0,0 +1,11 @@
+-- adds the profile fields of users and the indexes of search_users
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/002_user_profiles.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name VARCHAR(64) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS avatar VARCHAR(1024) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bio TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS status_text VARCHAR(128) NOT NULL DEFAULT '';
+
+CREATE INDEX IF NOT EXISTS users_username_prefix ON users (lower(username) text_pattern_ops);
+CREATE INDEX IF NOT EXISTS users_display_name_prefix ON users (lower(display_name) text_pattern_ops);
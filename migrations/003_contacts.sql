@@ -0,0 +1,15 @@
+-- adds contacts and the privacy settings of users
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/003_contacts.sql
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS direct_room_privacy VARCHAR(16) NOT NULL DEFAULT 'everyone';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS presence_privacy VARCHAR(16) NOT NULL DEFAULT 'everyone';
+
+CREATE TABLE IF NOT EXISTS contacts (
+    user_id INT REFERENCES users(id),
+    contact_id INT REFERENCES users(id),
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, contact_id)
+);
+CREATE UNIQUE INDEX IF NOT EXISTS contacts_pair ON contacts (LEAST(user_id, contact_id), GREATEST(user_id, contact_id));
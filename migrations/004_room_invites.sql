@@ -0,0 +1,17 @@
+-- adds the invite codes of rooms
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/004_room_invites.sql
+
+CREATE TABLE IF NOT EXISTS room_invites (
+    code VARCHAR(32) PRIMARY KEY,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    created_by INT REFERENCES users(id),
+    -- role given to whoever joins with the code
+    role VARCHAR(16) NOT NULL DEFAULT 'member',
+    -- NULL for no limit
+    max_uses INT,
+    uses INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS room_invites_by_room ON room_invites (room_id);
@@ -0,0 +1,6 @@
+-- adds the visibility of rooms
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/005_public_rooms.sql
+
+ALTER TABLE rooms ADD COLUMN IF NOT EXISTS visibility VARCHAR(16) NOT NULL DEFAULT 'private';
+CREATE INDEX IF NOT EXISTS rooms_public ON rooms (id) WHERE visibility='public';
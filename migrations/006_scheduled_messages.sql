@@ -0,0 +1,19 @@
+-- adds scheduled messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/006_scheduled_messages.sql
+
+CREATE TABLE IF NOT EXISTS scheduled_messages (
+    id SERIAL PRIMARY KEY,
+    room_id INT REFERENCES rooms(id) ON DELETE CASCADE,
+    author_id INT REFERENCES users(id),
+    message TEXT NOT NULL,
+    envelope TEXT,
+    -- UTC
+    send_at TIMESTAMP NOT NULL,
+    -- pending, sending while it is being posted, or failed
+    status VARCHAR(16) NOT NULL DEFAULT 'pending',
+    error TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS scheduled_messages_due ON scheduled_messages (send_at) WHERE status='pending';
+CREATE INDEX IF NOT EXISTS scheduled_messages_by_author ON scheduled_messages (author_id);
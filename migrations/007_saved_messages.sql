@@ -0,0 +1,10 @@
+-- adds saved messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/007_saved_messages.sql
+
+CREATE TABLE IF NOT EXISTS saved_messages (
+    user_id INT REFERENCES users(id),
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE,
+    saved_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (user_id, message_id)
+);
@@ -0,0 +1,14 @@
+-- adds the link preview cache
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/008_link_previews.sql
+
+-- links that couldn't be previewed are kept without a title, so they aren't fetched again until the entry expires
+CREATE TABLE IF NOT EXISTS link_previews (
+    url TEXT PRIMARY KEY,
+    title TEXT NOT NULL DEFAULT '',
+    description TEXT NOT NULL DEFAULT '',
+    site_name TEXT NOT NULL DEFAULT '',
+    image TEXT NOT NULL DEFAULT '',
+    fetched_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS link_previews_by_age ON link_previews (fetched_at);
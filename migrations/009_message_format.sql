@@ -0,0 +1,9 @@
+-- adds the format of messages and the rendering of markdown messages
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/009_message_format.sql
+
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS format VARCHAR(16) NOT NULL DEFAULT 'plain';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS html TEXT;
+ALTER TABLE messages_archive ADD COLUMN IF NOT EXISTS format VARCHAR(16) NOT NULL DEFAULT 'plain';
+ALTER TABLE messages_archive ADD COLUMN IF NOT EXISTS html TEXT;
+ALTER TABLE scheduled_messages ADD COLUMN IF NOT EXISTS format VARCHAR(16) NOT NULL DEFAULT 'plain';
@@ -0,0 +1,16 @@
+-- gives an owner to the rooms that have none: rooms created before rooms had
+-- roles, and direct rooms, whose two members used to be both admins
+--
+--     psql -v ON_ERROR_STOP=1 -1 -f migrations/010_room_owners.sql
+--
+-- the owner is the room's admin with the lowest id, or its member with the
+-- lowest id when it has no admin. empty rooms stay without an owner
+
+UPDATE room_users ru SET role = 'owner'
+FROM (
+    SELECT DISTINCT ON (room_id) room_id, user_id
+    FROM room_users
+    WHERE room_id NOT IN (SELECT room_id FROM room_users WHERE role = 'owner')
+    ORDER BY room_id, role = 'admin' DESC, user_id
+) o
+WHERE ru.room_id = o.room_id AND ru.user_id = o.user_id;